@@ -0,0 +1,521 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+const (
+	// apiDefaultPageSize and apiMaxPageSize limit the number of items in
+	// API list responses.
+	apiDefaultPageSize = 50
+	apiMaxPageSize     = 500
+)
+
+// APIError is the body of all API v2 error responses.
+type APIError struct {
+	Error APIErrorDetails `json:"error"`
+}
+
+type APIErrorDetails struct {
+	// Code is a machine-readable error code, eg. not_found.
+	Code string `json:"code"`
+	// Message is a human-readable description of the error.
+	Message string `json:"message"`
+}
+
+// APIList is the body of API v2 list responses. Lists are sorted by a unique
+// key, and can be paginated with the page_size and page_token parameters.
+type APIList struct {
+	Items any `json:"items"`
+	// NextPageToken is passed as page_token to get the next page, if any.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+type APIPresence struct {
+	APIList
+	// Anonymous is the number of present users who don't want to be named.
+	Anonymous int `json:"anonymous"`
+}
+
+type APIPresentUser struct {
+	Login     string    `json:"login"`
+	Manual    bool      `json:"manual,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Emoji     string    `json:"emoji,omitempty"`
+	ArrivedAt time.Time `json:"arrived_at"`
+	Devices   int       `json:"devices"`
+}
+
+type APIDevice struct {
+	MACAddress             string     `json:"mac_address"`
+	AdditionalMACAddresses []string   `json:"additional_mac_addresses"`
+	Hostname               string     `json:"hostname"`
+	Name                   string     `json:"name,omitempty"`
+	Type                   DeviceType `json:"type,omitempty"`
+	Notes                  string     `json:"notes,omitempty"`
+	Owner                  string     `json:"owner"`
+	ClientID               string     `json:"client_id,omitempty"`
+	MatchClientID          bool       `json:"match_client_id"`
+	MatchHostname          bool       `json:"match_hostname"`
+	Visibility             Visibility `json:"visibility"`
+	ClaimedAt              *time.Time `json:"claimed_at,omitempty"`
+	LastSeenAt             *time.Time `json:"last_seen_at,omitempty"`
+	Stale                  bool       `json:"stale"`
+}
+
+// APIDeviceUpdate is the body of device PATCH requests. Only given fields are
+// changed.
+type APIDeviceUpdate struct {
+	Name  *string     `json:"name"`
+	Type  *DeviceType `json:"type"`
+	Notes *string     `json:"notes"`
+}
+
+type APILease struct {
+	IPAddress  string     `json:"ip_address"`
+	MACAddress string     `json:"mac_address"`
+	Hostname   string     `json:"hostname,omitempty"`
+	Vendor     string     `json:"vendor,omitempty"`
+	Randomized bool       `json:"randomized"`
+	ClientID   string     `json:"client_id,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RenewedAt  *time.Time `json:"renewed_at,omitempty"`
+	// Owner is the user who claimed the device holding the lease, if any.
+	Owner     string `json:"owner,omitempty"`
+	Equipment bool   `json:"equipment"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newAPIDevice(d *Device) *APIDevice {
+	additional := d.AdditionalMACAddresses
+	if additional == nil {
+		additional = []string{}
+	}
+	return &APIDevice{
+		MACAddress:             d.MACAddress,
+		AdditionalMACAddresses: additional,
+		Hostname:               d.Hostname,
+		Name:                   d.Name,
+		Type:                   d.Type,
+		Notes:                  d.Notes,
+		Owner:                  d.UserNickname,
+		ClientID:               d.ClientID,
+		MatchClientID:          d.MatchClientID,
+		MatchHostname:          d.MatchHostname,
+		Visibility:             d.Visibility,
+		ClaimedAt:              optionalTime(d.ClaimedAt),
+		LastSeenAt:             optionalTime(d.LastSeenAt),
+		Stale:                  d.Stale,
+	}
+}
+
+// writeAPIJSON writes a successful API response.
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Warningf("Could not write API response: %v", err)
+	}
+}
+
+// writeAPIError writes an API error response.
+func writeAPIError(w http.ResponseWriter, status int, code, format string, args ...any) {
+	writeAPIJSON(w, status, &APIError{
+		Error: APIErrorDetails{
+			Code:    code,
+			Message: fmt.Sprintf(format, args...),
+		},
+	})
+}
+
+// apiCaller is an authenticated API client.
+type apiCaller struct {
+	// Username is the calling user, or empty for API users (see -api_users),
+	// which can only read presence.
+	Username string
+	Admin    bool
+}
+
+// hashAPIToken returns the hash of an API token, as stored in the database.
+func hashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// apiAuth authenticates an API request, by user API token (as a bearer
+// token), API user (basic auth) or session cookie. State-changing requests
+// authenticated by session cookie must carry the session's CSRF token in the
+// X-CSRF-Token header. If the request isn't authenticated, an error is
+// returned to the client and nil is returned.
+func (s *Service) apiAuth(w http.ResponseWriter, r *http.Request) *apiCaller {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		user, err := s.Database.GetUserByAPIToken(hashAPIToken(strings.TrimPrefix(auth, "Bearer ")))
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get user: %v", err)
+			return nil
+		}
+		if user == nil {
+			writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "Invalid API token.")
+			return nil
+		}
+		return &apiCaller{Username: user.Username, Admin: s.isAdmin(user.Username)}
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		if !s.authorized(username, password) {
+			writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "Invalid API user.")
+			return nil
+		}
+		return &apiCaller{}
+	}
+	if session := s.Sessions.Get(r); session != nil && session.Username != "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			token := r.Header.Get("X-CSRF-Token")
+			if session.CSRFToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+				writeAPIError(w, http.StatusForbidden, "csrf", "Invalid or missing X-CSRF-Token header.")
+				return nil
+			}
+		}
+		return &apiCaller{Username: session.Username, Admin: s.isAdmin(session.Username)}
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "Authentication required.")
+	return nil
+}
+
+// apiUser authenticates an API request which needs a user (not an API user).
+func (s *Service) apiUser(w http.ResponseWriter, r *http.Request) *apiCaller {
+	caller := s.apiAuth(w, r)
+	if caller != nil && caller.Username == "" {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "API users can only read presence, use an API token.")
+		return nil
+	}
+	return caller
+}
+
+// apiAdmin authenticates an API request which needs an admin.
+func (s *Service) apiAdmin(w http.ResponseWriter, r *http.Request) *apiCaller {
+	caller := s.apiUser(w, r)
+	if caller != nil && !caller.Admin {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "You are not an admin.")
+		return nil
+	}
+	return caller
+}
+
+// apiMethod makes sure a request uses one of the given methods, returning an
+// error to the client otherwise.
+func apiMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method %s not allowed.", r.Method)
+	return false
+}
+
+// paginate returns the page of items requested by the page_size and
+// page_token parameters. Items must be sorted by key, which must be unique.
+// The returned token is empty on the last page. Errors are returned to the
+// client, in which case ok is false.
+func paginate[T any](w http.ResponseWriter, r *http.Request, items []T, key func(T) string) (page []T, next string, ok bool) {
+	size := apiDefaultPageSize
+	if v := r.URL.Query().Get("page_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxPageSize {
+			writeAPIError(w, http.StatusBadRequest, "invalid_argument", "page_size must be between 1 and %d.", apiMaxPageSize)
+			return nil, "", false
+		}
+		size = n
+	}
+	// The page token is the key of the last item of the previous page, so
+	// that pagination is stable when items are added or removed.
+	if after := r.URL.Query().Get("page_token"); after != "" {
+		start := sort.Search(len(items), func(i int) bool { return key(items[i]) > after })
+		items = items[start:]
+	}
+	if len(items) > size {
+		return items[:size], key(items[size-1]), true
+	}
+	return items, "", true
+}
+
+func (s *Service) viewAPIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+func (s *Service) viewAPINotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", "No such API endpoint.")
+}
+
+func (s *Service) viewAPIPresence(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, http.MethodGet) || s.apiAuth(w, r) == nil {
+		return
+	}
+	presence, err := s.getPresence()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get presence: %v", err)
+		return
+	}
+	users, next, ok := paginate(w, r, presence.Users, func(u PresentUser) string { return u.Name })
+	if !ok {
+		return
+	}
+	items := make([]*APIPresentUser, 0, len(users))
+	for _, u := range users {
+		items = append(items, &APIPresentUser{
+			Login:     u.Name,
+			Manual:    u.Manual,
+			Status:    u.Status,
+			Emoji:     u.Emoji,
+			ArrivedAt: u.ArrivedAt,
+			Devices:   u.Devices,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, &APIPresence{
+		APIList:   APIList{Items: items, NextPageToken: next},
+		Anonymous: presence.Anonymous,
+	})
+}
+
+// writeAPIDevices writes a page of devices, which must be sorted by MAC
+// address.
+func writeAPIDevices(w http.ResponseWriter, r *http.Request, devices []*Device) {
+	devices, next, ok := paginate(w, r, devices, func(d *Device) string { return d.MACAddress })
+	if !ok {
+		return
+	}
+	items := make([]*APIDevice, 0, len(devices))
+	for _, d := range devices {
+		items = append(items, newAPIDevice(d))
+	}
+	writeAPIJSON(w, http.StatusOK, &APIList{Items: items, NextPageToken: next})
+}
+
+func (s *Service) viewAPIDevices(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, http.MethodGet) {
+		return
+	}
+	caller := s.apiUser(w, r)
+	if caller == nil {
+		return
+	}
+	devices, err := s.Database.GetDevicesForUser(caller.Username)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get devices: %v", err)
+		return
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].MACAddress < devices[j].MACAddress })
+	writeAPIDevices(w, r, devices)
+}
+
+// viewAPIDevice gets, updates the metadata of (PATCH) or unclaims (DELETE) one of the caller's
+// devices, given by any of its MAC addresses.
+func (s *Service) viewAPIDevice(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete) {
+		return
+	}
+	caller := s.apiUser(w, r)
+	if caller == nil {
+		return
+	}
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_argument", "Invalid MAC address.")
+		return
+	}
+	// Look the device up first, so that devices of others are
+	// indistinguishable from nonexistent ones.
+	devices, err := s.Database.GetDevicesForMacAddresses([]net.HardwareAddr{mac})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get device: %v", err)
+		return
+	}
+	if len(devices) == 0 || devices[0].UserNickname != caller.Username {
+		writeAPIError(w, http.StatusNotFound, "not_found", "You have no device with address %s.", mac)
+		return
+	}
+	device := devices[0]
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAPIJSON(w, http.StatusOK, newAPIDevice(device))
+	case http.MethodDelete:
+		if err := s.Database.UnclaimDevice(caller.Username, mac); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", "Could not unclaim device: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		var update APIDeviceUpdate
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&update); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_argument", "Invalid request body: %v", err)
+			return
+		}
+		metadata := device.Metadata()
+		if update.Name != nil {
+			metadata.Name = strings.TrimSpace(*update.Name)
+		}
+		if update.Type != nil {
+			metadata.Type = *update.Type
+		}
+		if update.Notes != nil {
+			metadata.Notes = strings.TrimSpace(*update.Notes)
+		}
+		if err := metadata.validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_argument", "%v", err)
+			return
+		}
+		if err := s.Database.SetDeviceMetadata(caller.Username, mac, metadata); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", "Could not update device: %v", err)
+			return
+		}
+		device.Name, device.Type, device.Notes = metadata.Name, metadata.Type, metadata.Notes
+		writeAPIJSON(w, http.StatusOK, newAPIDevice(device))
+	}
+}
+
+func (s *Service) viewAPIAdminDevices(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, http.MethodGet) || s.apiAdmin(w, r) == nil {
+		return
+	}
+	devices, err := s.Database.GetDevices()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get devices: %v", err)
+		return
+	}
+	writeAPIDevices(w, r, devices)
+}
+
+// viewAPIAdminLeases lists active leases, along with who they belong to.
+func (s *Service) viewAPIAdminLeases(w http.ResponseWriter, r *http.Request) {
+	if !apiMethod(w, r, http.MethodGet) || s.apiAdmin(w, r) == nil {
+		return
+	}
+	leases, err := s.cfg().Leases.Leases()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get leases: %v", err)
+		return
+	}
+	now := time.Now()
+	var active []*Lease
+	for _, lease := range leases {
+		if s.leaseActiveUntil(lease).After(now) {
+			active = append(active, lease)
+		}
+	}
+	// Lease sources might return the same MAC address more than once.
+	sort.SliceStable(active, func(i, j int) bool { return active[i].MACAddress.String() < active[j].MACAddress.String() })
+	dedup := active[:0]
+	for _, lease := range active {
+		if len(dedup) > 0 && dedup[len(dedup)-1].MACAddress.String() == lease.MACAddress.String() {
+			if lease.Expires.After(dedup[len(dedup)-1].Expires) {
+				dedup[len(dedup)-1] = lease
+			}
+			continue
+		}
+		dedup = append(dedup, lease)
+	}
+	page, next, ok := paginate(w, r, dedup, func(l *Lease) string { return l.MACAddress.String() })
+	if !ok {
+		return
+	}
+
+	equipment, err := s.Database.GetEquipment()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get equipment: %v", err)
+		return
+	}
+	isEquipment := make(map[string]bool)
+	for _, e := range equipment {
+		isEquipment[e.MACAddress] = true
+	}
+	devices, err := s.Database.GetDevicesForLeases(page)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "Could not get devices: %v", err)
+		return
+	}
+	items := make([]*APILease, 0, len(page))
+	for _, lease := range page {
+		item := &APILease{
+			IPAddress:  lease.IPAddress.String(),
+			MACAddress: lease.MACAddress.String(),
+			Hostname:   lease.Hostname,
+			Vendor:     macVendor(lease.MACAddress),
+			Randomized: lease.Randomized(),
+			ClientID:   lease.ClientID,
+			ExpiresAt:  lease.Expires,
+			RenewedAt:  optionalTime(lease.RenewedAt),
+			Equipment:  isEquipment[lease.MACAddress.String()],
+		}
+		if d := leaseOwner(devices, lease); d != nil {
+			item.Owner = d.UserNickname
+		}
+		items = append(items, item)
+	}
+	writeAPIJSON(w, http.StatusOK, &APIList{Items: items, NextPageToken: next})
+}
+
+// viewAPIToken generates a new API token for the user, replacing any previous
+// one, or revokes it.
+func (s *Service) viewAPIToken(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	if r.PostFormValue("action") == "revoke" {
+		if err := s.Database.SetUserAPIToken(session.Username, ""); err != nil {
+			fmt.Fprintf(w, "Could not revoke API token: %v", err)
+			return
+		}
+		http.Redirect(w, r, "/manage", http.StatusFound)
+		return
+	}
+
+	token, err := generateSecret()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not generate API token: %v", err)
+		return
+	}
+	if err := s.Database.SetUserAPIToken(session.Username, hashAPIToken(token)); err != nil {
+		fmt.Fprintf(w, "Could not set API token: %v", err)
+		return
+	}
+	templateAPIToken.Execute(w, map[string]any{
+		"Username":  session.Username,
+		"Token":     token,
+		"SpaceName": s.cfg().SpaceName,
+		"SpaceURL":  s.cfg().SpaceURL,
+	})
+}
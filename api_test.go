@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// apiRequest serves an API request through the same mux as the server.
+func (s *Service) apiRequest(method, path, body string, auth func(r *http.Request)) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/", s.viewAPINotFound)
+	mux.HandleFunc("/api/v2/openapi.json", s.viewAPIOpenAPI)
+	mux.HandleFunc("/api/v2/presence", s.viewAPIPresence)
+	mux.HandleFunc("/api/v2/devices", s.viewAPIDevices)
+	mux.HandleFunc("/api/v2/devices/{mac}", s.viewAPIDevice)
+	mux.HandleFunc("/api/v2/admin/devices", s.viewAPIAdminDevices)
+	mux.HandleFunc("/api/v2/admin/leases", s.viewAPIAdminLeases)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != nil {
+		auth(r)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// apiErrorCode returns the error code of an API error response.
+func apiErrorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var e APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("invalid error body %q: %v", w.Body.String(), err)
+	}
+	return e.Error.Code
+}
+
+func TestAPI(t *testing.T) {
+	s := newTestService(t)
+	s.cfg().Admins = []string{"admin"}
+	s.cfg().APIUsers = []APIUser{{"api", "secret"}}
+	for _, user := range []string{"alice", "admin"} {
+		if err := s.Database.SetUserAPIToken(user, hashAPIToken(user+"-token")); err != nil {
+			t.Fatalf("could not set API token: %v", err)
+		}
+	}
+	for i, mac := range []string{"00:11:22:33:44:55", "00:00:00:00:00:02", "00:00:00:00:00:01"} {
+		if err := s.Database.ClaimDevice("alice", mustParseMAC(mac), "device"+string(rune('a'+i)), ""); err != nil {
+			t.Fatalf("could not claim device: %v", err)
+		}
+	}
+	if err := s.Database.ClaimDevice("bob", mustParseMAC("00:00:00:00:00:03"), "bobs", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+
+	// Errors are JSON.
+	for _, tc := range []struct {
+		method, path string
+		auth         func(r *http.Request)
+		status       int
+		code         string
+	}{
+		{"GET", "/api/v2/devices", nil, http.StatusUnauthorized, "unauthenticated"},
+		{"GET", "/api/v2/devices", bearer("wrong"), http.StatusUnauthorized, "unauthenticated"},
+		{"GET", "/api/v2/devices", func(r *http.Request) { r.SetBasicAuth("api", "secret") }, http.StatusForbidden, "forbidden"},
+		{"GET", "/api/v2/admin/devices", bearer("alice-token"), http.StatusForbidden, "forbidden"},
+		{"POST", "/api/v2/devices", bearer("alice-token"), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"GET", "/api/v2/devices?page_size=1000", bearer("alice-token"), http.StatusBadRequest, "invalid_argument"},
+		{"GET", "/api/v2/devices/00:00:00:00:00:03", bearer("alice-token"), http.StatusNotFound, "not_found"},
+		{"GET", "/api/v2/nope", bearer("alice-token"), http.StatusNotFound, "not_found"},
+	} {
+		w := s.apiRequest(tc.method, tc.path, "", tc.auth)
+		if w.Code != tc.status || apiErrorCode(t, w) != tc.code {
+			t.Errorf("%s %s: got %d %s, want %d %s", tc.method, tc.path, w.Code, w.Body.String(), tc.status, tc.code)
+		}
+	}
+
+	// Devices are paginated.
+	var macs []string
+	token := ""
+	for i := 0; ; i++ {
+		w := s.apiRequest("GET", "/api/v2/devices?page_size=2&page_token="+token, "", bearer("alice-token"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("list devices: got %d: %s", w.Code, w.Body.String())
+		}
+		var res struct {
+			Items         []APIDevice `json:"items"`
+			NextPageToken string      `json:"next_page_token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("invalid body: %v", err)
+		}
+		for _, d := range res.Items {
+			macs = append(macs, d.MACAddress)
+		}
+		if token = res.NextPageToken; token == "" {
+			break
+		}
+		if i > 2 {
+			t.Fatalf("too many pages")
+		}
+	}
+	if diff := cmp.Diff([]string{"00:00:00:00:00:01", "00:00:00:00:00:02", "00:11:22:33:44:55"}, macs); diff != "" {
+		t.Errorf("devices: %s", diff)
+	}
+
+	// Updating metadata and unclaiming.
+	w := s.apiRequest("PATCH", "/api/v2/devices/00:00:00:00:00:01", `{"name": "work laptop", "type": "laptop"}`, bearer("alice-token"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"work laptop","type":"laptop"`) {
+		t.Errorf("update: got %d: %s", w.Code, w.Body.String())
+	}
+	w = s.apiRequest("PATCH", "/api/v2/devices/00:00:00:00:00:01", `{"notes": "mine"}`, bearer("alice-token"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"work laptop","type":"laptop","notes":"mine"`) {
+		t.Errorf("partial update: got %d: %s", w.Code, w.Body.String())
+	}
+	w = s.apiRequest("PATCH", "/api/v2/devices/00:00:00:00:00:01", `{"type": "toaster"}`, bearer("alice-token"))
+	if w.Code != http.StatusBadRequest || apiErrorCode(t, w) != "invalid_argument" {
+		t.Errorf("invalid type: got %d: %s", w.Code, w.Body.String())
+	}
+	w = s.apiRequest("PATCH", "/api/v2/devices/00:00:00:00:00:01", `{"hostname": "laptop"}`, bearer("alice-token"))
+	if w.Code != http.StatusBadRequest || apiErrorCode(t, w) != "invalid_argument" {
+		t.Errorf("hostname update: got %d: %s", w.Code, w.Body.String())
+	}
+	w = s.apiRequest("DELETE", "/api/v2/devices/00:00:00:00:00:02", "", bearer("alice-token"))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("unclaim: got %d: %s", w.Code, w.Body.String())
+	}
+	devices, err := s.Database.GetDevicesForUser("alice")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Errorf("expected 2 devices left, got %d", len(devices))
+	}
+
+	// Session cookies need the CSRF token for changes.
+	cookies := s.sessionCookies(&Session{Username: "alice", CSRFToken: "csrf", ExpiresAt: time.Now().Add(time.Hour)})
+	withSession := func(csrf string) func(r *http.Request) {
+		return func(r *http.Request) {
+			for _, c := range cookies {
+				r.AddCookie(c)
+			}
+			if csrf != "" {
+				r.Header.Set("X-CSRF-Token", csrf)
+			}
+		}
+	}
+	if w := s.apiRequest("GET", "/api/v2/devices", "", withSession("")); w.Code != http.StatusOK {
+		t.Errorf("session GET: got %d: %s", w.Code, w.Body.String())
+	}
+	if w := s.apiRequest("DELETE", "/api/v2/devices/00:00:00:00:00:01", "", withSession("")); w.Code != http.StatusForbidden || apiErrorCode(t, w) != "csrf" {
+		t.Errorf("session DELETE without CSRF token: got %d: %s", w.Code, w.Body.String())
+	}
+	if w := s.apiRequest("DELETE", "/api/v2/devices/00:00:00:00:00:01", "", withSession("csrf")); w.Code != http.StatusNoContent {
+		t.Errorf("session DELETE: got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Presence includes arrival time and device count.
+	w = s.apiRequest("GET", "/api/v2/presence", "", func(r *http.Request) { r.SetBasicAuth("api", "secret") })
+	var presence struct {
+		Items     []APIPresentUser `json:"items"`
+		Anonymous int              `json:"anonymous"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &presence); err != nil {
+		t.Fatalf("invalid presence body %q: %v", w.Body.String(), err)
+	}
+	if len(presence.Items) != 1 || presence.Items[0].Login != "alice" || presence.Items[0].Devices != 1 || presence.Items[0].ArrivedAt.IsZero() {
+		t.Errorf("presence: got %s", w.Body.String())
+	}
+
+	// Admins see everything.
+	w = s.apiRequest("GET", "/api/v2/admin/devices", "", bearer("admin-token"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"owner":"bob"`) {
+		t.Errorf("admin devices: got %d: %s", w.Code, w.Body.String())
+	}
+	w = s.apiRequest("GET", "/api/v2/admin/leases", "", bearer("admin-token"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ip_address":"10.1.0.23","mac_address":"00:11:22:33:44:55","hostname":"laptop"`) || !strings.Contains(w.Body.String(), `"owner":"alice"`) {
+		t.Errorf("admin leases: got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAPIOpenAPI(t *testing.T) {
+	s := newTestService(t)
+	w := s.apiRequest("GET", "/api/v2/openapi.json", "", nil)
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	// Every documented operation exists.
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			path := strings.ReplaceAll(path, "{mac}", "00:00:00:00:00:09")
+			w := s.apiRequest(strings.ToUpper(method), "/api/v2"+path, "", nil)
+			if w.Code == http.StatusMethodNotAllowed || (w.Code == http.StatusNotFound && apiErrorCode(t, w) == "not_found" && !strings.Contains(path, "00:00")) {
+				t.Errorf("%s %s: documented, but got %d", method, path, w.Code)
+			}
+		}
+	}
+}
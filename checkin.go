@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"k8s.io/klog/v2"
+)
+
+// CheckIn is a manual, time-limited presence entry of a user, eg. for
+// visitors without a claimed device or people whose phone died.
+type CheckIn struct {
+	Username    string    `json:"username"`
+	CheckedInAt time.Time `json:"checked_in_at"`
+	// Until is when the check-in expires, unless extended.
+	Until time.Time `json:"until"`
+}
+
+// Map from username to serialized CheckIn.
+var bucketCheckIns = []byte("check_ins")
+
+// migrateCreateCheckIns creates the check-ins bucket.
+func migrateCreateCheckIns(tx *bbolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(bucketCheckIns)
+	return err
+}
+
+func (b *BoltDatabase) CheckIn(c *CheckIn) error {
+	v, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketCheckIns).Put([]byte(c.Username), v)
+	})
+}
+
+func (b *BoltDatabase) CheckOut(user string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketCheckIns).Delete([]byte(user))
+	})
+}
+
+func (b *BoltDatabase) GetCheckIns(now time.Time) ([]*CheckIn, error) {
+	var res []*CheckIn
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketCheckIns).ForEach(func(k, v []byte) error {
+			var c CheckIn
+			if err := json.Unmarshal(v, &c); err != nil {
+				klog.Warningf("Check-in %q could not be unmarshaled: %v", k, err)
+				return nil
+			}
+			if c.Until.After(now) {
+				res = append(res, &c)
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+// currentCheckIn returns the active check-in of a user, or nil.
+func (s *Service) currentCheckIn(user string) (*CheckIn, error) {
+	checkIns, err := s.Database.GetCheckIns(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range checkIns {
+		if c.Username == user {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// viewCheckIn manually checks the user in for the configured duration, or
+// extends an existing check-in.
+func (s *Service) viewCheckIn(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	duration := s.cfg().CheckInDuration
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, fmt.Sprintf("Check in manually for %s?", duration))
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+
+	existing, err := s.currentCheckIn(session.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get check-in: %v", err)
+		return
+	}
+	now := time.Now()
+	c := &CheckIn{
+		Username:    session.Username,
+		CheckedInAt: now,
+		Until:       now.Add(duration),
+	}
+	if existing != nil {
+		c.CheckedInAt = existing.CheckedInAt
+	}
+	if err := s.Database.CheckIn(c); err != nil {
+		fmt.Fprintf(w, "Could not check in: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// viewCheckOut ends the user's manual check-in.
+func (s *Service) viewCheckOut(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, "Check out?")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	if err := s.Database.CheckOut(session.Username); err != nil {
+		fmt.Fprintf(w, "Could not check out: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckIn(t *testing.T) {
+	s := newTestService(t)
+	s.cfg().CheckInDuration = 4 * time.Hour
+	leases := s.cfg().Leases
+	s.cfg().Leases = staticLeases{}
+	if err := s.Database.SetUserVisibility("bob", VisibilityCountOnly); err != nil {
+		t.Fatalf("could not set visibility: %v", err)
+	}
+
+	post := func(user string, view http.HandlerFunc) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"csrf_token": {"token"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range s.sessionCookies(&Session{Username: user, CSRFToken: "token", ExpiresAt: time.Now().Add(time.Hour)}) {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		view(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected redirect, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	presence := func() *Presence {
+		t.Helper()
+		p, err := s.getPresence()
+		if err != nil {
+			t.Fatalf("could not get presence: %v", err)
+		}
+		return p
+	}
+
+	post("alice", s.viewCheckIn)
+	post("bob", s.viewCheckIn)
+	want := &Presence{Users: []PresentUser{{Name: "alice", Manual: true}}, Anonymous: 1}
+	if diff := cmp.Diff(*want, *presence(), ignoreArrival, ignoreVisibility); diff != "" {
+		t.Errorf("presence after check-in: %s", diff)
+	}
+	c, err := s.currentCheckIn("alice")
+	if err != nil {
+		t.Fatalf("could not get check-in: %v", err)
+	}
+	if left := time.Until(c.Until); left < 3*time.Hour || left > 4*time.Hour {
+		t.Errorf("check-in lasts %s, expected ~4h", left)
+	}
+
+	// A user whose device is present isn't marked as manually checked in.
+	if err := s.Database.ClaimDevice("alice", mustParseMAC("00:11:22:33:44:55"), "", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	s.cfg().Leases = leases
+	want = &Presence{Users: []PresentUser{{Name: "alice", Devices: 1}}, Anonymous: 1}
+	if diff := cmp.Diff(*want, *presence(), ignoreArrival, ignoreVisibility); diff != "" {
+		t.Errorf("presence with device: %s", diff)
+	}
+
+	post("bob", s.viewCheckOut)
+	want = &Presence{Users: []PresentUser{{Name: "alice", Devices: 1}}}
+	if diff := cmp.Diff(*want, *presence(), ignoreArrival, ignoreVisibility); diff != "" {
+		t.Errorf("presence after check-out: %s", diff)
+	}
+}
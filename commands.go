@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a maintenance subcommand of yacheck, run instead of the server.
+// Commands either have subcommands or a run function.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+	sub   []*command
+}
+
+// commands is the tree of all maintenance commands.
+var commands = &command{
+	name: "yacheck",
+	sub: []*command{
+		{name: "devices", usage: "Manage claimed devices", sub: []*command{
+			{name: "list", usage: "[-user USER] - List claimed devices", run: cmdDevicesList},
+			{name: "claim", usage: "-user USER [-hostname HOSTNAME] MAC - Claim a device on behalf of a user", run: cmdDevicesClaim},
+			{name: "unclaim", usage: "[-user USER] MAC - Unclaim a device", run: cmdDevicesUnclaim},
+		}},
+		{name: "users", usage: "Manage users", sub: []*command{
+			{name: "rename", usage: "OLD NEW - Move all devices of a user to a different username", run: cmdUsersRename},
+			{name: "revoke", usage: "USER - Log a user out of all their sessions", run: cmdUsersRevoke},
+		}},
+		{name: "db", usage: "Database maintenance", sub: []*command{
+			{name: "check", usage: "[-repair] - Check database for inconsistencies", run: cmdDBCheck},
+		}},
+		{name: "leases", usage: "Inspect DHCP leases", sub: []*command{
+			{name: "show", usage: "[-all] - Show active (or all) leases and who claimed them", run: cmdLeasesShow},
+		}},
+		{name: "equipment", usage: "Manage equipment of the space", sub: []*command{
+			{name: "list", usage: "- List equipment", run: cmdEquipmentList},
+			{name: "add", usage: "-description DESCRIPTION MAC - Mark a device as equipment", run: cmdEquipmentAdd},
+			{name: "remove", usage: "MAC - Remove a device from equipment", run: cmdEquipmentRemove},
+		}},
+		{name: "oui", usage: "MAC address vendor database", sub: []*command{
+			{name: "lookup", usage: "MAC - Show the vendor of a MAC address", run: cmdOUILookup},
+			{name: "generate", usage: "[-in FILE] [-out FILE] - Convert the IEEE oui.csv into the embedded database (oui.txt)", run: cmdOUIGenerate},
+		}},
+		{name: "secret", usage: "Manage the session secret file", sub: []*command{
+			{name: "rotate", usage: "[-keep N] - Generate a new session secret, keeping previous ones valid", run: cmdSecretRotate},
+		}},
+		{name: "export", usage: "[-out FILE] - Export database as JSON", run: cmdExport},
+		{name: "import", usage: "[-in FILE] - Import database from JSON", run: cmdImport},
+	},
+}
+
+// commandConfig is the runtime configuration used by commands.
+var commandConfig *RuntimeConfig
+
+// runCommand runs a maintenance command given on the command line, instead of
+// the server.
+func runCommand(rc *RuntimeConfig, args []string) error {
+	commandConfig = rc
+	return commands.dispatch(nil, args)
+}
+
+func (c *command) dispatch(path []string, args []string) error {
+	path = append(path, c.name)
+	if c.run != nil {
+		return c.run(args)
+	}
+	if len(args) == 0 || args[0] == "help" || args[0] == "-help" {
+		c.printUsage(path)
+		return nil
+	}
+	for _, sub := range c.sub {
+		if sub.name == args[0] {
+			return sub.dispatch(path, args[1:])
+		}
+	}
+	c.printUsage(path)
+	return fmt.Errorf("unknown command %q", strings.Join(append(path, args[0]), " "))
+}
+
+func (c *command) printUsage(path []string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [global flags] %s COMMAND\n\nCommands:\n", os.Args[0], strings.Join(path[1:], " "))
+	for _, sub := range c.sub {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", sub.name, sub.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s -help for global flags.\n", os.Args[0])
+}
+
+// openCommandStore opens the database for a maintenance command, with a
+// friendly error if it's in use by a running server.
+func openCommandStore() (Store, error) {
+	db, err := OpenStore(flagDatabaseType, flagDatabaseFile)
+	if errors.Is(err, ErrLocked) {
+		return nil, fmt.Errorf("database %s is in use, probably by a running yacheck server. Stop the server before running maintenance commands", flagDatabaseFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %w", err)
+	}
+	return db, nil
+}
+
+// parseMACArg parses a command's single MAC address argument.
+func parseMACArg(fs *flag.FlagSet) (net.HardwareAddr, error) {
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("expected exactly one MAC address argument")
+	}
+	mac, err := net.ParseMAC(fs.Arg(0))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address: %w", err)
+	}
+	return mac, nil
+}
+
+func cmdDevicesList(args []string) error {
+	fs := flag.NewFlagSet("devices list", flag.ExitOnError)
+	user := fs.String("user", "", "Only show devices of this user")
+	fs.Parse(args)
+
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var devices []*Device
+	if *user != "" {
+		devices, err = db.GetDevicesForUser(*user)
+	} else {
+		devices, err = db.GetDevices()
+	}
+	if err != nil {
+		return fmt.Errorf("could not get devices: %w", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "MAC ADDRESSES\tHOSTNAME\tUSER\tCLAIMED\tLAST SEEN\n")
+	for _, d := range devices {
+		last := formatCommandTime(d.SeenAt())
+		if d.Stale {
+			last += " (stale)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", strings.Join(d.Addresses(), ","), d.Hostname, d.UserNickname, formatCommandTime(d.ClaimedAt), last)
+	}
+	return tw.Flush()
+}
+
+func formatCommandTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func cmdDevicesClaim(args []string) error {
+	fs := flag.NewFlagSet("devices claim", flag.ExitOnError)
+	user := fs.String("user", "", "User to claim device for (required)")
+	hostname := fs.String("hostname", "", "Hostname of device")
+	fs.Parse(args)
+
+	if *user == "" {
+		return fmt.Errorf("-user must be set")
+	}
+	mac, err := parseMACArg(fs)
+	if err != nil {
+		return err
+	}
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.ClaimDevice(*user, mac, *hostname, ""); err != nil {
+		return fmt.Errorf("could not claim device: %w", err)
+	}
+	fmt.Printf("Claimed %s for %s.\n", mac, *user)
+	return nil
+}
+
+func cmdDevicesUnclaim(args []string) error {
+	fs := flag.NewFlagSet("devices unclaim", flag.ExitOnError)
+	user := fs.String("user", "", "Only unclaim if device belongs to this user (default: whoever claimed it)")
+	fs.Parse(args)
+
+	mac, err := parseMACArg(fs)
+	if err != nil {
+		return err
+	}
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	devices, err := db.GetDevicesForMacAddresses([]net.HardwareAddr{mac})
+	if err != nil {
+		return fmt.Errorf("could not get device: %w", err)
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("device %s is not claimed", mac)
+	}
+	owner := devices[0].UserNickname
+	if *user != "" && *user != owner {
+		return fmt.Errorf("device %s belongs to %s, not %s", mac, owner, *user)
+	}
+	if err := db.UnclaimDevice(owner, mac); err != nil {
+		return fmt.Errorf("could not unclaim device: %w", err)
+	}
+	fmt.Printf("Unclaimed %s from %s.\n", devices[0].MACAddress, owner)
+	return nil
+}
+
+func cmdUsersRename(args []string) error {
+	fs := flag.NewFlagSet("users rename", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 || fs.Arg(0) == "" || fs.Arg(1) == "" {
+		return fmt.Errorf("expected OLD and NEW usernames")
+	}
+
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	n, err := db.RenameUser(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("could not rename user: %w", err)
+	}
+	fmt.Printf("Renamed %s to %s, moving %d devices.\n", fs.Arg(0), fs.Arg(1), n)
+	return nil
+}
+
+// cmdUsersRevoke revokes all sessions of a user.
+func cmdUsersRevoke(args []string) error {
+	fs := flag.NewFlagSet("users revoke", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		return fmt.Errorf("expected USER")
+	}
+
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.RevokeSessions(fs.Arg(0)); err != nil {
+		return fmt.Errorf("could not revoke sessions: %w", err)
+	}
+	fmt.Printf("Revoked all sessions of %s.\n", fs.Arg(0))
+	return nil
+}
+
+// cmdDBCheck performs a consistency check of the database, optionally
+// repairing the user devices index.
+func cmdDBCheck(args []string) error {
+	fs := flag.NewFlagSet("db check", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "Rebuild user devices index if it's inconsistent")
+	fs.Parse(args)
+	if *repair && flagDatabaseType != "bolt" {
+		return fmt.Errorf("-repair is only supported for bolt databases, %s databases keep no separate index", flagDatabaseType)
+	}
+
+	var db Store
+	var err error
+	if flagDatabaseType == "bolt" {
+		db, err = openBoltDatabase(flagDatabaseFile, *repair)
+		if errors.Is(err, ErrLocked) {
+			err = fmt.Errorf("database %s is in use, probably by a running yacheck server. Stop the server before running maintenance commands", flagDatabaseFile)
+		}
+	} else {
+		db, err = openCommandStore()
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	problems, err := db.Check()
+	if err != nil {
+		return fmt.Errorf("could not check database: %w", err)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("No problems found.")
+	return nil
+}
+
+// cmdLeasesShow shows leases from the lease source, along with who claimed
+// them. Like the server, it considers leases active per seen_within, but
+// without neighbour probing, which only the server does. If the database is in
+// use by a running server, leases are shown without claims.
+func cmdLeasesShow(args []string) error {
+	fs := flag.NewFlagSet("leases show", flag.ExitOnError)
+	all := fs.Bool("all", false, "Also show inactive leases (expired, or not renewed within -seen_within)")
+	fs.Parse(args)
+
+	leases, err := commandConfig.Leases.Leases()
+	if err != nil {
+		return fmt.Errorf("could not get leases: %w", err)
+	}
+	now := time.Now()
+	var shown []*Lease
+	for _, lease := range leases {
+		if !*all && !commandConfig.leaseActiveUntil(lease).After(now) {
+			continue
+		}
+		shown = append(shown, lease)
+	}
+	sort.Slice(shown, func(i, j int) bool {
+		return shown[i].MACAddress.String() < shown[j].MACAddress.String()
+	})
+
+	owners := make(map[string]string)
+	db, err := openCommandStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Not showing claims: %v\n", err)
+	} else {
+		defer db.Close()
+		equipment, err := db.GetEquipment()
+		if err != nil {
+			return fmt.Errorf("could not get equipment: %w", err)
+		}
+		for _, e := range equipment {
+			owners[e.MACAddress] = "(equipment: " + e.Description + ")"
+		}
+		devices, err := db.GetDevicesForLeases(shown)
+		if err != nil {
+			return fmt.Errorf("could not get devices: %w", err)
+		}
+		for _, lease := range shown {
+			if d := leaseOwner(devices, lease); d != nil {
+				owners[lease.MACAddress.String()] = d.UserNickname
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "MAC ADDRESS\tVENDOR\tIP ADDRESS\tHOSTNAME\tEXPIRES\tCLAIMED BY\n")
+	for _, lease := range shown {
+		mac := lease.MACAddress.String()
+		if lease.Randomized() {
+			mac += " (randomized)"
+		}
+		vendor := macVendor(lease.MACAddress)
+		if vendor == "" {
+			vendor = "-"
+		}
+		owner := owners[lease.MACAddress.String()]
+		if owner == "" {
+			owner = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", mac, vendor, lease.IPAddress, lease.Hostname, formatCommandTime(lease.Expires), owner)
+	}
+	return tw.Flush()
+}
+
+func cmdOUILookup(args []string) error {
+	fs := flag.NewFlagSet("oui lookup", flag.ExitOnError)
+	fs.Parse(args)
+	mac, err := parseMACArg(fs)
+	if err != nil {
+		return err
+	}
+	switch vendor := macVendor(mac); {
+	case isLocallyAdministered(mac):
+		fmt.Printf("%s: locally administered (randomized) address\n", mac)
+	case vendor == "":
+		fmt.Printf("%s: unknown vendor\n", mac)
+	default:
+		fmt.Printf("%s: %s\n", mac, vendor)
+	}
+	return nil
+}
+
+// cmdOUIGenerate converts the IEEE MA-L registry CSV into the format of the
+// embedded vendor database. The output is meant to replace oui.txt in the
+// source tree before building, so it's only replaced once the whole CSV has
+// been converted successfully.
+func cmdOUIGenerate(args []string) error {
+	fs := flag.NewFlagSet("oui generate", flag.ExitOnError)
+	in := fs.String("in", "-", "IEEE oui.csv file to read, - for stdin")
+	out := fs.String("out", "-", "File to write the database to, - for stdout")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("could not open CSV: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	if *out == "-" {
+		n, err := generateOUIDatabase(r, os.Stdout)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d vendors.\n", n)
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(*out), filepath.Base(*out)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create database file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	n, err := generateOUIDatabase(r, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write database file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not write database file: %w", err)
+	}
+	if err := os.Rename(f.Name(), *out); err != nil {
+		return fmt.Errorf("could not replace database file: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d vendors.\n", n)
+	return nil
+}
+
+func cmdEquipmentList(args []string) error {
+	fs := flag.NewFlagSet("equipment list", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	equipment, err := db.GetEquipment()
+	if err != nil {
+		return fmt.Errorf("could not get equipment: %w", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "MAC ADDRESS\tDESCRIPTION\tADDED BY\tADDED\n")
+	for _, e := range equipment {
+		addedBy := e.AddedBy
+		if addedBy == "" {
+			addedBy = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.MACAddress, e.Description, addedBy, formatCommandTime(e.AddedAt))
+	}
+	return tw.Flush()
+}
+
+func cmdEquipmentAdd(args []string) error {
+	fs := flag.NewFlagSet("equipment add", flag.ExitOnError)
+	description := fs.String("description", "", "Description of the device (required)")
+	fs.Parse(args)
+
+	if *description == "" {
+		return fmt.Errorf("-description must be set")
+	}
+	mac, err := parseMACArg(fs)
+	if err != nil {
+		return err
+	}
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.PutEquipment(&Equipment{
+		MACAddress:  mac.String(),
+		Description: *description,
+		AddedAt:     time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not add equipment: %w", err)
+	}
+	fmt.Printf("Marked %s as equipment.\n", mac)
+	return nil
+}
+
+func cmdEquipmentRemove(args []string) error {
+	fs := flag.NewFlagSet("equipment remove", flag.ExitOnError)
+	fs.Parse(args)
+
+	mac, err := parseMACArg(fs)
+	if err != nil {
+		return err
+	}
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.RemoveEquipment(mac); err != nil {
+		return fmt.Errorf("could not remove equipment: %w", err)
+	}
+	fmt.Printf("Removed %s from equipment.\n", mac)
+	return nil
+}
+
+// cmdExport writes an export of the database to a file or stdout.
+func cmdExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "-", "File to write export to, - for stdout")
+	fs.Parse(args)
+
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	e, err := ExportStore(db)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("could not create export file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(e); err != nil {
+		return fmt.Errorf("could not write export: %w", err)
+	}
+	return nil
+}
+
+// cmdImport imports an export from a file or stdin into the database,
+// reporting conflicts with existing data.
+func cmdImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "-", "File to read export from, - for stdin")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("could not open export file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	e, err := ReadExport(r)
+	if err != nil {
+		return fmt.Errorf("invalid export:\n%w", err)
+	}
+
+	db, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	res, err := ImportStore(db, e)
+	if err != nil {
+		return err
+	}
+	for _, err := range res.Conflicts {
+		fmt.Printf("Conflict: %v\n", err)
+	}
+	fmt.Printf("%d devices imported, %d already present; %d other records imported, %d already present; %d conflicts.\n", len(res.Imported), len(res.Unchanged), res.OtherImported, res.OtherUnchanged, len(res.Conflicts))
+	if len(res.Conflicts) > 0 {
+		return fmt.Errorf("import had conflicts")
+	}
+	return nil
+}
+
+// cmdSecretRotate rotates the session secret. This doesn't need the database,
+// so it can be run while the server is running, which picks up the new secret
+// on SIGHUP.
+func cmdSecretRotate(args []string) error {
+	fs := flag.NewFlagSet("secret rotate", flag.ExitOnError)
+	keep := fs.Int("keep", 1, "Number of previous secrets to keep accepting sessions for")
+	fs.Parse(args)
+	if *keep < 0 {
+		return fmt.Errorf("-keep must not be negative")
+	}
+
+	secrets, err := rotateSecrets(flagSecretFile, *keep)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rotated secret in %s, %d previous secrets kept. Send SIGHUP to (or restart) the server to apply.\n", flagSecretFile, len(secrets)-1)
+	return nil
+}
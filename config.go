@@ -0,0 +1,423 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"k8s.io/klog/v2"
+)
+
+// ConfigFile is the structure of the TOML configuration file given by
+// -config. Top-level keys are the same as command line flags (eg. space_name =
+// "FAFO"), in addition to the nested structures below.
+type ConfigFile struct {
+	// LeaseSources, if set, replace the lease source given by -lease_file.
+	LeaseSources []LeaseSourceConfig `toml:"lease_source"`
+	// APIUsers are added to the users given by -api_users.
+	APIUsers []APIUser `toml:"api_user"`
+	// Webhooks are notified whenever the list of present users changes.
+	Webhooks []WebhookConfig `toml:"webhook"`
+}
+
+// LeaseSourceConfig configures a source of DHCP leases.
+type LeaseSourceConfig struct {
+	// Type of lease source, currently only "kea".
+	Type string `toml:"type"`
+	// Path to the lease file.
+	Path string `toml:"path"`
+}
+
+// WebhookConfig configures a webhook.
+type WebhookConfig struct {
+	// URL to which present users are POSTed, in the same format as
+	// /api.json.
+	URL string `toml:"url"`
+}
+
+// nestedConfigKeys are top-level configuration file keys which are not flags.
+var nestedConfigKeys = map[string]bool{
+	"lease_source": true,
+	"api_user":     true,
+	"webhook":      true,
+}
+
+// reloadableFlags are flags which take effect when the configuration is
+// reloaded at runtime. Changes to all other flags require a restart.
+var reloadableFlags = map[string]bool{
+	"lease_file":            true,
+	"api_users":             true,
+	"space_name":            true,
+	"space_url":             true,
+	"admins":                true,
+	"trusted_proxies":       true,
+	"checkin_duration":      true,
+	"arrival_delay":         true,
+	"seen_within":           true,
+	"departure_delay":       true,
+	"show_unclaimed":        true,
+	"smtp_addr":             true,
+	"smtp_from":             true,
+	"smtp_username":         true,
+	"smtp_password":         true,
+	"ntfy_server":           true,
+	"notify_webhooks":       true,
+	"device_expiry":         true,
+	"device_expiry_warning": true,
+	"device_expiry_action":  true,
+}
+
+// envName returns the name of the environment variable overriding a flag, eg.
+// YACHECK_OAUTH_CLIENT_SECRET for -oauth_client_secret.
+func envName(flagName string) string {
+	return "YACHECK_" + strings.ToUpper(flagName)
+}
+
+// Config loads configuration from a configuration file and environment
+// variables, keeping track of flags explicitly set on the command line, which
+// always take precedence.
+type Config struct {
+	fs   *flag.FlagSet
+	path string
+	// cli are the flags explicitly set on the command line.
+	cli map[string]string
+}
+
+// NewConfig builds a Config for an already parsed FlagSet. The path to the
+// configuration file can be empty, in which case only environment variables
+// are used.
+func NewConfig(fs *flag.FlagSet, path string) *Config {
+	cli := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		cli[f.Name] = f.Value.String()
+	})
+	return &Config{
+		fs:   fs,
+		path: path,
+		cli:  cli,
+	}
+}
+
+// Resolve reads the configuration file and environment, returning the final
+// string value of every flag and the nested configuration structures. Flag
+// values are resolved in the following order, later ones taking precedence:
+// flag default, configuration file, environment, command line.
+func (c *Config) Resolve() (map[string]string, *ConfigFile, error) {
+	values := make(map[string]string)
+	c.fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.DefValue
+	})
+
+	var file ConfigFile
+	if c.path != "" {
+		var raw map[string]any
+		md, err := toml.DecodeFile(c.path, &raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse config file: %w", err)
+		}
+		for _, key := range md.Keys() {
+			if len(key) != 1 {
+				continue
+			}
+			name := key[0]
+			if nestedConfigKeys[name] {
+				continue
+			}
+			if _, ok := values[name]; !ok {
+				return nil, nil, fmt.Errorf("config file: unknown key %q", name)
+			}
+			v, err := configValue(raw[name])
+			if err != nil {
+				return nil, nil, fmt.Errorf("config file: %s: %w", name, err)
+			}
+			values[name] = v
+		}
+		if _, err := toml.DecodeFile(c.path, &file); err != nil {
+			return nil, nil, fmt.Errorf("could not parse config file: %w", err)
+		}
+	}
+
+	for name := range values {
+		if v, ok := os.LookupEnv(envName(name)); ok {
+			values[name] = v
+		}
+	}
+	for name, v := range c.cli {
+		values[name] = v
+	}
+	return values, &file, nil
+}
+
+// configValue converts a configuration file value into its flag string
+// representation. Lists are joined with commas.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64, float64, bool:
+		return fmt.Sprint(v), nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, el := range v {
+			s, err := configValue(el)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// Apply resolves the configuration (see Resolve) and sets all flags
+// accordingly. This must only be called at startup, as flags are global
+// variables read without synchronization.
+func (c *Config) Apply() (map[string]string, *ConfigFile, error) {
+	values, file, err := c.Resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, v := range values {
+		if err := c.fs.Set(name, v); err != nil {
+			return nil, nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+	return values, file, nil
+}
+
+// RuntimeConfig is the part of the configuration that can be changed at
+// runtime by reloading the configuration (on SIGHUP).
+type RuntimeConfig struct {
+	SpaceName string
+	SpaceURL  string
+	// APIUsers are users allowed to access /api.json.
+	APIUsers []APIUser
+	// Admins are usernames of users allowed to access administrative views.
+	Admins []string
+	// Leases is the source of DHCP leases.
+	Leases LeaseSource
+	// Webhooks are URLs notified on changes of present users.
+	Webhooks []string
+	// TrustedProxies are reverse proxies whose forwarding headers are used
+	// to determine client addresses.
+	TrustedProxies TrustedProxies
+
+	DeviceExpiry        time.Duration
+	DeviceExpiryWarning time.Duration
+	DeviceExpiryAction  string
+
+	// CheckInDuration is how long manual check-ins last.
+	CheckInDuration time.Duration
+	// SeenWithin, if set, is how recently a device must have renewed its
+	// lease (or been seen by neighbour probing) to be present.
+	SeenWithin time.Duration
+	// ArrivalDelay and DepartureDelay debounce device presence, see
+	// presenceTracker.
+	ArrivalDelay   time.Duration
+	DepartureDelay time.Duration
+	// ShowUnclaimed shows the number of unclaimed devices online on the
+	// index page.
+	ShowUnclaimed bool
+	// Notifiers are the available notification channels, by name (see
+	// notifierChannels).
+	Notifiers map[string]Notifier
+}
+
+// NewRuntimeConfig builds a RuntimeConfig from resolved flag values and the
+// configuration file.
+func NewRuntimeConfig(values map[string]string, file *ConfigFile) (*RuntimeConfig, error) {
+	rc := RuntimeConfig{
+		SpaceName:          values["space_name"],
+		SpaceURL:           values["space_url"],
+		DeviceExpiryAction: values["device_expiry_action"],
+	}
+
+	if v := values["api_users"]; v != "" {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			parts := strings.Split(s, ":")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid user:password pair %s", s)
+			}
+			rc.APIUsers = append(rc.APIUsers, APIUser{
+				Username: parts[0],
+				Password: parts[1],
+			})
+		}
+	}
+	for _, au := range file.APIUsers {
+		if au.Username == "" || au.Password == "" {
+			return nil, fmt.Errorf("api_user: username and password must be set")
+		}
+		rc.APIUsers = append(rc.APIUsers, au)
+	}
+
+	if v := values["admins"]; v != "" {
+		for _, s := range strings.Split(v, ",") {
+			rc.Admins = append(rc.Admins, strings.TrimSpace(s))
+		}
+	}
+
+	var err error
+	if rc.TrustedProxies, err = ParseTrustedProxies(values["trusted_proxies"]); err != nil {
+		return nil, fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	if rc.DeviceExpiry, err = time.ParseDuration(values["device_expiry"]); err != nil {
+		return nil, fmt.Errorf("invalid device_expiry: %w", err)
+	}
+	if rc.DeviceExpiryWarning, err = time.ParseDuration(values["device_expiry_warning"]); err != nil {
+		return nil, fmt.Errorf("invalid device_expiry_warning: %w", err)
+	}
+	if rc.CheckInDuration, err = time.ParseDuration(values["checkin_duration"]); err != nil {
+		return nil, fmt.Errorf("invalid checkin_duration: %w", err)
+	}
+	if rc.CheckInDuration <= 0 {
+		return nil, fmt.Errorf("checkin_duration must be positive")
+	}
+	if rc.SeenWithin, err = time.ParseDuration(values["seen_within"]); err != nil {
+		return nil, fmt.Errorf("invalid seen_within: %w", err)
+	}
+	if rc.SeenWithin < 0 {
+		return nil, fmt.Errorf("seen_within must not be negative")
+	}
+	if rc.ArrivalDelay, err = time.ParseDuration(values["arrival_delay"]); err != nil {
+		return nil, fmt.Errorf("invalid arrival_delay: %w", err)
+	}
+	if rc.DepartureDelay, err = time.ParseDuration(values["departure_delay"]); err != nil {
+		return nil, fmt.Errorf("invalid departure_delay: %w", err)
+	}
+	if rc.ArrivalDelay < 0 || rc.DepartureDelay < 0 {
+		return nil, fmt.Errorf("arrival_delay and departure_delay must not be negative")
+	}
+	if rc.ShowUnclaimed, err = strconv.ParseBool(values["show_unclaimed"]); err != nil {
+		return nil, fmt.Errorf("invalid show_unclaimed: %w", err)
+	}
+	rc.Notifiers = make(map[string]Notifier)
+	if addr := values["smtp_addr"]; addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid smtp_addr: %w", err)
+		}
+		if values["smtp_from"] == "" {
+			return nil, fmt.Errorf("smtp_from must be set with smtp_addr")
+		}
+		rc.Notifiers["email"] = &SMTPNotifier{
+			Addr:     addr,
+			From:     values["smtp_from"],
+			Username: values["smtp_username"],
+			Password: values["smtp_password"],
+		}
+	}
+	if server := values["ntfy_server"]; server != "" {
+		if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+			return nil, fmt.Errorf("invalid ntfy_server %q", server)
+		}
+		rc.Notifiers["ntfy"] = &NtfyNotifier{Server: server}
+	}
+	notifyWebhooks, err := strconv.ParseBool(values["notify_webhooks"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid notify_webhooks: %w", err)
+	}
+	if notifyWebhooks {
+		rc.Notifiers["webhook"] = &WebhookNotifier{}
+	}
+	if rc.DeviceExpiryAction != "flag" && rc.DeviceExpiryAction != "unclaim" {
+		return nil, fmt.Errorf("device_expiry_action must be 'flag' or 'unclaim'")
+	}
+
+	if len(file.LeaseSources) == 0 {
+		rc.Leases = NewKeaLeaseFile(values["lease_file"])
+	} else {
+		var sources MultiLeaseSource
+		for i, ls := range file.LeaseSources {
+			switch ls.Type {
+			case "kea":
+				if ls.Path == "" {
+					return nil, fmt.Errorf("lease_source %d: path must be set", i)
+				}
+				sources = append(sources, NewKeaLeaseFile(ls.Path))
+			default:
+				return nil, fmt.Errorf("lease_source %d: unknown type %q", i, ls.Type)
+			}
+		}
+		rc.Leases = sources
+	}
+
+	for i, wh := range file.Webhooks {
+		if !strings.HasPrefix(wh.URL, "http://") && !strings.HasPrefix(wh.URL, "https://") {
+			return nil, fmt.Errorf("webhook %d: invalid URL %q", i, wh.URL)
+		}
+		rc.Webhooks = append(rc.Webhooks, wh.URL)
+	}
+	return &rc, nil
+}
+
+// cfg returns the current RuntimeConfig of the service.
+func (s *Service) cfg() *RuntimeConfig {
+	return s.runtimeConfig.Load()
+}
+
+// changed returns the names of flags which aren't reloadable, and whose
+// resolved values differ from the ones in effect, sorted by name.
+func (c *Config) changed(values map[string]string) []string {
+	var res []string
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if reloadableFlags[f.Name] || f.Name == "config" {
+			return
+		}
+		// Compare parsed values, so that eg. 4h and 4h0m0s are the same.
+		// The flag package's values are pointers to their parsed types, so
+		// parse into a scratch value of the same type.
+		current := f.Value.String()
+		resolved := values[f.Name]
+		if t := reflect.TypeOf(f.Value); t.Kind() == reflect.Pointer {
+			v := reflect.New(t.Elem()).Interface().(flag.Value)
+			if err := v.Set(resolved); err == nil {
+				resolved = v.String()
+			}
+		}
+		if resolved != current {
+			res = append(res, f.Name)
+		}
+	})
+	sort.Strings(res)
+	return res
+}
+
+// reload re-reads the configuration and secret file, and applies all
+// runtime-changeable parts of them. Changes to other parts are logged, as they
+// require a restart.
+func (s *Service) reload() error {
+	values, file, err := s.Config.Resolve()
+	if err != nil {
+		return err
+	}
+	rc, err := NewRuntimeConfig(values, file)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range s.Config.changed(values) {
+		klog.Warningf("Configuration of %s changed, restart to apply", name)
+	}
+
+	// The secret file might have been rotated.
+	secrets, err := readSecrets(flagSecretFile)
+	if err != nil {
+		return fmt.Errorf("could not read secret: %w", err)
+	}
+	if err := s.Sessions.SetSecrets(secrets); err != nil {
+		return err
+	}
+
+	s.runtimeConfig.Store(rc)
+	return nil
+}
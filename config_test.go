@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConfig(t *testing.T) {
+	path := t.TempDir() + "/config.toml"
+	err := os.WriteFile(path, []byte(`
+space_name = "Warsaw Hackerspace"
+space_url = "https://hackerspace.pl/"
+oauth_client_secret = "from-file"
+admins = ["q3k", "informatic"]
+device_expiry = "720h"
+
+[[lease_source]]
+type = "kea"
+path = "/var/lib/kea/dhcp4.leases"
+
+[[lease_source]]
+type = "kea"
+path = "/var/lib/kea/other.leases"
+
+[[api_user]]
+username = "bot"
+password = "hunter2"
+
+[[webhook]]
+url = "https://example.com/hook"
+`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse([]string{"-space_url", "https://hswaw.pl/", "-api_users", "cli:pass"}); err != nil {
+		t.Fatalf("could not parse flags: %v", err)
+	}
+	t.Setenv("YACHECK_OAUTH_CLIENT_SECRET", "from-env")
+	t.Setenv("YACHECK_SPACE_URL", "https://env.example.com/")
+
+	c := NewConfig(fs, path)
+	values, file, err := c.Resolve()
+	if err != nil {
+		t.Fatalf("could not resolve config: %v", err)
+	}
+	for k, want := range map[string]string{
+		// From file.
+		"space_name": "Warsaw Hackerspace",
+		// Environment overrides file.
+		"oauth_client_secret": "from-env",
+		// Command line overrides environment.
+		"space_url": "https://hswaw.pl/",
+		// Lists are joined.
+		"admins": "q3k,informatic",
+		// Defaults.
+		"listen": ":8080",
+	} {
+		if got := values[k]; got != want {
+			t.Errorf("%s: got %q, want %q", k, got, want)
+		}
+	}
+
+	rc, err := NewRuntimeConfig(values, file)
+	if err != nil {
+		t.Fatalf("could not build runtime config: %v", err)
+	}
+	if diff := cmp.Diff(rc.APIUsers, []APIUser{{"cli", "pass"}, {"bot", "hunter2"}}); diff != "" {
+		t.Errorf("api users: %s", diff)
+	}
+	if diff := cmp.Diff(rc.Admins, []string{"q3k", "informatic"}); diff != "" {
+		t.Errorf("admins: %s", diff)
+	}
+	if diff := cmp.Diff(rc.Webhooks, []string{"https://example.com/hook"}); diff != "" {
+		t.Errorf("webhooks: %s", diff)
+	}
+	if rc.DeviceExpiry != 720*time.Hour {
+		t.Errorf("device expiry: got %v", rc.DeviceExpiry)
+	}
+	sources, ok := rc.Leases.(MultiLeaseSource)
+	if !ok || len(sources) != 2 {
+		t.Errorf("expected two lease sources, got %+v", rc.Leases)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"unknown key", `spacename = "FAFO"`, `unknown key "spacename"`},
+		{"bad lease source", "[[lease_source]]\ntype = \"dnsmasq\"\npath = \"foo\"", `unknown type "dnsmasq"`},
+		{"bad duration", `device_expiry = "forever"`, "invalid device_expiry"},
+		{"bad webhook", "[[webhook]]\nurl = \"ftp://example.com\"", "invalid URL"},
+		{"smtp without sender", `smtp_addr = "localhost:25"`, "smtp_from must be set"},
+		{"bad ntfy server", `ntfy_server = "ntfy.sh"`, "invalid ntfy_server"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir() + "/config.toml"
+			if err := os.WriteFile(path, []byte(test.config), 0600); err != nil {
+				t.Fatalf("could not write config: %v", err)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			registerFlags(fs)
+			values, file, err := NewConfig(fs, path).Resolve()
+			if err == nil {
+				_, err = NewRuntimeConfig(values, file)
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestConfigChanged(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse([]string{"-shutdown_timeout", "1m", "-listen", ":8080"}); err != nil {
+		t.Fatalf("could not parse flags: %v", err)
+	}
+	c := NewConfig(fs, "")
+	values, _, err := c.Resolve()
+	if err != nil {
+		t.Fatalf("could not resolve config: %v", err)
+	}
+	// Equivalent spellings of the same value aren't changes.
+	values["shutdown_timeout"] = "60s"
+	values["matrix_announce"] = "0"
+	values["listen"] = ":8081"
+	if diff := cmp.Diff([]string{"listen"}, c.changed(values)); diff != "" {
+		t.Errorf("changed flags: %s", diff)
+	}
+}
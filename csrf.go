@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// newCSRFToken generates a random token for a new session.
+func newCSRFToken() (string, error) {
+	var token [16]byte
+	if _, err := io.ReadFull(rand.Reader, token[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token[:]), nil
+}
+
+// csrfToken returns the CSRF token of a session, generating and saving one if
+// the session predates them. Must be called before writing the response body.
+func (s *Service) csrfToken(w http.ResponseWriter, session *Session) string {
+	if session.CSRFToken == "" {
+		token, err := newCSRFToken()
+		if err != nil {
+			// The session simply won't be able to perform mutations.
+			return ""
+		}
+		session.CSRFToken = token
+		s.Sessions.Set(w, session)
+	}
+	return session.CSRFToken
+}
+
+// checkCSRF makes sure a request is a POST carrying the session's CSRF token.
+// Otherwise, an error is returned to the user and false is returned.
+func (s *Service) checkCSRF(w http.ResponseWriter, r *http.Request, session *Session) bool {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method not allowed.")
+		return false
+	}
+	token := r.PostFormValue("csrf_token")
+	if session.CSRFToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Invalid or missing CSRF token, please go back, reload the page and try again.")
+		return false
+	}
+	return true
+}
+
+// confirm shows a page asking the user to confirm a state-changing action,
+// which is then POSTed back to the same URL. It's used for GET requests to
+// mutating endpoints, so that following links (or prefetching them) never
+// changes anything.
+func (s *Service) confirm(w http.ResponseWriter, r *http.Request, session *Session, message string) {
+	token := s.csrfToken(w, session)
+	templateConfirm.Execute(w, map[string]any{
+		"Username":  session.Username,
+		"Message":   message,
+		"Action":    r.URL.Path,
+		"CSRFToken": token,
+		"SpaceName": s.cfg().SpaceName,
+		"SpaceURL":  s.cfg().SpaceURL,
+	})
+}
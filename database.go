@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sort"
+	"time"
 
 	"go.etcd.io/bbolt"
 	"k8s.io/klog/v2"
@@ -19,41 +22,143 @@ type BoltDatabase struct {
 var (
 	// Map from hardware ID to serialized Device
 	bucketDevices = []byte("devices")
+	// Map from alias key (see aliasKey) to hardware ID of the primary MAC
+	// address of a Device.
+	bucketAliases = []byte("aliases")
+	// Map from user nickname to nested bucket, which contains the primary MAC
+	// addresses of all devices of that user as keys (with empty values).
+	bucketUserDevices = []byte("user_devices")
 )
 
 // NewBoltDatabase returns a BoltDatabase, creating it at the given path if
 // needed.
 func NewBoltDatabase(path string) (*BoltDatabase, error) {
-	db, err := bbolt.Open(path, 0666, nil)
+	return openBoltDatabase(path, true)
+}
+
+// openBoltDatabase opens a BoltDatabase, migrating it if needed. If repair is
+// true, the user devices index is checked and rebuilt if it's inconsistent.
+func openBoltDatabase(path string, repair bool) (*BoltDatabase, error) {
+	// Don't wait forever for another process to release the file lock.
+	db, err := bbolt.Open(path, 0666, &bbolt.Options{Timeout: time.Second})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open DB file: %w", err)
 	}
 
-	db.Update(func(tx *bbolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(bucketDevices); err != nil {
-			return err
+	b := &BoltDatabase{
+		db: db,
+	}
+	if err := b.migrate(path); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate DB: %w", err)
+	}
+	if repair {
+		if err := b.repairUserIndex(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to repair DB: %w", err)
 		}
-		return nil
-	})
+	}
+	return b, nil
+}
 
-	return &BoltDatabase{
-		db: db,
-	}, nil
+// Close closes the underlying BoltDB.
+func (b *BoltDatabase) Close() error {
+	return b.db.Close()
 }
 
 // Device is the stored per-device data in the database.
 type Device struct {
-	// MACAddress is the string representation of the MAC address of the device.
+	// MACAddress is the string representation of the primary MAC address of
+	// the device. This is the address that the device was first claimed with.
 	MACAddress string `json:"mac_address"`
+	// AdditionalMACAddresses are other MAC addresses that belong to the same
+	// logical device, eg. per-network randomized addresses of a phone.
+	AdditionalMACAddresses []string `json:"additional_mac_addresses,omitempty"`
 	// Hostname is the name of the device as visible to the user in the
 	// management panel.
 	Hostname string `json:"hostname"`
 	// UserNickname is the nickname of the user who manages this device.
 	UserNickname string `json:"user_nickname"`
+	// ClientID is the DHCP client identifier last seen for this device when
+	// it was claimed.
+	ClientID string `json:"client_id,omitempty"`
+	// MatchClientID enables matching leases to this device by ClientID, in
+	// addition to MAC addresses.
+	MatchClientID bool `json:"match_client_id,omitempty"`
+	// MatchHostname enables matching leases to this device by Hostname, in
+	// addition to MAC addresses.
+	MatchHostname bool `json:"match_hostname,omitempty"`
+	// ClaimedAt is the time at which the device was first claimed.
+	ClaimedAt time.Time `json:"claimed_at"`
+	// LastSeenAt is the last time at which the device had an active lease.
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Stale is set when the device hasn't been seen for a while and the
+	// expiry policy is to flag (and not to unclaim) such devices. It's
+	// cleared when the device is seen again.
+	Stale bool `json:"stale,omitempty"`
+	// Visibility of the device to others when present. By default, the
+	// user's visibility is used.
+	Visibility Visibility `json:"visibility,omitempty"`
+	// Name, Type and Notes are set by the user, see DeviceMetadata.
+	Name  string     `json:"name,omitempty"`
+	Type  DeviceType `json:"type,omitempty"`
+	Notes string     `json:"notes,omitempty"`
+}
+
+// lastSeenGranularity is how often the last seen time of present devices is
+// updated. Expiry periods are in the order of days, so there's no point in
+// rewriting every present device every minute.
+const lastSeenGranularity = time.Hour
+
+// needsSeen returns true if the last seen time or stale flag of a device have
+// to be updated when it's seen at a given time.
+func (d *Device) needsSeen(at time.Time) bool {
+	return d.Stale || at.Sub(d.LastSeenAt) >= lastSeenGranularity
+}
+
+// SeenAt returns the last time the device is known to have been present,
+// falling back to the claim time for devices which haven't been seen by the
+// expiry job yet. A zero time is returned for devices claimed before these
+// timestamps were tracked.
+func (d *Device) SeenAt() time.Time {
+	if d.LastSeenAt.After(d.ClaimedAt) {
+		return d.LastSeenAt
+	}
+	return d.ClaimedAt
+}
+
+// Addresses returns all MAC addresses of this device, primary first.
+func (d *Device) Addresses() []string {
+	return append([]string{d.MACAddress}, d.AdditionalMACAddresses...)
 }
 
-func (b *BoltDatabase) getDeviceForMacAddress(devices *bbolt.Bucket, maddr net.HardwareAddr) (*Device, error) {
-	deviceBytes := devices.Get([]byte(maddr.String()))
+// aliasKeys returns the keys under which this device should be findable in
+// the aliases bucket.
+func (d *Device) aliasKeys() [][]byte {
+	var res [][]byte
+	for _, mac := range d.AdditionalMACAddresses {
+		res = append(res, aliasKey("mac", mac))
+	}
+	if d.MatchClientID && d.ClientID != "" {
+		res = append(res, aliasKey("client_id", d.ClientID))
+	}
+	if d.MatchHostname && d.Hostname != "" {
+		res = append(res, aliasKey("hostname", d.Hostname))
+	}
+	return res
+}
+
+// aliasKey builds a key into the aliases bucket. Kind is one of mac,
+// client_id or hostname.
+func aliasKey(kind, value string) []byte {
+	return []byte(kind + "/" + value)
+}
+
+func getDevice(devices *bbolt.Bucket, key []byte) (*Device, error) {
+	deviceBytes := devices.Get(key)
 	if deviceBytes == nil {
 		return nil, nil
 	}
@@ -64,21 +169,127 @@ func (b *BoltDatabase) getDeviceForMacAddress(devices *bbolt.Bucket, maddr net.H
 	return &device, nil
 }
 
+// getDeviceForMacAddress returns the device which has the given MAC address as
+// either its primary or additional address, or nil if no such device exists.
+func (b *BoltDatabase) getDeviceForMacAddress(tx *bbolt.Tx, maddr net.HardwareAddr) (*Device, error) {
+	devices := tx.Bucket(bucketDevices)
+	device, err := getDevice(devices, []byte(maddr.String()))
+	if err != nil || device != nil {
+		return device, err
+	}
+	return b.getDeviceForAlias(tx, aliasKey("mac", maddr.String()))
+}
+
+func (b *BoltDatabase) getDeviceForAlias(tx *bbolt.Tx, key []byte) (*Device, error) {
+	primary := tx.Bucket(bucketAliases).Get(key)
+	if primary == nil {
+		return nil, nil
+	}
+	return getDevice(tx.Bucket(bucketDevices), primary)
+}
+
+// getDeviceForLease returns the device matching a lease, first by MAC address,
+// then by client ID and finally by hostname.
+func (b *BoltDatabase) getDeviceForLease(tx *bbolt.Tx, lease *Lease) (*Device, error) {
+	device, err := b.getDeviceForMacAddress(tx, lease.MACAddress)
+	if err != nil || device != nil {
+		return device, err
+	}
+	if lease.ClientID != "" {
+		device, err = b.getDeviceForAlias(tx, aliasKey("client_id", lease.ClientID))
+		if err != nil || device != nil {
+			return device, err
+		}
+	}
+	if lease.Hostname != "" {
+		return b.getDeviceForAlias(tx, aliasKey("hostname", lease.Hostname))
+	}
+	return nil, nil
+}
+
+// putDevice stores a device, replacing a previous version of it (if any) and
+// keeping the aliases bucket up to date. An error is returned if any of the
+// device's aliases already belong to some other device, or if any of its
+// addresses belong to equipment.
+func (b *BoltDatabase) putDevice(tx *bbolt.Tx, prev, device *Device) error {
+	devices := tx.Bucket(bucketDevices)
+	aliases := tx.Bucket(bucketAliases)
+	if prev != nil {
+		for _, k := range prev.aliasKeys() {
+			if err := aliases.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	for _, addr := range device.Addresses() {
+		if isEquipment(tx, addr) {
+			return fmt.Errorf("%s is equipment of the space", addr)
+		}
+	}
+	for _, k := range device.aliasKeys() {
+		if existing := aliases.Get(k); existing != nil && string(existing) != device.MACAddress {
+			return fmt.Errorf("%s already belongs to another device", k)
+		}
+		if err := aliases.Put(k, []byte(device.MACAddress)); err != nil {
+			return err
+		}
+	}
+	if prev != nil && prev.UserNickname != device.UserNickname {
+		if err := unindexUserDevice(tx, prev); err != nil {
+			return err
+		}
+	}
+	if err := indexUserDevice(tx, device); err != nil {
+		return err
+	}
+	v, err := json.Marshal(device)
+	if err != nil {
+		return fmt.Errorf("could not marshal device: %v", err)
+	}
+	return devices.Put([]byte(device.MACAddress), v)
+}
+
+// deleteDevice removes a device and all its aliases.
+func (b *BoltDatabase) deleteDevice(tx *bbolt.Tx, device *Device) error {
+	aliases := tx.Bucket(bucketAliases)
+	for _, k := range device.aliasKeys() {
+		if err := aliases.Delete(k); err != nil {
+			return err
+		}
+	}
+	if err := unindexUserDevice(tx, device); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketDevices).Delete([]byte(device.MACAddress))
+}
+
 // GetDevicesForMacAddresses returns a list of devices that match the given MAC
-// addresses.
+// addresses, either by their primary or additional MAC addresses.
 func (b *BoltDatabase) GetDevicesForMacAddresses(macAddresses []net.HardwareAddr) ([]*Device, error) {
+	leases := make([]*Lease, 0, len(macAddresses))
+	for _, maddr := range macAddresses {
+		leases = append(leases, &Lease{MACAddress: maddr})
+	}
+	return b.GetDevicesForLeases(leases)
+}
+
+// GetDevicesForLeases returns a list of devices that match the given leases.
+// Leases are matched to devices by MAC address, and by DHCP client ID and
+// hostname for devices which have opted into that.
+func (b *BoltDatabase) GetDevicesForLeases(leases []*Lease) ([]*Device, error) {
 	var res []*Device
+	seen := make(map[string]bool)
 	err := b.db.View(func(tx *bbolt.Tx) error {
-		devices := tx.Bucket(bucketDevices)
-		for _, maddr := range macAddresses {
-			device, err := b.getDeviceForMacAddress(devices, maddr)
+		for _, lease := range leases {
+			device, err := b.getDeviceForLease(tx, lease)
 			if err != nil {
-				klog.Warningf("Device %q could not be unmarshaled: %v", maddr, err)
+				klog.Warningf("Device %q could not be unmarshaled: %v", lease.MACAddress, err)
 				continue
 			}
-			if device == nil {
+			if device == nil || seen[device.MACAddress] {
 				continue
 			}
+			seen[device.MACAddress] = true
 			res = append(res, device)
 		}
 		return nil
@@ -96,43 +307,63 @@ func (b *BoltDatabase) GetDevicesForMacAddresses(macAddresses []net.HardwareAddr
 func (b *BoltDatabase) GetDevicesForUser(user string) ([]*Device, error) {
 	var res []*Device
 	err := b.db.View(func(tx *bbolt.Tx) error {
+		index := tx.Bucket(bucketUserDevices).Bucket([]byte(user))
+		if index == nil {
+			return nil
+		}
 		devices := tx.Bucket(bucketDevices)
-		// TODO(q3k): index so that linear scan isn't needed
-		cur := devices.Cursor()
-		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		return index.ForEach(func(k, _ []byte) error {
+			device, err := getDevice(devices, k)
+			if err != nil {
+				klog.Warningf("Device %q could not be unmarshaled: %v", k, err)
+				return nil
+			}
+			if device == nil {
+				klog.Warningf("Device %q of %q is in user index, but does not exist", k, user)
+				return nil
+			}
+			res = append(res, device)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Already sorted by MAC address, as bbolt keys are sorted.
+	return res, nil
+}
+
+// GetDevices returns all devices, sorted by MAC address.
+func (b *BoltDatabase) GetDevices() ([]*Device, error) {
+	var res []*Device
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketDevices).ForEach(func(k, v []byte) error {
 			var device Device
 			if err := json.Unmarshal(v, &device); err != nil {
 				klog.Warningf("Device %q could not be unmarshaled: %v", k, err)
-				continue
-			}
-			if device.UserNickname != user {
-				continue
+				return nil
 			}
 			res = append(res, &device)
-		}
-		return nil
+			return nil
+		})
 	})
 	if err != nil {
 		return nil, err
 	}
-	sort.Slice(res, func(i, j int) bool {
-		return res[i].MACAddress < res[j].MACAddress
-	})
 	return res, nil
 }
 
-// ClaimDevice marks a device with a given mac address and hostname as
-// managed/claimed by the given user.
+// ClaimDevice marks a device with a given mac address, hostname and DHCP client
+// ID as managed/claimed by the given user.
 //
-// If the same user already claimed this device (by MAC address) the hostname
-// is updated (upsert semantics).
+// If the same user already claimed this device (by MAC address, primary or
+// additional) the hostname and client ID are updated (upsert semantics).
 //
 // If some other user already claim this device (by MAC address) an error is
 // returned.
-func (b *BoltDatabase) ClaimDevice(user string, macAddress net.HardwareAddr, hostname string) error {
+func (b *BoltDatabase) ClaimDevice(user string, macAddress net.HardwareAddr, hostname, clientID string) error {
 	return b.db.Update(func(tx *bbolt.Tx) error {
-		devices := tx.Bucket(bucketDevices)
-		existing, err := b.getDeviceForMacAddress(devices, macAddress)
+		existing, err := b.getDeviceForMacAddress(tx, macAddress)
 		if err != nil {
 			return fmt.Errorf("could not unmarshal existing device: %w", err)
 		}
@@ -140,30 +371,433 @@ func (b *BoltDatabase) ClaimDevice(user string, macAddress net.HardwareAddr, hos
 			return fmt.Errorf("device already claimed")
 		}
 
-		v, err := json.Marshal(Device{
+		now := time.Now()
+		device := Device{
 			MACAddress:   macAddress.String(),
 			Hostname:     hostname,
 			UserNickname: user,
-		})
-		if err != nil {
-			return fmt.Errorf("could not marshal device: %v", err)
+			ClientID:     clientID,
+			ClaimedAt:    now,
+		}
+		if existing != nil {
+			device = *existing
+			device.Hostname = hostname
+			device.ClientID = clientID
 		}
-		return devices.Put([]byte(macAddress.String()), v)
+		// Claiming happens from an active lease, so the device is present.
+		device.LastSeenAt = now
+		device.Stale = false
+		return b.putDevice(tx, existing, &device)
 	})
 }
 
 // UnclaimDevice releases a device from being managed by the user. If the device
-// is managed by some other user, an error is returned.
+// is managed by some other user, an error is returned. The device can be given
+// by any of its MAC addresses.
 func (b *BoltDatabase) UnclaimDevice(user string, macAddress net.HardwareAddr) error {
 	return b.db.Update(func(tx *bbolt.Tx) error {
-		devices := tx.Bucket(bucketDevices)
-		device, err := b.getDeviceForMacAddress(devices, macAddress)
+		device, err := b.getDeviceForMacAddress(tx, macAddress)
 		if err != nil {
 			return fmt.Errorf("could not unmarshal existing device: %w", err)
 		}
-		if device != nil && device.UserNickname != user {
+		if device == nil {
+			return nil
+		}
+		if device.UserNickname != user {
 			return fmt.Errorf("device does not belong to user")
 		}
-		return devices.Delete([]byte(macAddress.String()))
+		return b.deleteDevice(tx, device)
+	})
+}
+
+// ImportDevice stores a device as given, eg. from an export. If an identical
+// device already exists, nothing is done. If the device conflicts with an
+// existing device, an error wrapping ErrConflict is returned.
+func (b *BoltDatabase) ImportDevice(device *Device) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, addr := range device.Addresses() {
+			mac, err := net.ParseMAC(addr)
+			if err != nil {
+				return fmt.Errorf("invalid MAC address %q: %w", addr, err)
+			}
+			existing, err := b.getDeviceForMacAddress(tx, mac)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal existing device: %w", err)
+			}
+			if existing == nil {
+				continue
+			}
+			if devicesEqual(existing, device) {
+				return nil
+			}
+			return fmt.Errorf("%w: %s already belongs to device %s of %s", ErrConflict, addr, existing.MACAddress, existing.UserNickname)
+		}
+		if err := b.putDevice(tx, nil, device); err != nil {
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent snapshot of the database to w.
+func (b *BoltDatabase) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// getUserDevice returns a device with the given MAC address (primary or
+// additional) that must be owned by the given user.
+func (b *BoltDatabase) getUserDevice(tx *bbolt.Tx, user string, macAddress net.HardwareAddr) (*Device, error) {
+	device, err := b.getDeviceForMacAddress(tx, macAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal existing device: %w", err)
+	}
+	if device == nil {
+		return nil, fmt.Errorf("no such device")
+	}
+	if device.UserNickname != user {
+		return nil, fmt.Errorf("device does not belong to user")
+	}
+	return device, nil
+}
+
+// AddDeviceAddress adds an additional MAC address to a user's device. If the
+// address is already the primary address of another device of that user,
+// that device is merged into this one. If the address belongs to some other
+// user, an error is returned.
+func (b *BoltDatabase) AddDeviceAddress(user string, device, macAddress net.HardwareAddr) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		d, err := b.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		other, err := b.getDeviceForMacAddress(tx, macAddress)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal existing device: %w", err)
+		}
+		if other != nil {
+			if other.UserNickname != user {
+				return fmt.Errorf("address already claimed")
+			}
+			if other.MACAddress == d.MACAddress {
+				// Already part of this device.
+				return nil
+			}
+			if other.MACAddress != macAddress.String() {
+				return fmt.Errorf("address is already an additional address of %s", other.MACAddress)
+			}
+			// Merge other device (and its additional addresses) into this one.
+			if err := b.deleteDevice(tx, other); err != nil {
+				return err
+			}
+		}
+
+		updated := *d
+		updated.AdditionalMACAddresses = append([]string{}, d.AdditionalMACAddresses...)
+		updated.AdditionalMACAddresses = append(updated.AdditionalMACAddresses, macAddress.String())
+		if other != nil {
+			updated.AdditionalMACAddresses = append(updated.AdditionalMACAddresses, other.AdditionalMACAddresses...)
+			if other.LastSeenAt.After(updated.LastSeenAt) {
+				updated.LastSeenAt = other.LastSeenAt
+				updated.Stale = other.Stale
+			}
+		}
+		sort.Strings(updated.AdditionalMACAddresses)
+		return b.putDevice(tx, d, &updated)
+	})
+}
+
+// RemoveDeviceAddress removes an additional MAC address from a user's device.
+// The primary address of a device cannot be removed, the device should be
+// unclaimed instead.
+func (b *BoltDatabase) RemoveDeviceAddress(user string, device, macAddress net.HardwareAddr) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		d, err := b.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		updated := *d
+		updated.AdditionalMACAddresses = nil
+		found := false
+		for _, addr := range d.AdditionalMACAddresses {
+			if addr == macAddress.String() {
+				found = true
+				continue
+			}
+			updated.AdditionalMACAddresses = append(updated.AdditionalMACAddresses, addr)
+		}
+		if !found {
+			return fmt.Errorf("not an additional address of this device")
+		}
+		return b.putDevice(tx, d, &updated)
+	})
+}
+
+// SetDeviceMatching configures whether leases should be matched to a user's
+// device by DHCP client ID and/or hostname, in addition to MAC addresses.
+func (b *BoltDatabase) SetDeviceMatching(user string, device net.HardwareAddr, clientID, hostname bool) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		d, err := b.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		updated := *d
+		updated.MatchClientID = clientID
+		updated.MatchHostname = hostname
+		return b.putDevice(tx, d, &updated)
+	})
+}
+
+func (b *BoltDatabase) SetDeviceVisibility(user string, device net.HardwareAddr, visibility Visibility) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		d, err := b.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		updated := *d
+		updated.Visibility = visibility
+		return b.putDevice(tx, d, &updated)
+	})
+}
+
+func (b *BoltDatabase) SetDeviceMetadata(user string, device net.HardwareAddr, metadata DeviceMetadata) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		d, err := b.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		updated := *d
+		updated.Name = metadata.Name
+		updated.Type = metadata.Type
+		updated.Notes = metadata.Notes
+		return b.putDevice(tx, d, &updated)
 	})
 }
+
+// RenameUser moves all devices and data of a user to a different user,
+// returning the number of devices moved. It refuses to overwrite settings or a
+// check-in of the target user, and revokes all sessions of the old name.
+func (b *BoltDatabase) RenameUser(from, to string) (int, error) {
+	var n int
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		fromUser, err := getUser(tx, from)
+		if err != nil {
+			return err
+		}
+		toUser, err := getUser(tx, to)
+		if err != nil {
+			return err
+		}
+		if fromUser.hasSettings() && toUser.hasSettings() {
+			return fmt.Errorf("%s already has settings (visibility, status or API token)", to)
+		}
+		checkIns := tx.Bucket(bucketCheckIns)
+		checkIn := checkIns.Get([]byte(from))
+		if checkIn != nil && checkIns.Get([]byte(to)) != nil {
+			return fmt.Errorf("%s is already checked in", to)
+		}
+
+		if fromUser.hasSettings() {
+			updated := *fromUser
+			updated.Username = to
+			updated.SessionGeneration = toUser.SessionGeneration
+			if err := putUser(tx, &updated); err != nil {
+				return err
+			}
+		}
+		if err := putUser(tx, &User{Username: from, SessionGeneration: fromUser.SessionGeneration + 1}); err != nil {
+			return err
+		}
+		if checkIn != nil {
+			var c CheckIn
+			if err := json.Unmarshal(checkIn, &c); err != nil {
+				return fmt.Errorf("could not unmarshal check-in: %w", err)
+			}
+			c.Username = to
+			v, err := json.Marshal(&c)
+			if err != nil {
+				return err
+			}
+			if err := checkIns.Put([]byte(to), v); err != nil {
+				return err
+			}
+			if err := checkIns.Delete([]byte(from)); err != nil {
+				return err
+			}
+		}
+		subscriptions := tx.Bucket(bucketSubscriptions)
+		var moved []*Subscription
+		err = subscriptions.ForEach(func(k, v []byte) error {
+			var sub Subscription
+			if err := json.Unmarshal(v, &sub); err != nil {
+				klog.Warningf("Subscription %q could not be unmarshaled: %v", k, err)
+				return nil
+			}
+			if sub.Username == from {
+				moved = append(moved, &sub)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Modify outside of ForEach, as bbolt doesn't allow modifying a
+		// bucket while iterating over it.
+		for _, sub := range moved {
+			sub.Username = to
+			v, err := json.Marshal(sub)
+			if err != nil {
+				return err
+			}
+			if err := subscriptions.Put([]byte(sub.ID), v); err != nil {
+				return err
+			}
+		}
+
+		index := tx.Bucket(bucketUserDevices).Bucket([]byte(from))
+		if index == nil {
+			return nil
+		}
+		// Collect keys first, as putDevice modifies the index.
+		var keys [][]byte
+		index.ForEach(func(k, _ []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		devices := tx.Bucket(bucketDevices)
+		for _, k := range keys {
+			device, err := getDevice(devices, k)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal device %q: %w", k, err)
+			}
+			if device == nil {
+				continue
+			}
+			updated := *device
+			updated.UserNickname = to
+			if err := b.putDevice(tx, device, &updated); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// MarkDevicesSeen sets the last seen time of all devices matching the given
+// leases, clearing their stale flag. Devices seen within lastSeenGranularity
+// are left alone, and the database isn't written to if no device changes.
+func (b *BoltDatabase) MarkDevicesSeen(leases []*Lease, at time.Time) error {
+	var changed []*Lease
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		for _, lease := range leases {
+			device, err := b.getDeviceForLease(tx, lease)
+			if err != nil {
+				klog.Warningf("Device %q could not be unmarshaled: %v", lease.MACAddress, err)
+				continue
+			}
+			if device != nil && device.needsSeen(at) {
+				changed = append(changed, lease)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(changed) == 0 {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		seen := make(map[string]bool)
+		for _, lease := range changed {
+			device, err := b.getDeviceForLease(tx, lease)
+			if err != nil {
+				klog.Warningf("Device %q could not be unmarshaled: %v", lease.MACAddress, err)
+				continue
+			}
+			if device == nil || seen[device.MACAddress] {
+				continue
+			}
+			seen[device.MACAddress] = true
+			if !device.needsSeen(at) {
+				continue
+			}
+			updated := *device
+			updated.LastSeenAt = at
+			updated.Stale = false
+			if err := b.putDevice(tx, device, &updated); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ExpireDevices finds all devices which haven't been seen since cutoff, and
+// either unclaims them (if unclaim is true) or flags them as stale. Devices
+// which have never been seen and have no claim time are skipped. The affected
+// devices are returned. If dryRun is true, the database is not modified.
+func (b *BoltDatabase) ExpireDevices(cutoff time.Time, unclaim, dryRun bool) ([]*Device, error) {
+	var res []*Device
+	fn := func(tx *bbolt.Tx) error {
+		devices := tx.Bucket(bucketDevices)
+		var stale []*Device
+		err := devices.ForEach(func(k, v []byte) error {
+			var device Device
+			if err := json.Unmarshal(v, &device); err != nil {
+				klog.Warningf("Device %q could not be unmarshaled: %v", k, err)
+				return nil
+			}
+			seen := device.SeenAt()
+			if seen.IsZero() || !seen.Before(cutoff) {
+				return nil
+			}
+			if device.Stale && !unclaim {
+				// Already flagged.
+				return nil
+			}
+			stale = append(stale, &device)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		res = stale
+		if dryRun {
+			return nil
+		}
+		// Modify outside of ForEach, as bbolt doesn't allow modifying a
+		// bucket while iterating over it.
+		for _, device := range stale {
+			if unclaim {
+				if err := b.deleteDevice(tx, device); err != nil {
+					return err
+				}
+				continue
+			}
+			updated := *device
+			updated.Stale = true
+			if err := b.putDevice(tx, device, &updated); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if dryRun {
+		err = b.db.View(fn)
+	} else {
+		err = b.db.Update(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].MACAddress < res[j].MACAddress
+	})
+	return res, nil
+}
@@ -0,0 +1,1124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDatabase stores checkinator data (claimed devices) in an SQLite
+// database on disk. Unlike BoltDatabase, the database can be queried by other
+// tools using SQL.
+type SQLiteDatabase struct {
+	db   *sql.DB
+	lock *os.File
+}
+
+// sqliteMigrations is the ordered list of all SQLite schema migrations.
+// sqliteMigrations[i] upgrades a database from version i to version i+1, with
+// the version stored as PRAGMA user_version. Never modify or remove existing
+// migrations, only append new ones.
+var sqliteMigrations = []string{
+	`
+	CREATE TABLE devices (
+		mac_address TEXT PRIMARY KEY,
+		hostname TEXT NOT NULL,
+		user_nickname TEXT NOT NULL,
+		client_id TEXT NOT NULL DEFAULT '',
+		match_client_id INTEGER NOT NULL DEFAULT 0,
+		match_hostname INTEGER NOT NULL DEFAULT 0,
+		claimed_at TEXT,
+		last_seen_at TEXT,
+		stale INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX devices_user_nickname ON devices (user_nickname);
+	CREATE UNIQUE INDEX devices_match_client_id ON devices (client_id) WHERE match_client_id AND client_id != '';
+	CREATE UNIQUE INDEX devices_match_hostname ON devices (hostname) WHERE match_hostname AND hostname != '';
+	CREATE TABLE device_addresses (
+		mac_address TEXT PRIMARY KEY,
+		device TEXT NOT NULL REFERENCES devices (mac_address) ON DELETE CASCADE
+	);
+	CREATE INDEX device_addresses_device ON device_addresses (device);
+	`,
+	`
+	CREATE TABLE users (
+		username TEXT PRIMARY KEY,
+		session_generation INTEGER NOT NULL DEFAULT 0
+	);
+	`,
+	`
+	ALTER TABLE devices ADD COLUMN visibility TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN visibility TEXT NOT NULL DEFAULT '';
+	`,
+	`
+	CREATE TABLE equipment (
+		mac_address TEXT PRIMARY KEY,
+		description TEXT NOT NULL,
+		added_by TEXT NOT NULL DEFAULT '',
+		added_at TEXT
+	);
+	`,
+	`
+	CREATE TABLE check_ins (
+		username TEXT PRIMARY KEY,
+		checked_in_at TEXT NOT NULL,
+		until TEXT NOT NULL
+	);
+	`,
+	`
+	ALTER TABLE users ADD COLUMN status_text TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN status_emoji TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN status_set_at TEXT;
+	ALTER TABLE users ADD COLUMN status_clear_on_leave INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+	ALTER TABLE users ADD COLUMN api_token_hash TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX users_api_token_hash ON users (api_token_hash) WHERE api_token_hash != '';
+	`,
+	`
+	ALTER TABLE devices ADD COLUMN name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE devices ADD COLUMN type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE devices ADD COLUMN notes TEXT NOT NULL DEFAULT '';
+	`,
+	`
+	CREATE TABLE subscriptions (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		event TEXT NOT NULL,
+		users TEXT NOT NULL DEFAULT '',
+		channel TEXT NOT NULL,
+		target TEXT NOT NULL,
+		quiet_start INTEGER NOT NULL DEFAULT 0,
+		quiet_end INTEGER NOT NULL DEFAULT 0,
+		min_interval INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT
+	);
+	`,
+}
+
+// NewSQLiteDatabase returns an SQLiteDatabase, creating it at the given path if
+// needed.
+func NewSQLiteDatabase(path string) (*SQLiteDatabase, error) {
+	// SQLite itself allows concurrent access, but we want the same exclusive
+	// semantics as BoltDB, so that maintenance commands don't run under a
+	// live server.
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_txlock=immediate")
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to open DB file: %w", err)
+	}
+	// Serialize all access, as SQLite only allows a single writer anyway.
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteDatabase{
+		db:   db,
+		lock: lock,
+	}
+	if err := s.migrate(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to migrate DB: %w", err)
+	}
+	return s, nil
+}
+
+func (s *SQLiteDatabase) migrate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(sqliteMigrations))
+	}
+	if version == len(sqliteMigrations) {
+		return nil
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		klog.Infof("Migrating database to version %d...", version+1)
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			return fmt.Errorf("migration to version %d failed: %w", version+1, err)
+		}
+	}
+	// PRAGMA doesn't support placeholders.
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the underlying SQLite database.
+func (s *SQLiteDatabase) Close() error {
+	err := s.db.Close()
+	s.lock.Close()
+	return err
+}
+
+// sqlTime converts a time into its stored representation, NULL for zero
+// times.
+func sqlTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseSQLTime parses a stored time, as written by sqlTime.
+func parseSQLTime(v sql.NullString) (time.Time, error) {
+	if !v.Valid {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, v.String)
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+const sqliteDeviceColumns = "mac_address, hostname, user_nickname, client_id, match_client_id, match_hostname, claimed_at, last_seen_at, stale, visibility, name, type, notes"
+
+// scanDevice scans a row of sqliteDeviceColumns into a Device, without its
+// additional addresses.
+func scanDevice(scan func(dest ...any) error) (*Device, error) {
+	var d Device
+	var claimedAt, lastSeenAt sql.NullString
+	if err := scan(&d.MACAddress, &d.Hostname, &d.UserNickname, &d.ClientID, &d.MatchClientID, &d.MatchHostname, &claimedAt, &lastSeenAt, &d.Stale, &d.Visibility, &d.Name, &d.Type, &d.Notes); err != nil {
+		return nil, err
+	}
+	var err error
+	if d.ClaimedAt, err = parseSQLTime(claimedAt); err != nil {
+		return nil, fmt.Errorf("invalid claimed_at: %w", err)
+	}
+	if d.LastSeenAt, err = parseSQLTime(lastSeenAt); err != nil {
+		return nil, fmt.Errorf("invalid last_seen_at: %w", err)
+	}
+	return &d, nil
+}
+
+// queryDevices returns all devices matching a query for sqliteDeviceColumns,
+// including their additional addresses.
+func (s *SQLiteDatabase) queryDevices(q querier, query string, args ...any) ([]*Device, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var res []*Device
+	for rows.Next() {
+		d, err := scanDevice(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, d := range res {
+		if err := s.loadAddresses(q, d); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (s *SQLiteDatabase) loadAddresses(q querier, d *Device) error {
+	rows, err := q.Query("SELECT mac_address FROM device_addresses WHERE device = ? ORDER BY mac_address", d.MACAddress)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	d.AdditionalMACAddresses = nil
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			return err
+		}
+		d.AdditionalMACAddresses = append(d.AdditionalMACAddresses, mac)
+	}
+	return rows.Err()
+}
+
+// queryDevice is like queryDevices, but for queries returning at most one
+// device. Nil is returned if no device matches.
+func (s *SQLiteDatabase) queryDevice(q querier, query string, args ...any) (*Device, error) {
+	devices, err := s.queryDevices(q, query, args...)
+	if err != nil || len(devices) == 0 {
+		return nil, err
+	}
+	return devices[0], nil
+}
+
+// getDeviceForMacAddress returns the device which has the given MAC address as
+// either its primary or additional address, or nil if no such device exists.
+func (s *SQLiteDatabase) getDeviceForMacAddress(q querier, maddr net.HardwareAddr) (*Device, error) {
+	return s.queryDevice(q, `
+		SELECT `+sqliteDeviceColumns+` FROM devices WHERE mac_address = ?1
+		UNION ALL
+		SELECT `+sqliteDeviceColumns+` FROM devices WHERE mac_address = (SELECT device FROM device_addresses WHERE mac_address = ?1)
+	`, maddr.String())
+}
+
+// getDeviceForLease returns the device matching a lease, first by MAC address,
+// then by client ID and finally by hostname.
+func (s *SQLiteDatabase) getDeviceForLease(q querier, lease *Lease) (*Device, error) {
+	device, err := s.getDeviceForMacAddress(q, lease.MACAddress)
+	if err != nil || device != nil {
+		return device, err
+	}
+	if lease.ClientID != "" {
+		device, err = s.queryDevice(q, "SELECT "+sqliteDeviceColumns+" FROM devices WHERE match_client_id AND client_id = ?", lease.ClientID)
+		if err != nil || device != nil {
+			return device, err
+		}
+	}
+	if lease.Hostname != "" {
+		return s.queryDevice(q, "SELECT "+sqliteDeviceColumns+" FROM devices WHERE match_hostname AND hostname = ?", lease.Hostname)
+	}
+	return nil, nil
+}
+
+// putDevice inserts or replaces a device and its additional addresses. Any
+// conflicts (additional addresses, client ID or hostname matching already
+// used by another device, addresses belonging to equipment) result in an
+// error.
+func (s *SQLiteDatabase) putDevice(tx *sql.Tx, device *Device) error {
+	for _, mac := range device.Addresses() {
+		err := tx.QueryRow("SELECT 1 FROM equipment WHERE mac_address = ?", mac).Scan(new(int))
+		switch {
+		case err == nil:
+			return fmt.Errorf("%s is equipment of the space", mac)
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+	}
+	_, err := tx.Exec(`
+		INSERT INTO devices (`+sqliteDeviceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (mac_address) DO UPDATE SET
+			hostname = excluded.hostname,
+			user_nickname = excluded.user_nickname,
+			client_id = excluded.client_id,
+			match_client_id = excluded.match_client_id,
+			match_hostname = excluded.match_hostname,
+			claimed_at = excluded.claimed_at,
+			last_seen_at = excluded.last_seen_at,
+			stale = excluded.stale,
+			visibility = excluded.visibility,
+			name = excluded.name,
+			type = excluded.type,
+			notes = excluded.notes
+	`, device.MACAddress, device.Hostname, device.UserNickname, device.ClientID, device.MatchClientID, device.MatchHostname, sqlTime(device.ClaimedAt), sqlTime(device.LastSeenAt), device.Stale, device.Visibility, device.Name, device.Type, device.Notes)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return fmt.Errorf("client ID or hostname already matched by another device")
+		}
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM device_addresses WHERE device = ?", device.MACAddress); err != nil {
+		return err
+	}
+	for _, mac := range device.AdditionalMACAddresses {
+		var owner string
+		err := tx.QueryRow(`
+			SELECT mac_address FROM devices WHERE mac_address = ?1
+			UNION ALL
+			SELECT device FROM device_addresses WHERE mac_address = ?1
+		`, mac).Scan(&owner)
+		switch {
+		case err == nil:
+			return fmt.Errorf("mac/%s already belongs to another device", mac)
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO device_addresses (mac_address, device) VALUES (?, ?)", mac, device.MACAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteDevice removes a device and (by cascade) all its additional addresses.
+func (s *SQLiteDatabase) deleteDevice(tx *sql.Tx, device *Device) error {
+	_, err := tx.Exec("DELETE FROM devices WHERE mac_address = ?", device.MACAddress)
+	return err
+}
+
+// update runs fn in a transaction, committing it if fn returns no error.
+func (s *SQLiteDatabase) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// view runs fn in a read-only transaction, which (unlike those of update)
+// doesn't take the write lock.
+func (s *SQLiteDatabase) view(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+func (s *SQLiteDatabase) GetDevicesForMacAddresses(macAddresses []net.HardwareAddr) ([]*Device, error) {
+	leases := make([]*Lease, 0, len(macAddresses))
+	for _, maddr := range macAddresses {
+		leases = append(leases, &Lease{MACAddress: maddr})
+	}
+	return s.GetDevicesForLeases(leases)
+}
+
+func (s *SQLiteDatabase) GetDevicesForLeases(leases []*Lease) ([]*Device, error) {
+	var res []*Device
+	err := s.view(func(tx *sql.Tx) error {
+		seen := make(map[string]bool)
+		for _, lease := range leases {
+			device, err := s.getDeviceForLease(tx, lease)
+			if err != nil {
+				return err
+			}
+			if device == nil || seen[device.MACAddress] {
+				continue
+			}
+			seen[device.MACAddress] = true
+			res = append(res, device)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].MACAddress < res[j].MACAddress
+	})
+	return res, nil
+}
+
+func (s *SQLiteDatabase) GetDevicesForUser(user string) ([]*Device, error) {
+	return s.queryDevices(s.db, "SELECT "+sqliteDeviceColumns+" FROM devices WHERE user_nickname = ? ORDER BY mac_address", user)
+}
+
+func (s *SQLiteDatabase) GetDevices() ([]*Device, error) {
+	return s.queryDevices(s.db, "SELECT "+sqliteDeviceColumns+" FROM devices ORDER BY mac_address")
+}
+
+func (s *SQLiteDatabase) ClaimDevice(user string, macAddress net.HardwareAddr, hostname, clientID string) error {
+	return s.update(func(tx *sql.Tx) error {
+		existing, err := s.getDeviceForMacAddress(tx, macAddress)
+		if err != nil {
+			return fmt.Errorf("could not get existing device: %w", err)
+		}
+		if existing != nil && existing.UserNickname != user {
+			return fmt.Errorf("device already claimed")
+		}
+
+		now := time.Now()
+		device := Device{
+			MACAddress:   macAddress.String(),
+			Hostname:     hostname,
+			UserNickname: user,
+			ClientID:     clientID,
+			ClaimedAt:    now,
+		}
+		if existing != nil {
+			device = *existing
+			device.Hostname = hostname
+			device.ClientID = clientID
+		}
+		// Claiming happens from an active lease, so the device is present.
+		device.LastSeenAt = now
+		device.Stale = false
+		return s.putDevice(tx, &device)
+	})
+}
+
+func (s *SQLiteDatabase) UnclaimDevice(user string, macAddress net.HardwareAddr) error {
+	return s.update(func(tx *sql.Tx) error {
+		device, err := s.getDeviceForMacAddress(tx, macAddress)
+		if err != nil {
+			return fmt.Errorf("could not get existing device: %w", err)
+		}
+		if device == nil {
+			return nil
+		}
+		if device.UserNickname != user {
+			return fmt.Errorf("device does not belong to user")
+		}
+		return s.deleteDevice(tx, device)
+	})
+}
+
+func (s *SQLiteDatabase) ImportDevice(device *Device) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, addr := range device.Addresses() {
+			mac, err := net.ParseMAC(addr)
+			if err != nil {
+				return fmt.Errorf("invalid MAC address %q: %w", addr, err)
+			}
+			existing, err := s.getDeviceForMacAddress(tx, mac)
+			if err != nil {
+				return fmt.Errorf("could not get existing device: %w", err)
+			}
+			if existing == nil {
+				continue
+			}
+			if devicesEqual(existing, device) {
+				return nil
+			}
+			return fmt.Errorf("%w: %s already belongs to device %s of %s", ErrConflict, addr, existing.MACAddress, existing.UserNickname)
+		}
+		if err := s.putDevice(tx, device); err != nil {
+			return fmt.Errorf("%w: %v", ErrConflict, err)
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent snapshot of the database to w. The snapshot is
+// made using VACUUM INTO a temporary file, which is then removed.
+func (s *SQLiteDatabase) Backup(w io.Writer) (int64, error) {
+	dir, err := os.MkdirTemp("", "yacheck-backup")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.sqlite")
+	if _, err := s.db.Exec("VACUUM INTO ?", path); err != nil {
+		return 0, fmt.Errorf("could not snapshot database: %w", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// getUserDevice returns a device with the given MAC address (primary or
+// additional) that must be owned by the given user.
+func (s *SQLiteDatabase) getUserDevice(tx *sql.Tx, user string, macAddress net.HardwareAddr) (*Device, error) {
+	device, err := s.getDeviceForMacAddress(tx, macAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not get existing device: %w", err)
+	}
+	if device == nil {
+		return nil, fmt.Errorf("no such device")
+	}
+	if device.UserNickname != user {
+		return nil, fmt.Errorf("device does not belong to user")
+	}
+	return device, nil
+}
+
+func (s *SQLiteDatabase) AddDeviceAddress(user string, device, macAddress net.HardwareAddr) error {
+	return s.update(func(tx *sql.Tx) error {
+		d, err := s.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		other, err := s.getDeviceForMacAddress(tx, macAddress)
+		if err != nil {
+			return fmt.Errorf("could not get existing device: %w", err)
+		}
+		if other != nil {
+			if other.UserNickname != user {
+				return fmt.Errorf("address already claimed")
+			}
+			if other.MACAddress == d.MACAddress {
+				// Already part of this device.
+				return nil
+			}
+			if other.MACAddress != macAddress.String() {
+				return fmt.Errorf("address is already an additional address of %s", other.MACAddress)
+			}
+			// Merge other device (and its additional addresses) into this one.
+			if err := s.deleteDevice(tx, other); err != nil {
+				return err
+			}
+		}
+
+		updated := *d
+		updated.AdditionalMACAddresses = append([]string{}, d.AdditionalMACAddresses...)
+		updated.AdditionalMACAddresses = append(updated.AdditionalMACAddresses, macAddress.String())
+		if other != nil {
+			updated.AdditionalMACAddresses = append(updated.AdditionalMACAddresses, other.AdditionalMACAddresses...)
+			if other.LastSeenAt.After(updated.LastSeenAt) {
+				updated.LastSeenAt = other.LastSeenAt
+				updated.Stale = other.Stale
+			}
+		}
+		sort.Strings(updated.AdditionalMACAddresses)
+		return s.putDevice(tx, &updated)
+	})
+}
+
+func (s *SQLiteDatabase) RemoveDeviceAddress(user string, device, macAddress net.HardwareAddr) error {
+	return s.update(func(tx *sql.Tx) error {
+		d, err := s.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec("DELETE FROM device_addresses WHERE device = ? AND mac_address = ?", d.MACAddress, macAddress.String())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("not an additional address of this device")
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteDatabase) SetDeviceMatching(user string, device net.HardwareAddr, clientID, hostname bool) error {
+	return s.update(func(tx *sql.Tx) error {
+		d, err := s.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		updated := *d
+		updated.MatchClientID = clientID
+		updated.MatchHostname = hostname
+		return s.putDevice(tx, &updated)
+	})
+}
+
+func (s *SQLiteDatabase) SetDeviceVisibility(user string, device net.HardwareAddr, visibility Visibility) error {
+	return s.update(func(tx *sql.Tx) error {
+		d, err := s.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		updated := *d
+		updated.Visibility = visibility
+		return s.putDevice(tx, &updated)
+	})
+}
+
+func (s *SQLiteDatabase) SetDeviceMetadata(user string, device net.HardwareAddr, metadata DeviceMetadata) error {
+	return s.update(func(tx *sql.Tx) error {
+		d, err := s.getUserDevice(tx, user, device)
+		if err != nil {
+			return err
+		}
+		updated := *d
+		updated.Name = metadata.Name
+		updated.Type = metadata.Type
+		updated.Notes = metadata.Notes
+		return s.putDevice(tx, &updated)
+	})
+}
+
+func (s *SQLiteDatabase) RenameUser(from, to string) (int, error) {
+	var n int64
+	err := s.update(func(tx *sql.Tx) error {
+		fromUser, err := s.getUser(tx, from)
+		if err != nil {
+			return err
+		}
+		toUser, err := s.getUser(tx, to)
+		if err != nil {
+			return err
+		}
+		if fromUser.hasSettings() && toUser.hasSettings() {
+			return fmt.Errorf("%s already has settings (visibility, status or API token)", to)
+		}
+		var checkIns int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM check_ins WHERE username IN (?, ?)", from, to).Scan(&checkIns); err != nil {
+			return err
+		}
+		if checkIns == 2 {
+			return fmt.Errorf("%s is already checked in", to)
+		}
+
+		// Clear the old user first, as API token hashes are unique.
+		if _, err := tx.Exec(`
+			INSERT INTO users (username, session_generation) VALUES (?, 1)
+			ON CONFLICT (username) DO UPDATE SET
+				session_generation = session_generation + 1,
+				visibility = '',
+				status_text = '',
+				status_emoji = '',
+				status_set_at = NULL,
+				status_clear_on_leave = 0,
+				api_token_hash = ''
+		`, from); err != nil {
+			return err
+		}
+		if fromUser.hasSettings() {
+			status := fromUser.Status
+			if status == nil {
+				status = &Status{}
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO users (username, visibility, status_text, status_emoji, status_set_at, status_clear_on_leave, api_token_hash) VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (username) DO UPDATE SET
+					visibility = excluded.visibility,
+					status_text = excluded.status_text,
+					status_emoji = excluded.status_emoji,
+					status_set_at = excluded.status_set_at,
+					status_clear_on_leave = excluded.status_clear_on_leave,
+					api_token_hash = excluded.api_token_hash
+			`, to, fromUser.Visibility, status.Text, status.Emoji, sqlTime(status.SetAt), status.ClearOnLeave, fromUser.APITokenHash); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE check_ins SET username = ? WHERE username = ?", to, from); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE subscriptions SET username = ? WHERE username = ?", to, from); err != nil {
+			return err
+		}
+		res, err := tx.Exec("UPDATE devices SET user_nickname = ? WHERE user_nickname = ?", to, from)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// sqliteUserColumns are the columns of the users table, in the order expected
+// by scanUser.
+const sqliteUserColumns = "username, session_generation, visibility, status_text, status_emoji, status_set_at, status_clear_on_leave, api_token_hash"
+
+// scanUser scans a row of sqliteUserColumns.
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	var user User
+	var status Status
+	var setAt sql.NullString
+	if err := row.Scan(&user.Username, &user.SessionGeneration, &user.Visibility, &status.Text, &status.Emoji, &setAt, &status.ClearOnLeave, &user.APITokenHash); err != nil {
+		return nil, err
+	}
+	if status.Text != "" || status.Emoji != "" {
+		var err error
+		if status.SetAt, err = parseSQLTime(setAt); err != nil {
+			return nil, fmt.Errorf("invalid status_set_at: %w", err)
+		}
+		user.Status = &status
+	}
+	return &user, nil
+}
+
+func (s *SQLiteDatabase) GetUser(username string) (*User, error) {
+	return s.getUser(s.db, username)
+}
+
+func (s *SQLiteDatabase) getUser(q querier, username string) (*User, error) {
+	user, err := scanUser(q.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE username = ?", username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return &User{Username: username}, nil
+	}
+	return user, err
+}
+
+func (s *SQLiteDatabase) SetUserStatus(username string, status *Status) error {
+	if status == nil {
+		status = &Status{}
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO users (username, status_text, status_emoji, status_set_at, status_clear_on_leave) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET
+			status_text = excluded.status_text,
+			status_emoji = excluded.status_emoji,
+			status_set_at = excluded.status_set_at,
+			status_clear_on_leave = excluded.status_clear_on_leave
+	`, username, status.Text, status.Emoji, sqlTime(status.SetAt), status.ClearOnLeave)
+	return err
+}
+
+func (s *SQLiteDatabase) RevokeSessions(username string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO users (username, session_generation) VALUES (?, 1)
+		ON CONFLICT (username) DO UPDATE SET session_generation = session_generation + 1
+	`, username)
+	return err
+}
+
+func (s *SQLiteDatabase) SetUserVisibility(username string, visibility Visibility) error {
+	_, err := s.db.Exec(`
+		INSERT INTO users (username, visibility) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET visibility = excluded.visibility
+	`, username, visibility)
+	return err
+}
+
+func (s *SQLiteDatabase) SetUserAPIToken(username, hash string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO users (username, api_token_hash) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET api_token_hash = excluded.api_token_hash
+	`, username, hash)
+	return err
+}
+
+func (s *SQLiteDatabase) GetUserByAPIToken(hash string) (*User, error) {
+	if hash == "" {
+		return nil, nil
+	}
+	user, err := scanUser(s.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE api_token_hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return user, err
+}
+
+func (s *SQLiteDatabase) GetUsers() ([]*User, error) {
+	rows, err := s.db.Query("SELECT " + sqliteUserColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, user)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLiteDatabase) GetEquipment() ([]*Equipment, error) {
+	rows, err := s.db.Query("SELECT mac_address, description, added_by, added_at FROM equipment ORDER BY mac_address")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Equipment
+	for rows.Next() {
+		var e Equipment
+		var addedAt sql.NullString
+		if err := rows.Scan(&e.MACAddress, &e.Description, &e.AddedBy, &addedAt); err != nil {
+			return nil, err
+		}
+		if e.AddedAt, err = parseSQLTime(addedAt); err != nil {
+			return nil, fmt.Errorf("invalid added_at: %w", err)
+		}
+		res = append(res, &e)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLiteDatabase) PutEquipment(e *Equipment) error {
+	mac, err := net.ParseMAC(e.MACAddress)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address: %w", err)
+	}
+	return s.update(func(tx *sql.Tx) error {
+		existing, err := s.getDeviceForMacAddress(tx, mac)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s is claimed by %s", ErrConflict, mac, existing.UserNickname)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO equipment (mac_address, description, added_by, added_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (mac_address) DO UPDATE SET
+				description = excluded.description,
+				added_by = excluded.added_by,
+				added_at = excluded.added_at
+		`, mac.String(), e.Description, e.AddedBy, sqlTime(e.AddedAt))
+		return err
+	})
+}
+
+func (s *SQLiteDatabase) RemoveEquipment(mac net.HardwareAddr) error {
+	_, err := s.db.Exec("DELETE FROM equipment WHERE mac_address = ?", mac.String())
+	return err
+}
+
+func (s *SQLiteDatabase) CheckIn(c *CheckIn) error {
+	_, err := s.db.Exec(`
+		INSERT INTO check_ins (username, checked_in_at, until) VALUES (?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET
+			checked_in_at = excluded.checked_in_at,
+			until = excluded.until
+	`, c.Username, sqlTime(c.CheckedInAt), sqlTime(c.Until))
+	return err
+}
+
+func (s *SQLiteDatabase) CheckOut(user string) error {
+	_, err := s.db.Exec("DELETE FROM check_ins WHERE username = ?", user)
+	return err
+}
+
+func (s *SQLiteDatabase) GetCheckIns(now time.Time) ([]*CheckIn, error) {
+	// Times are stored as text, so compare after parsing.
+	rows, err := s.db.Query("SELECT username, checked_in_at, until FROM check_ins ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*CheckIn
+	for rows.Next() {
+		var c CheckIn
+		var checkedInAt, until sql.NullString
+		if err := rows.Scan(&c.Username, &checkedInAt, &until); err != nil {
+			return nil, err
+		}
+		if c.CheckedInAt, err = parseSQLTime(checkedInAt); err != nil {
+			return nil, fmt.Errorf("invalid checked_in_at: %w", err)
+		}
+		if c.Until, err = parseSQLTime(until); err != nil {
+			return nil, fmt.Errorf("invalid until: %w", err)
+		}
+		if c.Until.After(now) {
+			res = append(res, &c)
+		}
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLiteDatabase) GetSubscriptions() ([]*Subscription, error) {
+	rows, err := s.db.Query("SELECT id, username, event, users, channel, target, quiet_start, quiet_end, min_interval, created_at FROM subscriptions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Subscription
+	for rows.Next() {
+		var sub Subscription
+		var users string
+		var createdAt sql.NullString
+		if err := rows.Scan(&sub.ID, &sub.Username, &sub.Event, &users, &sub.Channel, &sub.Target, &sub.QuietStart, &sub.QuietEnd, &sub.MinInterval, &createdAt); err != nil {
+			return nil, err
+		}
+		// Usernames are stored comma-separated.
+		if users != "" {
+			sub.Users = strings.Split(users, ",")
+		}
+		if sub.CreatedAt, err = parseSQLTime(createdAt); err != nil {
+			return nil, fmt.Errorf("invalid created_at: %w", err)
+		}
+		res = append(res, &sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortSubscriptions(res)
+	return res, nil
+}
+
+func (s *SQLiteDatabase) PutSubscription(sub *Subscription) error {
+	res, err := s.db.Exec(`
+		INSERT INTO subscriptions (id, username, event, users, channel, target, quiet_start, quiet_end, min_interval, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			event = excluded.event,
+			users = excluded.users,
+			channel = excluded.channel,
+			target = excluded.target,
+			quiet_start = excluded.quiet_start,
+			quiet_end = excluded.quiet_end,
+			min_interval = excluded.min_interval
+		WHERE username = excluded.username
+	`, sub.ID, sub.Username, sub.Event, strings.Join(sub.Users, ","), sub.Channel, sub.Target, sub.QuietStart, sub.QuietEnd, sub.MinInterval, sqlTime(sub.CreatedAt))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("subscription %s belongs to another user", sub.ID)
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) RemoveSubscription(user, id string) error {
+	res, err := s.db.Exec("DELETE FROM subscriptions WHERE id = ? AND username = ?", id, user)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no such subscription")
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) MarkDevicesSeen(leases []*Lease, at time.Time) error {
+	var changed []*Lease
+	for _, lease := range leases {
+		device, err := s.getDeviceForLease(s.db, lease)
+		if err != nil {
+			return err
+		}
+		if device != nil && device.needsSeen(at) {
+			changed = append(changed, lease)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return s.update(func(tx *sql.Tx) error {
+		seen := make(map[string]bool)
+		for _, lease := range changed {
+			device, err := s.getDeviceForLease(tx, lease)
+			if err != nil {
+				return err
+			}
+			if device == nil || seen[device.MACAddress] {
+				continue
+			}
+			seen[device.MACAddress] = true
+			if !device.needsSeen(at) {
+				continue
+			}
+			if _, err := tx.Exec("UPDATE devices SET last_seen_at = ?, stale = 0 WHERE mac_address = ?", sqlTime(at), device.MACAddress); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteDatabase) ExpireDevices(cutoff time.Time, unclaim, dryRun bool) ([]*Device, error) {
+	var res []*Device
+	fn := func(tx *sql.Tx) error {
+		devices, err := s.queryDevices(tx, "SELECT "+sqliteDeviceColumns+" FROM devices ORDER BY mac_address")
+		if err != nil {
+			return err
+		}
+		for _, device := range devices {
+			seen := device.SeenAt()
+			if seen.IsZero() || !seen.Before(cutoff) {
+				continue
+			}
+			if device.Stale && !unclaim {
+				// Already flagged.
+				continue
+			}
+			res = append(res, device)
+			if dryRun {
+				continue
+			}
+			if unclaim {
+				err = s.deleteDevice(tx, device)
+			} else {
+				_, err = tx.Exec("UPDATE devices SET stale = 1 WHERE mac_address = ?", device.MACAddress)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var err error
+	if dryRun {
+		err = s.view(fn)
+	} else {
+		err = s.update(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *SQLiteDatabase) Check() ([]string, error) {
+	var problems []string
+	rows, err := s.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var res string
+		if err := rows.Scan(&res); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if res != "ok" {
+			problems = append(problems, "integrity: "+res)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf("foreign key: row %d of %s references missing %s", rowid.Int64, table, parent))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query("SELECT a.mac_address FROM device_addresses a JOIN devices d ON a.mac_address = d.mac_address")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf("address %q is both a primary and an additional address", mac))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(`
+		SELECT e.mac_address FROM equipment e
+		WHERE e.mac_address IN (SELECT mac_address FROM devices UNION ALL SELECT mac_address FROM device_addresses)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf("equipment %s is also claimed", mac))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"k8s.io/klog/v2"
+)
+
+// Equipment is a device belonging to the space itself (printers, Raspberry
+// Pis, ...) rather than to any user. Equipment can't be claimed, isn't part
+// of people presence and is listed on the equipment status page instead.
+type Equipment struct {
+	MACAddress  string    `json:"mac_address"`
+	Description string    `json:"description"`
+	AddedBy     string    `json:"added_by,omitempty"`
+	AddedAt     time.Time `json:"added_at,omitempty"`
+}
+
+// Map from MAC address to serialized Equipment.
+var bucketEquipment = []byte("equipment")
+
+// migrateCreateEquipment creates the equipment bucket.
+func migrateCreateEquipment(tx *bbolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(bucketEquipment)
+	return err
+}
+
+// isEquipment returns true if a MAC address belongs to equipment.
+func isEquipment(tx *bbolt.Tx, mac string) bool {
+	b := tx.Bucket(bucketEquipment)
+	return b != nil && b.Get([]byte(mac)) != nil
+}
+
+func (b *BoltDatabase) GetEquipment() ([]*Equipment, error) {
+	var res []*Equipment
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketEquipment).ForEach(func(k, v []byte) error {
+			var e Equipment
+			if err := json.Unmarshal(v, &e); err != nil {
+				klog.Warningf("Equipment %q could not be unmarshaled: %v", k, err)
+				return nil
+			}
+			res = append(res, &e)
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (b *BoltDatabase) PutEquipment(e *Equipment) error {
+	mac, err := net.ParseMAC(e.MACAddress)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address: %w", err)
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		existing, err := b.getDeviceForMacAddress(tx, mac)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal existing device: %w", err)
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s is claimed by %s", ErrConflict, mac, existing.UserNickname)
+		}
+		stored := *e
+		stored.MACAddress = mac.String()
+		v, err := json.Marshal(&stored)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketEquipment).Put([]byte(stored.MACAddress), v)
+	})
+}
+
+func (b *BoltDatabase) RemoveEquipment(mac net.HardwareAddr) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketEquipment).Delete([]byte(mac.String()))
+	})
+}
+
+// checkEquipment finds equipment which is also claimed by a user.
+func checkEquipment(tx *bbolt.Tx) ([]string, error) {
+	var problems []string
+	aliases := tx.Bucket(bucketAliases)
+	err := tx.Bucket(bucketEquipment).ForEach(func(k, v []byte) error {
+		if owner := aliases.Get(aliasKey("mac", string(k))); owner != nil {
+			problems = append(problems, fmt.Sprintf("equipment %s is also claimed as part of device %s", k, owner))
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// equipmentStatus is Equipment along with its current lease, if any.
+type equipmentStatus struct {
+	*Equipment
+	Lease *Lease
+}
+
+// viewEquipment shows all equipment and whether it's currently online. Admins
+// can also add and remove equipment.
+func (s *Service) viewEquipment(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+
+	equipment, err := s.Database.GetEquipment()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get equipment: %v", err)
+		return
+	}
+	leases, err := s.cfg().Leases.Leases()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get leases: %v", err)
+		return
+	}
+	active := make(map[string]*Lease)
+	now := time.Now()
+	for _, lease := range leases {
+		if s.leaseActiveUntil(lease).After(now) {
+			active[lease.MACAddress.String()] = lease
+		}
+	}
+	statuses := make([]equipmentStatus, 0, len(equipment))
+	for _, e := range equipment {
+		statuses = append(statuses, equipmentStatus{
+			Equipment: e,
+			Lease:     active[e.MACAddress],
+		})
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return strings.ToLower(statuses[i].Description) < strings.ToLower(statuses[j].Description)
+	})
+
+	admin := s.isAdmin(session.Username)
+	var token string
+	if admin {
+		token = s.csrfToken(w, session)
+	}
+	templateEquipment.Execute(w, map[string]any{
+		"Username":  session.Username,
+		"Admin":     admin,
+		"CSRFToken": token,
+		"Equipment": statuses,
+		"SpaceName": s.cfg().SpaceName,
+		"SpaceURL":  s.cfg().SpaceURL,
+	})
+}
+
+// viewAdminEquipmentAdd marks a MAC address as equipment, or updates the
+// description of existing equipment.
+func (s *Service) viewAdminEquipmentAdd(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.isAdmin(session.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "You are not an admin.")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+
+	mac, err := net.ParseMAC(strings.TrimSpace(r.PostFormValue("mac")))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	description := strings.TrimSpace(r.PostFormValue("description"))
+	if description == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Description must be set.")
+		return
+	}
+	err = s.Database.PutEquipment(&Equipment{
+		MACAddress:  mac.String(),
+		Description: description,
+		AddedBy:     session.Username,
+		AddedAt:     time.Now(),
+	})
+	if err != nil {
+		fmt.Fprintf(w, "Could not add equipment: %v", err)
+		return
+	}
+	klog.Infof("%s marked %s as equipment (%s)", session.Username, mac, description)
+	http.Redirect(w, r, "/equipment", http.StatusFound)
+}
+
+// viewAdminEquipmentRemove removes a MAC address from equipment.
+func (s *Service) viewAdminEquipmentRemove(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.isAdmin(session.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "You are not an admin.")
+		return
+	}
+
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, fmt.Sprintf("Remove %s from equipment?", mac))
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	if err := s.Database.RemoveEquipment(mac); err != nil {
+		fmt.Fprintf(w, "Could not remove equipment: %v", err)
+		return
+	}
+	klog.Infof("%s removed %s from equipment", session.Username, mac)
+	http.Redirect(w, r, "/equipment", http.StatusFound)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEquipmentPage(t *testing.T) {
+	s := newTestService(t)
+	// The test service's lease is for 00:11:22:33:44:55.
+	for _, e := range []*Equipment{
+		{MACAddress: "00:11:22:33:44:55", Description: "Hallway Raspberry Pi"},
+		{MACAddress: "00:11:22:33:44:66", Description: "3D printer controller"},
+	} {
+		if err := s.Database.PutEquipment(e); err != nil {
+			t.Fatalf("could not add equipment: %v", err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/equipment", nil)
+	for _, c := range s.sessionCookies(&Session{Username: "q3k", ExpiresAt: time.Now().Add(time.Hour)}) {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	s.viewEquipment(w, r)
+	body := w.Body.String()
+	for _, want := range []string{
+		"<td>3D printer controller</td>\n            <td>00:11:22:33:44:66</td>\n            <td><span class=\"offline\">Offline",
+		"<td>Hallway Raspberry Pi</td>\n            <td>00:11:22:33:44:55</td>\n            <td><span class=\"online\">Online</span> (10.1.0.23, laptop)",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in page, got %s", want, body)
+		}
+	}
+	if strings.Contains(body, "/admin/equipment") {
+		t.Errorf("non-admin sees admin forms")
+	}
+
+	// Equipment isn't part of people presence, even if someone manages to
+	// have it matched by hostname.
+	if err := s.Database.ClaimDevice("q3k", net.HardwareAddr{0, 1, 2, 3, 4, 5}, "laptop", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := s.Database.SetDeviceMatching("q3k", net.HardwareAddr{0, 1, 2, 3, 4, 5}, false, true); err != nil {
+		t.Fatalf("could not set matching: %v", err)
+	}
+	p, err := s.getPresence()
+	if err != nil {
+		t.Fatalf("could not get presence: %v", err)
+	}
+	if len(p.Users) != 0 || p.Anonymous != 0 {
+		t.Errorf("equipment counted as presence: %+v", p)
+	}
+}
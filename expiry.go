@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// deviceExpiry describes when a device will be (or would have been) expired
+// according to the configured expiry policy.
+type deviceExpiry struct {
+	*Device
+	// ExpiresAt is the time at which the device will be expired, or zero if
+	// expiry is disabled or the device has never been seen.
+	ExpiresAt time.Time
+	// Warning is true if the device will be expired soon.
+	Warning bool
+}
+
+// expiryFor calculates the expiry of a device at a given time.
+func (rc *RuntimeConfig) expiryFor(d *Device, now time.Time) deviceExpiry {
+	res := deviceExpiry{
+		Device: d,
+	}
+	seen := d.SeenAt()
+	if rc.DeviceExpiry == 0 || seen.IsZero() {
+		return res
+	}
+	res.ExpiresAt = seen.Add(rc.DeviceExpiry)
+	res.Warning = d.Stale || now.After(res.ExpiresAt.Add(-rc.DeviceExpiryWarning))
+	return res
+}
+
+// runDeviceExpiry periodically updates the last seen time of all devices with
+// active leases and expires devices not seen for longer than the configured
+// expiry period. It runs until the given context is canceled.
+func (s *Service) runDeviceExpiry(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := s.expireDevices(time.Now()); err != nil {
+			klog.Errorf("Device expiry failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) expireDevices(now time.Time) error {
+	rc := s.cfg()
+	leases, err := rc.Leases.Leases()
+	if err != nil {
+		return fmt.Errorf("could not get leases: %w", err)
+	}
+	var active []*Lease
+	for _, lease := range leases {
+		if !s.leaseActiveUntil(lease).After(now) {
+			continue
+		}
+		active = append(active, lease)
+	}
+	if err := s.Database.MarkDevicesSeen(active, now); err != nil {
+		return fmt.Errorf("could not mark devices as seen: %w", err)
+	}
+
+	if rc.DeviceExpiry == 0 {
+		return nil
+	}
+	unclaim := rc.DeviceExpiryAction == "unclaim"
+	expired, err := s.Database.ExpireDevices(now.Add(-rc.DeviceExpiry), unclaim, false)
+	if err != nil {
+		return fmt.Errorf("could not expire devices: %w", err)
+	}
+	for _, d := range expired {
+		if unclaim {
+			klog.Infof("Unclaimed device %s (%s) of %s, last seen %s", d.MACAddress, d.Hostname, d.UserNickname, d.SeenAt())
+		} else {
+			klog.Infof("Flagged device %s (%s) of %s as stale, last seen %s", d.MACAddress, d.Hostname, d.UserNickname, d.SeenAt())
+		}
+	}
+	return nil
+}
+
+// viewAdminExpiry shows a dry-run report of the device expiry policy: which
+// devices would be expired right now, and which will be expired soon.
+func (s *Service) viewAdminExpiry(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.isAdmin(session.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "You are not an admin.")
+		return
+	}
+
+	rc := s.cfg()
+	now := time.Now()
+	var expired []deviceExpiry
+	if rc.DeviceExpiry != 0 {
+		devices, err := s.Database.ExpireDevices(now.Add(-rc.DeviceExpiry), true, true)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not calculate expiry: %v", err)
+			return
+		}
+		for _, d := range devices {
+			expired = append(expired, rc.expiryFor(d, now))
+		}
+	}
+	var warned []deviceExpiry
+	if rc.DeviceExpiry != 0 {
+		devices, err := s.Database.ExpireDevices(now.Add(-rc.DeviceExpiry+rc.DeviceExpiryWarning), true, true)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not calculate expiry: %v", err)
+			return
+		}
+		for _, d := range devices {
+			e := rc.expiryFor(d, now)
+			if !e.ExpiresAt.After(now) {
+				// Already in expired list.
+				continue
+			}
+			warned = append(warned, e)
+		}
+	}
+
+	templateAdminExpiry.Execute(w, map[string]any{
+		"Username":  session.Username,
+		"Enabled":   rc.DeviceExpiry != 0,
+		"Expiry":    rc.DeviceExpiry,
+		"Action":    rc.DeviceExpiryAction,
+		"Expired":   expired,
+		"Warned":    warned,
+		"SpaceName": rc.SpaceName,
+		"SpaceURL":  rc.SpaceURL,
+	})
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// exportFormat and exportVersion identify checkinator exports. The version is
+// bumped whenever the format changes incompatibly.
+const (
+	exportFormat  = "yacheck-export"
+	exportVersion = 1
+)
+
+// Export is a database-agnostic dump of all checkinator data, as written by
+// `yacheck export` and read by `yacheck import`. See README.md for the
+// documented format.
+type Export struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Devices    []*Device `json:"devices"`
+	// Users are per-user settings. Optional, as most users don't have any.
+	Users []*ExportUser `json:"users,omitempty"`
+	// Equipment of the space. Optional.
+	Equipment []*Equipment `json:"equipment,omitempty"`
+	// CheckIns are the active manual check-ins. Optional.
+	CheckIns []*CheckIn `json:"check_ins,omitempty"`
+	// Subscriptions are the notification subscriptions of users. Optional.
+	Subscriptions []*Subscription `json:"subscriptions,omitempty"`
+}
+
+// ExportUser are the exported settings of a user. Sessions are deliberately
+// not exported.
+type ExportUser struct {
+	Username   string     `json:"username"`
+	Visibility Visibility `json:"visibility,omitempty"`
+	Status     *Status    `json:"status,omitempty"`
+	// APITokenHash is the hash of the user's API token, so that exports
+	// have to be kept private.
+	APITokenHash string `json:"api_token_hash,omitempty"`
+}
+
+// ExportStore dumps all data from a Store into an Export.
+func ExportStore(db Store) (*Export, error) {
+	now := time.Now()
+	devices, err := db.GetDevices()
+	if err != nil {
+		return nil, fmt.Errorf("could not get devices: %w", err)
+	}
+	if devices == nil {
+		devices = []*Device{}
+	}
+	users, err := db.GetUsers()
+	if err != nil {
+		return nil, fmt.Errorf("could not get users: %w", err)
+	}
+	var exportUsers []*ExportUser
+	for _, u := range users {
+		if !u.hasSettings() {
+			continue
+		}
+		exportUsers = append(exportUsers, &ExportUser{
+			Username:     u.Username,
+			Visibility:   u.Visibility,
+			Status:       u.Status,
+			APITokenHash: u.APITokenHash,
+		})
+	}
+	equipment, err := db.GetEquipment()
+	if err != nil {
+		return nil, fmt.Errorf("could not get equipment: %w", err)
+	}
+	checkIns, err := db.GetCheckIns(now)
+	if err != nil {
+		return nil, fmt.Errorf("could not get check-ins: %w", err)
+	}
+	subs, err := db.GetSubscriptions()
+	if err != nil {
+		return nil, fmt.Errorf("could not get subscriptions: %w", err)
+	}
+	return &Export{
+		Format:        exportFormat,
+		Version:       exportVersion,
+		ExportedAt:    now,
+		Devices:       devices,
+		Users:         exportUsers,
+		Equipment:     equipment,
+		CheckIns:      checkIns,
+		Subscriptions: subs,
+	}, nil
+}
+
+// ReadExport parses and validates an export. All validation problems are
+// returned at once.
+func ReadExport(r io.Reader) (*Export, error) {
+	var e Export
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return nil, fmt.Errorf("could not parse export: %w", err)
+	}
+	if e.Format != exportFormat {
+		return nil, fmt.Errorf("not a checkinator export (format %q)", e.Format)
+	}
+	if e.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", e.Version)
+	}
+	if errs := e.validate(); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &e, nil
+}
+
+// validate checks all data in an export for missing data, invalid MAC
+// addresses, invalid settings and conflicts within the export itself.
+func (e *Export) validate() []error {
+	var errs []error
+	owners := make(map[string]string)
+	for i, d := range e.Devices {
+		if d == nil {
+			errs = append(errs, fmt.Errorf("device %d: empty", i))
+			continue
+		}
+		if d.UserNickname == "" {
+			errs = append(errs, fmt.Errorf("device %d (%s): missing user_nickname", i, d.MACAddress))
+		}
+		if _, err := ParseVisibility(string(d.Visibility)); err != nil {
+			errs = append(errs, fmt.Errorf("device %d (%s): %w", i, d.MACAddress, err))
+		}
+		if _, err := ParseDeviceType(string(d.Type)); err != nil {
+			errs = append(errs, fmt.Errorf("device %d (%s): %w", i, d.MACAddress, err))
+		}
+		for j, addr := range d.Addresses() {
+			mac, err := net.ParseMAC(addr)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("device %d: invalid MAC address %q", i, addr))
+				continue
+			}
+			// Normalize, as addresses are keys in the database.
+			if j == 0 {
+				d.MACAddress = mac.String()
+			} else {
+				d.AdditionalMACAddresses[j-1] = mac.String()
+			}
+			if owner, ok := owners[mac.String()]; ok {
+				errs = append(errs, fmt.Errorf("device %d: address %s already used by device %s", i, mac, owner))
+			}
+			owners[mac.String()] = d.MACAddress
+		}
+		sort.Strings(d.AdditionalMACAddresses)
+	}
+	for i, eq := range e.Equipment {
+		if eq == nil {
+			errs = append(errs, fmt.Errorf("equipment %d: empty", i))
+			continue
+		}
+		mac, err := net.ParseMAC(eq.MACAddress)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("equipment %d: invalid MAC address %q", i, eq.MACAddress))
+			continue
+		}
+		eq.MACAddress = mac.String()
+		if owner, ok := owners[mac.String()]; ok {
+			errs = append(errs, fmt.Errorf("equipment %d: address %s already used by device %s", i, mac, owner))
+		}
+		if eq.Description == "" {
+			errs = append(errs, fmt.Errorf("equipment %d (%s): missing description", i, mac))
+		}
+	}
+	usernames := make(map[string]bool)
+	tokens := make(map[string]string)
+	for i, u := range e.Users {
+		if u == nil || u.Username == "" {
+			errs = append(errs, fmt.Errorf("user %d: missing username", i))
+			continue
+		}
+		if usernames[u.Username] {
+			errs = append(errs, fmt.Errorf("user %d: duplicate user %s", i, u.Username))
+		}
+		usernames[u.Username] = true
+		if _, err := ParseVisibility(string(u.Visibility)); err != nil {
+			errs = append(errs, fmt.Errorf("user %d (%s): %w", i, u.Username, err))
+		}
+		if u.Status != nil {
+			if st, err := NewStatus(u.Status.Text, u.Status.Emoji, u.Status.ClearOnLeave, u.Status.SetAt); err != nil || st == nil {
+				errs = append(errs, fmt.Errorf("user %d (%s): invalid status %q", i, u.Username, u.Status.Emoji+" "+u.Status.Text))
+			}
+		}
+		if u.APITokenHash != "" {
+			if h, err := hex.DecodeString(u.APITokenHash); err != nil || len(h) != 32 {
+				errs = append(errs, fmt.Errorf("user %d (%s): invalid api_token_hash", i, u.Username))
+			} else if owner, ok := tokens[u.APITokenHash]; ok {
+				errs = append(errs, fmt.Errorf("user %d (%s): api_token_hash already used by user %s", i, u.Username, owner))
+			}
+			tokens[u.APITokenHash] = u.Username
+		}
+	}
+	checkedIn := make(map[string]bool)
+	for i, c := range e.CheckIns {
+		if c == nil || c.Username == "" {
+			errs = append(errs, fmt.Errorf("check-in %d: missing username", i))
+			continue
+		}
+		if checkedIn[c.Username] {
+			errs = append(errs, fmt.Errorf("check-in %d: duplicate check-in of %s", i, c.Username))
+		}
+		checkedIn[c.Username] = true
+		if c.Until.IsZero() {
+			errs = append(errs, fmt.Errorf("check-in %d (%s): missing until", i, c.Username))
+		}
+	}
+	subIDs := make(map[string]bool)
+	for i, sub := range e.Subscriptions {
+		if sub == nil || sub.ID == "" {
+			errs = append(errs, fmt.Errorf("subscription %d: missing id", i))
+			continue
+		}
+		if subIDs[sub.ID] {
+			errs = append(errs, fmt.Errorf("subscription %d: duplicate id %s", i, sub.ID))
+		}
+		subIDs[sub.ID] = true
+		if sub.Username == "" {
+			errs = append(errs, fmt.Errorf("subscription %d (%s): missing username", i, sub.ID))
+		}
+		switch sub.Event {
+		case EventArrival, EventOpen, EventClose:
+		default:
+			errs = append(errs, fmt.Errorf("subscription %d (%s): invalid event %q", i, sub.ID, sub.Event))
+		}
+		if !slices.ContainsFunc(notifierChannels, func(c notifierChannel) bool { return c.Name == sub.Channel }) {
+			errs = append(errs, fmt.Errorf("subscription %d (%s): invalid channel %q", i, sub.ID, sub.Channel))
+		}
+		if sub.Target == "" {
+			errs = append(errs, fmt.Errorf("subscription %d (%s): missing target", i, sub.ID))
+		}
+		if sub.QuietStart < 0 || sub.QuietStart >= 24*60 || sub.QuietEnd < 0 || sub.QuietEnd >= 24*60 || sub.MinInterval < 0 {
+			errs = append(errs, fmt.Errorf("subscription %d (%s): invalid quiet hours or interval", i, sub.ID))
+		}
+	}
+	return errs
+}
+
+// ImportResult summarizes an import.
+type ImportResult struct {
+	// Imported are devices that were imported.
+	Imported []*Device
+	// Unchanged are devices that were already present in the database.
+	Unchanged []*Device
+	// OtherImported and OtherUnchanged count the other records (user
+	// settings, equipment, check-ins and subscriptions) which were imported
+	// or already present.
+	OtherImported  int
+	OtherUnchanged int
+	// Conflicts are errors for records which conflict with existing data and
+	// were not imported.
+	Conflicts []error
+}
+
+// ImportStore imports all data from an export into a Store. Records already
+// present are left as they are. Records which conflict with existing data
+// (eg. a user whose existing settings differ) are not imported, but reported
+// in the result. Any other error aborts the import.
+func ImportStore(db Store, e *Export) (*ImportResult, error) {
+	var res ImportResult
+	conflict := func(format string, args ...any) {
+		res.Conflicts = append(res.Conflicts, fmt.Errorf(format, args...))
+	}
+	for _, u := range e.Users {
+		existing, err := db.GetUser(u.Username)
+		if err != nil {
+			return nil, fmt.Errorf("could not get user %s: %w", u.Username, err)
+		}
+		changed := false
+		switch {
+		case u.Visibility == VisibilityDefault || u.Visibility == existing.Visibility:
+		case existing.Visibility == VisibilityDefault:
+			changed = true
+		default:
+			conflict("user %s: %w: visibility is already %s", u.Username, ErrConflict, existing.Visibility)
+			continue
+		}
+		switch {
+		case u.Status == nil || sameStatus(u.Status, existing.Status):
+		case existing.Status == nil:
+			changed = true
+		default:
+			conflict("user %s: %w: status is already set", u.Username, ErrConflict)
+			continue
+		}
+		switch {
+		case u.APITokenHash == "" || u.APITokenHash == existing.APITokenHash:
+		case existing.APITokenHash == "":
+			owner, err := db.GetUserByAPIToken(u.APITokenHash)
+			if err != nil {
+				return nil, fmt.Errorf("could not get user by API token: %w", err)
+			}
+			if owner != nil {
+				conflict("user %s: %w: API token is already used by %s", u.Username, ErrConflict, owner.Username)
+				continue
+			}
+			changed = true
+		default:
+			conflict("user %s: %w: API token is already set", u.Username, ErrConflict)
+			continue
+		}
+		if !changed {
+			res.OtherUnchanged++
+			continue
+		}
+		if u.Visibility != VisibilityDefault && existing.Visibility == VisibilityDefault {
+			if err := db.SetUserVisibility(u.Username, u.Visibility); err != nil {
+				return nil, fmt.Errorf("could not import user %s: %w", u.Username, err)
+			}
+		}
+		if existing.Status == nil && u.Status != nil {
+			if err := db.SetUserStatus(u.Username, u.Status); err != nil {
+				return nil, fmt.Errorf("could not import user %s: %w", u.Username, err)
+			}
+		}
+		if u.APITokenHash != "" && existing.APITokenHash == "" {
+			if err := db.SetUserAPIToken(u.Username, u.APITokenHash); err != nil {
+				return nil, fmt.Errorf("could not import user %s: %w", u.Username, err)
+			}
+		}
+		res.OtherImported++
+	}
+
+	// Equipment first, so that devices conflicting with it are reported.
+	equipment, err := db.GetEquipment()
+	if err != nil {
+		return nil, fmt.Errorf("could not get equipment: %w", err)
+	}
+	for _, eq := range e.Equipment {
+		if i := slices.IndexFunc(equipment, func(x *Equipment) bool { return x.MACAddress == eq.MACAddress }); i >= 0 {
+			if equipment[i].Description != eq.Description {
+				conflict("equipment %s: %w: already present as %q", eq.MACAddress, ErrConflict, equipment[i].Description)
+			} else {
+				res.OtherUnchanged++
+			}
+			continue
+		}
+		err := db.PutEquipment(eq)
+		switch {
+		case errors.Is(err, ErrConflict):
+			conflict("equipment %s: %w", eq.MACAddress, err)
+		case err != nil:
+			return nil, fmt.Errorf("could not import equipment %s: %w", eq.MACAddress, err)
+		default:
+			res.OtherImported++
+		}
+	}
+	for _, d := range e.Devices {
+		existing, err := db.GetDevicesForMacAddresses([]net.HardwareAddr{mustParseMAC(d.MACAddress)})
+		if err != nil {
+			return nil, fmt.Errorf("could not get existing device: %w", err)
+		}
+		err = db.ImportDevice(d)
+		switch {
+		case errors.Is(err, ErrConflict):
+			conflict("device %s of %s: %w", d.MACAddress, d.UserNickname, err)
+		case err != nil:
+			return nil, fmt.Errorf("could not import device %s: %w", d.MACAddress, err)
+		case len(existing) > 0:
+			res.Unchanged = append(res.Unchanged, d)
+		default:
+			res.Imported = append(res.Imported, d)
+		}
+	}
+
+	// Expired check-ins are skipped, as they don't matter anymore.
+	now := time.Now()
+	checkIns, err := db.GetCheckIns(now)
+	if err != nil {
+		return nil, fmt.Errorf("could not get check-ins: %w", err)
+	}
+	for _, c := range e.CheckIns {
+		if !c.Until.After(now) {
+			continue
+		}
+		if i := slices.IndexFunc(checkIns, func(x *CheckIn) bool { return x.Username == c.Username }); i >= 0 {
+			if !checkIns[i].CheckedInAt.Equal(c.CheckedInAt) || !checkIns[i].Until.Equal(c.Until) {
+				conflict("check-in of %s: %w: already checked in", c.Username, ErrConflict)
+			} else {
+				res.OtherUnchanged++
+			}
+			continue
+		}
+		if err := db.CheckIn(c); err != nil {
+			return nil, fmt.Errorf("could not import check-in of %s: %w", c.Username, err)
+		}
+		res.OtherImported++
+	}
+
+	subs, err := db.GetSubscriptions()
+	if err != nil {
+		return nil, fmt.Errorf("could not get subscriptions: %w", err)
+	}
+	for _, sub := range e.Subscriptions {
+		if i := slices.IndexFunc(subs, func(x *Subscription) bool { return x.ID == sub.ID }); i >= 0 {
+			if !sameSubscription(subs[i], sub) {
+				conflict("subscription %s of %s: %w: ID already used", sub.ID, sub.Username, ErrConflict)
+			} else {
+				res.OtherUnchanged++
+			}
+			continue
+		}
+		if err := db.PutSubscription(sub); err != nil {
+			return nil, fmt.Errorf("could not import subscription %s: %w", sub.ID, err)
+		}
+		res.OtherImported++
+	}
+	return &res, nil
+}
+
+// sameStatus returns true if two statuses (which may be nil) are the same,
+// regardless of time zones.
+func sameStatus(a, b *Status) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Text == b.Text && a.Emoji == b.Emoji && a.ClearOnLeave == b.ClearOnLeave && a.SetAt.Equal(b.SetAt)
+}
+
+// sameSubscription returns true if two subscriptions are the same, regardless
+// of time zones.
+func sameSubscription(a, b *Subscription) bool {
+	x, y := *a, *b
+	x.CreatedAt, y.CreatedAt = time.Time{}, time.Time{}
+	x.Users, y.Users = nil, nil
+	return a.CreatedAt.Equal(b.CreatedAt) && slices.Equal(a.Users, b.Users) && reflect.DeepEqual(x, y)
+}
+
+// mustParseMAC parses a MAC address which has already been validated.
+func mustParseMAC(s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return mac
+}
+
+// viewAdminBackup streams a consistent snapshot of the database file.
+func (s *Service) viewAdminBackup(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.isAdmin(session.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "You are not an admin.")
+		return
+	}
+	backuper, ok := s.Database.(Backuper)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Database does not support backups.")
+		return
+	}
+
+	// Large databases can take longer than the server's write timeout.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		klog.Warningf("Could not extend write deadline for backup: %v", err)
+	}
+
+	filename := fmt.Sprintf("checkinator-%s.%s", time.Now().Format("20060102-150405"), flagDatabaseType)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	n, err := backuper.Backup(w)
+	if err != nil {
+		// Headers are already sent, best we can do is log and cut the
+		// response short.
+		klog.Errorf("Backup failed after %d bytes: %v", n, err)
+		return
+	}
+	klog.Infof("%s downloaded backup (%d bytes)", session.Username, n)
+}
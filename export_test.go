@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, from := range storeTypes {
+		for _, to := range storeTypes {
+			t.Run(from+"/"+to, func(t *testing.T) {
+				src, err := OpenStore(from, t.TempDir()+"/src")
+				if err != nil {
+					t.Fatalf("could not create source DB: %v", err)
+				}
+				defer src.Close()
+				if err := src.ClaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, "stinkpad", ""); err != nil {
+					t.Fatalf("could not claim device: %v", err)
+				}
+				if err := src.AddDeviceAddress("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{2, 1, 2, 3, 4, 5}); err != nil {
+					t.Fatalf("could not add address: %v", err)
+				}
+				if err := src.ClaimDevice("joe", net.HardwareAddr{0, 1, 2, 3, 4, 6}, "crapbook", "01:00:01:02:03:04:06"); err != nil {
+					t.Fatalf("could not claim device: %v", err)
+				}
+				if err := src.SetDeviceMatching("joe", net.HardwareAddr{0, 1, 2, 3, 4, 6}, true, false); err != nil {
+					t.Fatalf("could not set matching: %v", err)
+				}
+				if err := src.SetDeviceVisibility("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, VisibilityHidden); err != nil {
+					t.Fatalf("could not set visibility: %v", err)
+				}
+				if err := src.SetUserVisibility("jane", VisibilityCountOnly); err != nil {
+					t.Fatalf("could not set visibility: %v", err)
+				}
+				now := time.Now().Truncate(time.Second)
+				status := &Status{Text: "hacking", Emoji: "🔧", SetAt: now}
+				if err := src.SetUserStatus("jane", status); err != nil {
+					t.Fatalf("could not set status: %v", err)
+				}
+				if err := src.SetUserAPIToken("jane", hashAPIToken("token")); err != nil {
+					t.Fatalf("could not set API token: %v", err)
+				}
+				if err := src.SetUserVisibility("jim", VisibilityHidden); err != nil {
+					t.Fatalf("could not set visibility: %v", err)
+				}
+				if err := src.CheckIn(&CheckIn{Username: "jim", CheckedInAt: now, Until: now.Add(time.Hour)}); err != nil {
+					t.Fatalf("could not check in: %v", err)
+				}
+				sub := &Subscription{ID: "s1", Username: "jane", Event: EventArrival, Users: []string{"joe"}, Channel: "ntfy", Target: "jane", CreatedAt: now}
+				if err := src.PutSubscription(sub); err != nil {
+					t.Fatalf("could not subscribe: %v", err)
+				}
+				for _, eq := range []*Equipment{
+					{MACAddress: "00:01:02:03:04:07", Description: "Printer"},
+					{MACAddress: "00:01:02:03:04:08", Description: "Hallway Pi"},
+				} {
+					if err := src.PutEquipment(eq); err != nil {
+						t.Fatalf("could not add equipment: %v", err)
+					}
+				}
+
+				e, err := ExportStore(src)
+				if err != nil {
+					t.Fatalf("could not export: %v", err)
+				}
+				var buf bytes.Buffer
+				if err := json.NewEncoder(&buf).Encode(e); err != nil {
+					t.Fatalf("could not encode export: %v", err)
+				}
+
+				dst, err := OpenStore(to, t.TempDir()+"/dst")
+				if err != nil {
+					t.Fatalf("could not create destination DB: %v", err)
+				}
+				defer dst.Close()
+				// Conflicting claim by someone else, user settings and
+				// equipment.
+				if err := dst.ClaimDevice("mallory", net.HardwareAddr{0, 1, 2, 3, 4, 6}, "evil", ""); err != nil {
+					t.Fatalf("could not claim device: %v", err)
+				}
+				if err := dst.SetUserVisibility("jim", VisibilityVisible); err != nil {
+					t.Fatalf("could not set visibility: %v", err)
+				}
+				if err := dst.PutEquipment(&Equipment{MACAddress: "00:01:02:03:04:08", Description: "Router"}); err != nil {
+					t.Fatalf("could not add equipment: %v", err)
+				}
+
+				for i, want := range []struct{ imported, unchanged, otherImported, otherUnchanged, conflicts int }{
+					// jane's settings, the printer, jim's check-in and
+					// jane's subscription are imported.
+					{1, 0, 4, 0, 3},
+					{0, 1, 0, 4, 3},
+				} {
+					e, err := ReadExport(bytes.NewReader(buf.Bytes()))
+					if err != nil {
+						t.Fatalf("could not read export: %v", err)
+					}
+					res, err := ImportStore(dst, e)
+					if err != nil {
+						t.Fatalf("could not import: %v", err)
+					}
+					if len(res.Imported) != want.imported || len(res.Unchanged) != want.unchanged || res.OtherImported != want.otherImported || res.OtherUnchanged != want.otherUnchanged || len(res.Conflicts) != want.conflicts {
+						t.Errorf("import %d: got %d/%d imported, %d/%d unchanged, %d conflicts (%v)", i, len(res.Imported), res.OtherImported, len(res.Unchanged), res.OtherUnchanged, len(res.Conflicts), res.Conflicts)
+					}
+				}
+
+				want, err := src.GetDevicesForUser("jane")
+				if err != nil {
+					t.Fatalf("could not get devices: %v", err)
+				}
+				got, err := dst.GetDevicesForUser("jane")
+				if err != nil {
+					t.Fatalf("could not get devices: %v", err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Error(diff)
+				}
+				user, err := dst.GetUser("jane")
+				if err != nil {
+					t.Fatalf("could not get user: %v", err)
+				}
+				if user.Visibility != VisibilityCountOnly || !sameStatus(user.Status, status) || user.APITokenHash != hashAPIToken("token") {
+					t.Errorf("user settings not imported, got %+v", user)
+				}
+				if user, err := dst.GetUser("jim"); err != nil || user.Visibility != VisibilityVisible {
+					t.Errorf("conflicting user settings should not have been imported, got %+v, %v", user, err)
+				}
+				checkIns, err := dst.GetCheckIns(now)
+				if err != nil {
+					t.Fatalf("could not get check-ins: %v", err)
+				}
+				if len(checkIns) != 1 || checkIns[0].Username != "jim" || !checkIns[0].Until.Equal(now.Add(time.Hour)) {
+					t.Errorf("check-in not imported, got %+v", checkIns)
+				}
+				subs, err := dst.GetSubscriptions()
+				if err != nil {
+					t.Fatalf("could not get subscriptions: %v", err)
+				}
+				if len(subs) != 1 || !sameSubscription(subs[0], sub) {
+					t.Errorf("subscription not imported, got %+v", subs)
+				}
+				equipment, err := dst.GetEquipment()
+				if err != nil {
+					t.Fatalf("could not get equipment: %v", err)
+				}
+				var descriptions []string
+				for _, eq := range equipment {
+					descriptions = append(descriptions, eq.Description)
+				}
+				if diff := cmp.Diff([]string{"Printer", "Router"}, descriptions); diff != "" {
+					t.Errorf("equipment: %s", diff)
+				}
+				got, err = dst.GetDevicesForUser("joe")
+				if err != nil {
+					t.Fatalf("could not get devices: %v", err)
+				}
+				if len(got) != 0 {
+					t.Errorf("conflicting device should not have been imported, got %+v", got)
+				}
+			})
+		}
+	}
+}
+
+func TestReadExportInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		export string
+		err    string
+	}{
+		{"wrong format", `{"format": "something", "version": 1}`, "not a checkinator export"},
+		{"wrong version", `{"format": "yacheck-export", "version": 1000}`, "unsupported export version"},
+		{"bad mac", `{"format": "yacheck-export", "version": 1, "devices": [{"mac_address": "foo", "user_nickname": "jane"}]}`, `invalid MAC address "foo"`},
+		{"no user", `{"format": "yacheck-export", "version": 1, "devices": [{"mac_address": "00:01:02:03:04:05"}]}`, "missing user_nickname"},
+		{"duplicate", `{"format": "yacheck-export", "version": 1, "devices": [
+			{"mac_address": "00:01:02:03:04:05", "user_nickname": "jane"},
+			{"mac_address": "00:01:02:03:04:06", "additional_mac_addresses": ["00-01-02-03-04-05"], "user_nickname": "joe"}
+		]}`, "address 00:01:02:03:04:05 already used"},
+		{"bad status", `{"format": "yacheck-export", "version": 1, "users": [{"username": "jane", "status": {"text": "a\nb"}}]}`, "invalid status"},
+		{"bad token", `{"format": "yacheck-export", "version": 1, "users": [{"username": "jane", "api_token_hash": "1234"}]}`, "invalid api_token_hash"},
+		{"bad check-in", `{"format": "yacheck-export", "version": 1, "check_ins": [{"username": "jane"}]}`, "missing until"},
+		{"bad subscription", `{"format": "yacheck-export", "version": 1, "subscriptions": [{"id": "s1", "username": "jane", "event": "party", "channel": "ntfy", "target": "jane"}]}`, `invalid event "party"`},
+		{"duplicate subscription", `{"format": "yacheck-export", "version": 1, "subscriptions": [
+			{"id": "s1", "username": "jane", "event": "open", "channel": "ntfy", "target": "jane"},
+			{"id": "s1", "username": "joe", "event": "open", "channel": "ntfy", "target": "joe"}
+		]}`, "duplicate id s1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadExport(strings.NewReader(test.export))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	for _, kind := range storeTypes {
+		t.Run(kind, func(t *testing.T) {
+			db, err := OpenStore(kind, t.TempDir()+"/db")
+			if err != nil {
+				t.Fatalf("could not create DB: %v", err)
+			}
+			defer db.Close()
+			if err := db.ClaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, "stinkpad", ""); err != nil {
+				t.Fatalf("could not claim device: %v", err)
+			}
+
+			var buf bytes.Buffer
+			if _, err := db.(Backuper).Backup(&buf); err != nil {
+				t.Fatalf("could not back up: %v", err)
+			}
+			path := t.TempDir() + "/backup"
+			if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+				t.Fatalf("could not write backup: %v", err)
+			}
+			restored, err := OpenStore(kind, path)
+			if err != nil {
+				t.Fatalf("could not open backup: %v", err)
+			}
+			defer restored.Close()
+			devices, err := restored.GetDevicesForUser("jane")
+			if err != nil {
+				t.Fatalf("could not get devices: %v", err)
+			}
+			if len(devices) != 1 {
+				t.Errorf("expected one device in backup, got %+v", devices)
+			}
+		})
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"html/template"
 	"net"
 	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
 )
 
 //go:embed templates/index.html
@@ -15,21 +18,81 @@ var templateIndexString string
 //go:embed templates/manage.html
 var templateManageString string
 
+//go:embed templates/admin_expiry.html
+var templateAdminExpiryString string
+
+//go:embed templates/confirm.html
+var templateConfirmString string
+
+//go:embed templates/admin_users.html
+var templateAdminUsersString string
+
+//go:embed templates/equipment.html
+var templateEquipmentString string
+
+//go:embed templates/api_token.html
+var templateAPITokenString string
+
+//go:embed templates/unclaimed.html
+var templateUnclaimedString string
+
+//go:embed templates/notifications.html
+var templateNotificationsString string
+
 var (
-	templateIndex  = template.Must(template.New("index").Parse(templateIndexString))
-	templateManage = template.Must(template.New("manage").Parse(templateManageString))
+	templateFuncs = template.FuncMap{
+		"date": func(t time.Time) string {
+			if t.IsZero() {
+				return "never"
+			}
+			return t.Format("2006-01-02")
+		},
+		"randomized": func(mac string) bool {
+			hwaddr, err := net.ParseMAC(mac)
+			if err != nil {
+				return false
+			}
+			return isLocallyAdministered(hwaddr)
+		},
+		"vendor": func(mac string) string {
+			hwaddr, err := net.ParseMAC(mac)
+			if err != nil {
+				return ""
+			}
+			return macVendor(hwaddr)
+		},
+		"interval": formatInterval,
+	}
+	templateIndex  = template.Must(template.New("index").Funcs(templateFuncs).Parse(templateIndexString))
+	templateManage = template.Must(template.New("manage").Funcs(templateFuncs).Parse(templateManageString))
+
+	templateAdminExpiry = template.Must(template.New("admin_expiry").Funcs(templateFuncs).Parse(templateAdminExpiryString))
+	templateConfirm     = template.Must(template.New("confirm").Funcs(templateFuncs).Parse(templateConfirmString))
+	templateAdminUsers  = template.Must(template.New("admin_users").Funcs(templateFuncs).Parse(templateAdminUsersString))
+	templateEquipment   = template.Must(template.New("equipment").Funcs(templateFuncs).Parse(templateEquipmentString))
+	templateAPIToken    = template.Must(template.New("api_token").Funcs(templateFuncs).Parse(templateAPITokenString))
+	templateUnclaimed   = template.Must(template.New("unclaimed").Funcs(templateFuncs).Parse(templateUnclaimedString))
+
+	templateNotifications = template.Must(template.New("notifications").Funcs(templateFuncs).Parse(templateNotificationsString))
 )
 
 type JSONTop struct {
 	Users []JSONUser `json:"users"`
+	// Anonymous is the number of present users who don't want to be named.
+	Anonymous int `json:"anonymous"`
 }
 
 type JSONUser struct {
 	Login string `json:"login"`
+	// Manual is set if the user checked in manually.
+	Manual bool `json:"manual,omitempty"`
+	// Status and Emoji are what the user is up to, if they set it.
+	Status string `json:"status,omitempty"`
+	Emoji  string `json:"emoji,omitempty"`
 }
 
 func (s *Service) authorized(username, password string) bool {
-	for _, au := range s.Authorized {
+	for _, au := range s.cfg().APIUsers {
 		// I'll give you 50€ if you can exploit this non-constant-time
 		// comparison in practice. ~q3k
 		if au.Username == username && au.Password == password {
@@ -39,24 +102,26 @@ func (s *Service) authorized(username, password string) bool {
 	return false
 }
 
+// isAdmin returns true if the given user is an admin.
+func (s *Service) isAdmin(username string) bool {
+	for _, admin := range s.cfg().Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Service) viewAPIJSON(w http.ResponseWriter, r *http.Request) {
 	username, password, ok := r.BasicAuth()
 	if ok && s.authorized(username, password) {
-		users, err := s.getActiveUsers()
+		presence, err := s.getPresence()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "%v", err)
 			return
 		}
-		res := JSONTop{
-			Users: make([]JSONUser, 0, len(users)),
-		}
-		for _, user := range users {
-			res.Users = append(res.Users, JSONUser{
-				Login: user,
-			})
-		}
-		json.NewEncoder(w).Encode(&res)
+		json.NewEncoder(w).Encode(presence.JSON())
 		return
 	} else {
 		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -71,18 +136,47 @@ func (s *Service) viewIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := s.getActiveUsers()
+	presence, err := s.getPresence()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	checkIn, err := s.currentCheckIn(session.Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
+	user, err := s.Database.GetUser(session.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	unclaimed := 0
+	if s.cfg().ShowUnclaimed {
+		leases, err := s.unclaimedLeases()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		unclaimed = len(leases)
+	}
 
+	token := s.csrfToken(w, session)
 	templateIndex.Execute(w, map[string]any{
 		"Username":  session.Username,
-		"Users":     users,
-		"SpaceName": flagSpaceName,
-		"SpaceURL":  flagSpaceURL,
+		"CSRFToken": token,
+		"CheckIn":   checkIn,
+		"Status":    user.Status,
+		"Users":     presence.Users,
+		"Anonymous": presence.Anonymous,
+		"Unclaimed": unclaimed,
+		"SpaceName": s.cfg().SpaceName,
+		"SpaceURL":  s.cfg().SpaceURL,
 	})
 }
 
@@ -100,14 +194,69 @@ func (s *Service) viewManage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Current lease is optional, it's only used to offer adding the current
+	// address to an existing device.
+	current, _, _ := s.currentLease(r)
+	if current != nil {
+		for _, d := range devices {
+			for _, addr := range d.Addresses() {
+				if addr == current.MACAddress.String() {
+					current = nil
+					break
+				}
+			}
+			if current == nil {
+				break
+			}
+		}
+	}
+
+	user, err := s.Database.GetUser(session.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get your settings: %v", err)
+		return
+	}
+
+	// Leases are optional too, they're only used to show which devices are
+	// online.
+	rc := s.cfg()
+	leases, err := rc.Leases.Leases()
+	if err != nil {
+		klog.Warningf("Could not get leases: %v", err)
+	}
+	now := s.timeNow()
+	managed := make([]managedDevice, 0, len(devices))
+	for _, d := range devices {
+		managed = append(managed, managedDevice{
+			deviceExpiry: rc.expiryFor(d, now),
+			Lease:        s.activeLease(d, leases, now),
+		})
+	}
+
+	token := s.csrfToken(w, session)
 	templateManage.Execute(w, map[string]any{
-		"Username":  session.Username,
-		"Devices":   devices,
-		"SpaceName": flagSpaceName,
-		"SpaceURL":  flagSpaceURL,
+		"Username":   session.Username,
+		"CSRFToken":  token,
+		"Visibility": user.Visibility,
+		"Status":     user.Status,
+		"APIToken":   user.APITokenHash != "",
+		"Admin":      s.isAdmin(session.Username),
+		"Devices":    managed,
+		"Types":      deviceTypes,
+		"Current":    current,
+		"SpaceName":  s.cfg().SpaceName,
+		"SpaceURL":   s.cfg().SpaceURL,
 	})
 }
 
+// managedDevice is a device as shown on the management page.
+type managedDevice struct {
+	deviceExpiry
+	// Lease is the device's active lease, or nil if it's offline.
+	Lease *Lease
+}
+
 func (s *Service) viewUnclaim(w http.ResponseWriter, r *http.Request) {
 	session := s.Sessions.Get(r)
 	if session == nil || session.Username == "" {
@@ -122,22 +271,42 @@ func (s *Service) viewUnclaim(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Invalid MAC address.")
 		return
 	}
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, fmt.Sprintf("Unclaim device %s?", hwaddr))
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
 	if err := s.Database.UnclaimDevice(session.Username, hwaddr); err != nil {
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
 	http.Redirect(w, r, "/manage", http.StatusFound)
-
 }
 
-// remoteHost returns the host/address part of the remote host connecting to
-// this HTTP server.
-func (s *Service) remoteHost(r *http.Request) string {
-	host := r.Header.Get("X-Forwarded-For")
-	if host == "" {
-		host, _, _ = net.SplitHostPort(r.RemoteAddr)
+// currentLease returns the lease of the remote host connecting to this HTTP
+// server. If the host cannot be found in the leases, nil is returned along
+// with the detected host. Errors are user-presentable.
+func (s *Service) currentLease(r *http.Request) (*Lease, string, error) {
+	addr, err := s.cfg().TrustedProxies.ClientAddr(r)
+	if err != nil {
+		klog.Warningf("Could not determine client address: %v", err)
+		return nil, "", fmt.Errorf("Can't get your IP address / host.")
+	}
+	host := addr.String()
+
+	leases, err := s.cfg().Leases.Leases()
+	if err != nil {
+		return nil, host, fmt.Errorf("Can't get leases: %w", err)
 	}
-	return host
+	hostIP := netIP(addr)
+	for _, lease := range leases {
+		if lease.IPAddress.Equal(hostIP) {
+			return lease, host, nil
+		}
+	}
+	return nil, host, nil
 }
 
 func (s *Service) viewClaim(w http.ResponseWriter, r *http.Request) {
@@ -147,34 +316,131 @@ func (s *Service) viewClaim(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	host := s.remoteHost(r)
-	if host == "" {
-		fmt.Fprintf(w, "Can't get your IP address / host.")
+	// Find remote host in leases.
+	lease, host, err := s.currentLease(r)
+	if err != nil {
+		fmt.Fprintf(w, "%v", err)
 		return
 	}
-	hostIP := net.ParseIP(host)
-	if hostIP == nil {
-		fmt.Fprintf(w, "Could not parse your IP.")
+	if lease == nil {
+		fmt.Fprintf(w, "You must be present at the lab and be using local DNS to claim this device (detected host: %s).", host)
 		return
 	}
+	if r.Method != http.MethodPost {
+		msg := fmt.Sprintf("Claim device %s as yours?", lease.MACAddress)
+		if lease.Hostname != "" {
+			msg = fmt.Sprintf("Claim device %s (%s) as yours?", lease.MACAddress, lease.Hostname)
+		}
+		s.confirm(w, r, session, msg)
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	// If found, claim.
+	if err := s.Database.ClaimDevice(session.Username, lease.MACAddress, lease.Hostname, lease.ClientID); err != nil {
+		fmt.Fprintf(w, "Could not claim device: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
 
-	// Find remote host in leases.
-	leases, err := s.Leases.Leases()
+// viewDeviceAddAddress adds the MAC address of the device the user is
+// currently connecting from to one of their existing devices.
+func (s *Service) viewDeviceAddAddress(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+
+	device, err := net.ParseMAC(r.PathValue("mac"))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Can't get leases: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
 		return
 	}
-	for _, lease := range leases {
-		if lease.IPAddress.Equal(hostIP) {
-			// If found, claim.
-			if err := s.Database.ClaimDevice(session.Username, lease.MACAddress, lease.Hostname); err != nil {
-				fmt.Fprintf(w, "Could not claim device: %v", err)
-				return
-			}
-			http.Redirect(w, r, "/manage", http.StatusFound)
-			return
-		}
+	lease, host, err := s.currentLease(r)
+	if err != nil {
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if lease == nil {
+		fmt.Fprintf(w, "You must be present at the lab and be using local DNS to add this device's address (detected host: %s).", host)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, fmt.Sprintf("Add address %s of the device you're connecting from to device %s?", lease.MACAddress, device))
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
 	}
-	fmt.Fprintf(w, "You must be present at the lab and be using local DNS to claim this device (detected host: %s).", host)
+	if err := s.Database.AddDeviceAddress(session.Username, device, lease.MACAddress); err != nil {
+		fmt.Fprintf(w, "Could not add address: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
+
+// viewDeviceRemoveAddress removes an additional MAC address from one of the
+// user's devices.
+func (s *Service) viewDeviceRemoveAddress(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+
+	device, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	address, err := net.ParseMAC(r.PathValue("address"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, fmt.Sprintf("Remove address %s from device %s?", address, device))
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	if err := s.Database.RemoveDeviceAddress(session.Username, device, address); err != nil {
+		fmt.Fprintf(w, "Could not remove address: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
+
+// viewDeviceMatching configures client ID/hostname matching for one of the
+// user's devices.
+func (s *Service) viewDeviceMatching(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+
+	device, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	clientID := r.PostFormValue("client_id") == "on"
+	hostname := r.PostFormValue("hostname") == "on"
+	if err := s.Database.SetDeviceMatching(session.Username, device, clientID, hostname); err != nil {
+		fmt.Fprintf(w, "Could not update device: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
 }
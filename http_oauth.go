@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"time"
 
 	"golang.org/x/oauth2"
+	"k8s.io/klog/v2"
 )
 
 func (s *Service) viewOauthLogin(w http.ResponseWriter, r *http.Request) {
@@ -27,6 +30,7 @@ func (s *Service) viewOauthLogin(w http.ResponseWriter, r *http.Request) {
 	s.Sessions.Set(w, &Session{
 		OAuthState:    state,
 		OAuthVerifier: verifier,
+		ExpiresAt:     time.Now().Add(10 * time.Minute),
 	})
 	http.Redirect(w, r, url, http.StatusFound)
 }
@@ -81,9 +85,138 @@ func (s *Service) viewOauthRedirect(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "no username")
 		return
 	}
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		fmt.Fprintf(w, "out of entropy")
+		return
+	}
+	user, err := s.Database.GetUser(ui.PreferredUsername)
+	if err != nil {
+		fmt.Fprintf(w, "could not get user")
+		return
+	}
+	now := time.Now()
 	session.Username = ui.PreferredUsername
+	session.CSRFToken = csrfToken
+	session.IssuedAt = now
+	session.ExpiresAt = now.Add(s.Sessions.Lifetime)
+	session.Generation = user.SessionGeneration
 	session.OAuthState = ""
 	session.OAuthVerifier = ""
 	s.Sessions.Set(w, session)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
+
+// viewLogout logs the user out of the current session.
+func (s *Service) viewLogout(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, "Log out?")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	s.Sessions.Clear(w)
+	fmt.Fprintf(w, "Logged out.")
+}
+
+// viewLogoutEverywhere logs the user out of all their sessions, on all
+// browsers.
+func (s *Service) viewLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, "Log out of all your sessions, on all browsers and devices?")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	if err := s.Database.RevokeSessions(session.Username); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not log out: %v", err)
+		return
+	}
+	klog.Infof("%s logged out everywhere", session.Username)
+	s.Sessions.Clear(w)
+	fmt.Fprintf(w, "Logged out everywhere.")
+}
+
+// viewAdminUsers lists all users with claimed devices, allowing admins to
+// revoke their sessions.
+func (s *Service) viewAdminUsers(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.isAdmin(session.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "You are not an admin.")
+		return
+	}
+
+	devices, err := s.Database.GetDevices()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get devices: %v", err)
+		return
+	}
+	counts := make(map[string]int)
+	for _, d := range devices {
+		counts[d.UserNickname]++
+	}
+	var users []string
+	for u := range counts {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+
+	token := s.csrfToken(w, session)
+	templateAdminUsers.Execute(w, map[string]any{
+		"Username":     session.Username,
+		"CSRFToken":    token,
+		"Users":        users,
+		"DeviceCounts": counts,
+		"SpaceName":    s.cfg().SpaceName,
+		"SpaceURL":     s.cfg().SpaceURL,
+	})
+}
+
+// viewAdminRevokeSessions logs a user out of all their sessions.
+func (s *Service) viewAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.isAdmin(session.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "You are not an admin.")
+		return
+	}
+
+	user := r.PathValue("user")
+	if r.Method != http.MethodPost {
+		s.confirm(w, r, session, fmt.Sprintf("Log %s out of all their sessions?", user))
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	if err := s.Database.RevokeSessions(user); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not revoke sessions: %v", err)
+		return
+	}
+	klog.Infof("%s revoked sessions of %s", session.Username, user)
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
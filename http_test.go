@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticLeases is a LeaseSource returning fixed leases.
+type staticLeases []*Lease
+
+func (s staticLeases) Leases() ([]*Lease, error) {
+	return s, nil
+}
+
+// newTestService builds a Service backed by a temporary database, with a
+// single lease for 10.1.0.23.
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+	db, err := NewBoltDatabase(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("could not create database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s := &Service{
+		Database: db,
+		Sessions: &Sessions{
+			Lifetime: time.Hour,
+			Users:    db,
+		},
+	}
+	if err := s.Sessions.SetSecrets([]string{"test"}); err != nil {
+		t.Fatalf("could not set secrets: %v", err)
+	}
+	s.runtimeConfig.Store(&RuntimeConfig{
+		Leases: staticLeases{{
+			IPAddress:  net.ParseIP("10.1.0.23"),
+			MACAddress: mustParseMAC("00:11:22:33:44:55"),
+			Expires:    time.Now().Add(time.Hour),
+			Hostname:   "laptop",
+		}},
+	})
+	return s
+}
+
+// sessionCookies returns cookies carrying the given session.
+func (s *Service) sessionCookies(session *Session) []*http.Cookie {
+	w := httptest.NewRecorder()
+	s.Sessions.Set(w, session)
+	return w.Result().Cookies()
+}
+
+func TestCSRF(t *testing.T) {
+	s := newTestService(t)
+	cookies := s.sessionCookies(&Session{Username: "q3k", CSRFToken: "secret-token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		var body *strings.Reader
+		if token != "" {
+			body = strings.NewReader(url.Values{"csrf_token": {token}}.Encode())
+		} else {
+			body = strings.NewReader("")
+		}
+		r := httptest.NewRequest(method, path, body)
+		r.RemoteAddr = "10.1.0.23:1234"
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		s.viewClaim(w, r)
+		return w
+	}
+	claimed := func() bool {
+		devices, err := s.Database.GetDevicesForUser("q3k")
+		if err != nil {
+			t.Fatalf("could not get devices: %v", err)
+		}
+		return len(devices) > 0
+	}
+
+	// GET only shows a confirmation page.
+	w := request("GET", "/claim", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "secret-token") {
+		t.Errorf("GET: expected confirmation page with token, got %d: %s", w.Code, w.Body.String())
+	}
+	if claimed() {
+		t.Fatalf("GET claimed device")
+	}
+
+	// POST without or with the wrong token is rejected.
+	for _, token := range []string{"", "wrong-token"} {
+		if w := request("POST", "/claim", token); w.Code != http.StatusForbidden {
+			t.Errorf("POST with token %q: expected forbidden, got %d", token, w.Code)
+		}
+		if claimed() {
+			t.Fatalf("POST with token %q claimed device", token)
+		}
+	}
+
+	// POST with the session's token claims.
+	if w := request("POST", "/claim", "secret-token"); w.Code != http.StatusFound {
+		t.Errorf("POST: expected redirect, got %d: %s", w.Code, w.Body.String())
+	}
+	if !claimed() {
+		t.Fatalf("POST did not claim device")
+	}
+}
+
+func TestCSRFLegacySession(t *testing.T) {
+	s := newTestService(t)
+	cookies := s.sessionCookies(&Session{Username: "q3k", ExpiresAt: time.Now().Add(time.Hour)})
+
+	// Sessions without a token can't perform mutations...
+	r := httptest.NewRequest("POST", "/unclaim/00:11:22:33:44:55", strings.NewReader("csrf_token="))
+	r.SetPathValue("mac", "00:11:22:33:44:55")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	s.viewUnclaim(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %d", w.Code)
+	}
+
+	// ... but get one when viewing a page with forms.
+	r = httptest.NewRequest("GET", "/manage", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	s.viewManage(w, r)
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	got := s.Sessions.Get(r)
+	if got == nil || got.CSRFToken == "" {
+		t.Errorf("expected session with new token, got %+v", got)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := newTestService(t)
+	get := func(cookies []*http.Cookie) *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return s.Sessions.Get(r)
+	}
+
+	if got := get(s.sessionCookies(&Session{Username: "q3k"})); got != nil {
+		t.Errorf("session without expiry is valid: %+v", got)
+	}
+	if got := get(s.sessionCookies(&Session{Username: "q3k", ExpiresAt: time.Now().Add(-time.Second)})); got != nil {
+		t.Errorf("expired session is valid: %+v", got)
+	}
+
+	// Sessions close to expiry are renewed.
+	expires := time.Now().Add(10 * time.Minute)
+	cookies := s.sessionCookies(&Session{Username: "q3k", ExpiresAt: expires})
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	s.Sessions.Renew(http.NotFoundHandler()).ServeHTTP(w, r)
+	got := get(w.Result().Cookies())
+	if got == nil || !got.ExpiresAt.After(expires.Add(30*time.Minute)) {
+		t.Errorf("session not renewed: %+v", got)
+	}
+}
+
+func TestSessionRevocation(t *testing.T) {
+	s := newTestService(t)
+	cookies := s.sessionCookies(&Session{Username: "q3k", ExpiresAt: time.Now().Add(time.Hour)})
+	other := s.sessionCookies(&Session{Username: "joe", ExpiresAt: time.Now().Add(time.Hour)})
+	get := func(cookies []*http.Cookie) *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return s.Sessions.Get(r)
+	}
+	if get(cookies) == nil {
+		t.Fatalf("session invalid before revocation")
+	}
+	if err := s.Database.RevokeSessions("q3k"); err != nil {
+		t.Fatalf("could not revoke sessions: %v", err)
+	}
+	if got := get(cookies); got != nil {
+		t.Errorf("revoked session still valid: %+v", got)
+	}
+	if get(other) == nil {
+		t.Errorf("other user's session revoked")
+	}
+	// New sessions (with the current generation) are valid again.
+	if get(s.sessionCookies(&Session{Username: "q3k", ExpiresAt: time.Now().Add(time.Hour), Generation: 1})) == nil {
+		t.Errorf("new session invalid after revocation")
+	}
+}
+
+func TestSessionSecretRotation(t *testing.T) {
+	s := newTestService(t)
+	get := func(cookies []*http.Cookie) *Session {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return s.Sessions.Get(r)
+	}
+	cookies := s.sessionCookies(&Session{Username: "q3k", ExpiresAt: time.Now().Add(time.Hour)})
+
+	if err := s.Sessions.SetSecrets([]string{"new", "test"}); err != nil {
+		t.Fatalf("could not set secrets: %v", err)
+	}
+	if get(cookies) == nil {
+		t.Fatalf("session sealed with previous secret not accepted")
+	}
+
+	// Renew reseals with the current secret, even if the session isn't close
+	// to expiry.
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	s.Sessions.Renew(http.NotFoundHandler()).ServeHTTP(w, r)
+	resealed := w.Result().Cookies()
+	if len(resealed) == 0 {
+		t.Fatalf("session not resealed")
+	}
+
+	// Once the previous secret is dropped, only the resealed session works.
+	if err := s.Sessions.SetSecrets([]string{"new"}); err != nil {
+		t.Fatalf("could not set secrets: %v", err)
+	}
+	if get(cookies) != nil {
+		t.Errorf("session sealed with dropped secret still accepted")
+	}
+	if get(resealed) == nil {
+		t.Errorf("resealed session not accepted")
+	}
+}
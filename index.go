@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"go.etcd.io/bbolt"
+	"k8s.io/klog/v2"
+)
+
+// indexUserDevice adds a device to its user's index.
+func indexUserDevice(tx *bbolt.Tx, device *Device) error {
+	index, err := tx.Bucket(bucketUserDevices).CreateBucketIfNotExists([]byte(device.UserNickname))
+	if err != nil {
+		return err
+	}
+	return index.Put([]byte(device.MACAddress), []byte{})
+}
+
+// unindexUserDevice removes a device from its user's index, removing the
+// user's index altogether if it becomes empty.
+func unindexUserDevice(tx *bbolt.Tx, device *Device) error {
+	users := tx.Bucket(bucketUserDevices)
+	index := users.Bucket([]byte(device.UserNickname))
+	if index == nil {
+		return nil
+	}
+	if err := index.Delete([]byte(device.MACAddress)); err != nil {
+		return err
+	}
+	if k, _ := index.Cursor().First(); k == nil {
+		return users.DeleteBucket([]byte(device.UserNickname))
+	}
+	return nil
+}
+
+// scanUserDevices builds the expected contents of the user devices index by
+// scanning all devices.
+func scanUserDevices(tx *bbolt.Tx) (map[string][]string, error) {
+	res := make(map[string][]string)
+	err := tx.Bucket(bucketDevices).ForEach(func(k, v []byte) error {
+		var device Device
+		if err := json.Unmarshal(v, &device); err != nil {
+			klog.Warningf("Device %q could not be unmarshaled: %v", k, err)
+			return nil
+		}
+		res[device.UserNickname] = append(res[device.UserNickname], device.MACAddress)
+		return nil
+	})
+	return res, err
+}
+
+// rebuildUserIndex drops and recreates the user devices index from all
+// devices.
+func rebuildUserIndex(tx *bbolt.Tx) error {
+	if tx.Bucket(bucketUserDevices) != nil {
+		if err := tx.DeleteBucket(bucketUserDevices); err != nil {
+			return err
+		}
+	}
+	users, err := tx.CreateBucket(bucketUserDevices)
+	if err != nil {
+		return err
+	}
+	expected, err := scanUserDevices(tx)
+	if err != nil {
+		return err
+	}
+	for user, macs := range expected {
+		index, err := users.CreateBucket([]byte(user))
+		if err != nil {
+			return err
+		}
+		for _, mac := range macs {
+			if err := index.Put([]byte(mac), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkUserIndex returns a list of inconsistencies between the user devices
+// index and the devices bucket.
+func checkUserIndex(tx *bbolt.Tx) ([]string, error) {
+	users := tx.Bucket(bucketUserDevices)
+	if users == nil {
+		return []string{"user devices index is missing"}, nil
+	}
+	expected, err := scanUserDevices(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	err = users.ForEach(func(user, v []byte) error {
+		if v != nil {
+			problems = append(problems, fmt.Sprintf("user index: %q is not a bucket", user))
+			return nil
+		}
+		want := make(map[string]bool)
+		for _, mac := range expected[string(user)] {
+			want[mac] = true
+		}
+		err := users.Bucket(user).ForEach(func(mac, _ []byte) error {
+			if !want[string(mac)] {
+				problems = append(problems, fmt.Sprintf("user index: %q lists device %q which it does not own", user, mac))
+			}
+			delete(want, string(mac))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for mac := range want {
+			problems = append(problems, fmt.Sprintf("user index: %q is missing device %q", user, mac))
+		}
+		delete(expected, string(user))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for user, macs := range expected {
+		for _, mac := range macs {
+			problems = append(problems, fmt.Sprintf("user index: %q is missing device %q", user, mac))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// checkAliases returns a list of inconsistencies between the aliases bucket
+// and the devices bucket.
+func checkAliases(tx *bbolt.Tx) ([]string, error) {
+	devices := tx.Bucket(bucketDevices)
+	aliases := tx.Bucket(bucketAliases)
+	var problems []string
+	wanted := make(map[string]string)
+	err := devices.ForEach(func(k, v []byte) error {
+		var device Device
+		if err := json.Unmarshal(v, &device); err != nil {
+			problems = append(problems, fmt.Sprintf("device %q could not be unmarshaled: %v", k, err))
+			return nil
+		}
+		if device.MACAddress != string(k) {
+			problems = append(problems, fmt.Sprintf("device %q is stored under key %q", device.MACAddress, k))
+		}
+		for _, ak := range device.aliasKeys() {
+			wanted[string(ak)] = device.MACAddress
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = aliases.ForEach(func(k, v []byte) error {
+		want, ok := wanted[string(k)]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("alias %q points to %q, but no device has it", k, v))
+		case !bytes.Equal([]byte(want), v):
+			problems = append(problems, fmt.Sprintf("alias %q points to %q, but belongs to %q", k, v, want))
+		}
+		delete(wanted, string(k))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k, mac := range wanted {
+		problems = append(problems, fmt.Sprintf("alias %q of device %q is missing", k, mac))
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// Check performs a full consistency check of the database and returns a list
+// of all problems found.
+func (b *BoltDatabase) Check() ([]string, error) {
+	var problems []string
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		p, err := checkAliases(tx)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, p...)
+		p, err = checkUserIndex(tx)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, p...)
+		p, err = checkEquipment(tx)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, p...)
+		return nil
+	})
+	return problems, err
+}
+
+// repairUserIndex rebuilds the user devices index if it is missing or
+// inconsistent.
+func (b *BoltDatabase) repairUserIndex() error {
+	var problems []string
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		problems, err = checkUserIndex(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, p := range problems {
+		klog.Warningf("Database inconsistency: %s", p)
+	}
+	klog.Warningf("Rebuilding user devices index...")
+	return b.db.Update(rebuildUserIndex)
+}
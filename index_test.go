@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestUserIndex(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db, err := NewBoltDatabase(path)
+	if err != nil {
+		t.Fatalf("could not create DB: %v", err)
+	}
+	if err := db.ClaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, "stinkpad", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := db.ClaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 6}, "pixel", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := db.ClaimDevice("joe", net.HardwareAddr{0, 1, 2, 3, 4, 7}, "crapbook", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	// Merging a device removes it from the index.
+	if err := db.AddDeviceAddress("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0, 1, 2, 3, 4, 6}); err != nil {
+		t.Fatalf("could not add address: %v", err)
+	}
+	if err := db.UnclaimDevice("joe", net.HardwareAddr{0, 1, 2, 3, 4, 7}); err != nil {
+		t.Fatalf("could not unclaim device: %v", err)
+	}
+	problems, err := db.Check()
+	if err != nil {
+		t.Fatalf("could not check DB: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	// Break the index by moving a device to another user behind its back.
+	err = db.db.Update(func(tx *bbolt.Tx) error {
+		v, _ := json.Marshal(&Device{MACAddress: "00:01:02:03:04:05", AdditionalMACAddresses: []string{"00:01:02:03:04:06"}, UserNickname: "joe"})
+		return tx.Bucket(bucketDevices).Put([]byte("00:01:02:03:04:05"), v)
+	})
+	if err != nil {
+		t.Fatalf("could not break DB: %v", err)
+	}
+	problems, err = db.Check()
+	if err != nil {
+		t.Fatalf("could not check DB: %v", err)
+	}
+	if len(problems) != 2 {
+		t.Errorf("expected two problems, got %v", problems)
+	}
+
+	// Reopening repairs the index.
+	db.db.Close()
+	db, err = NewBoltDatabase(path)
+	if err != nil {
+		t.Fatalf("could not reopen DB: %v", err)
+	}
+	devices, err := db.GetDevicesForUser("joe")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].MACAddress != "00:01:02:03:04:05" {
+		t.Errorf("expected moved device, got %+v", devices)
+	}
+	devices, err = db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("expected no devices, got %+v", devices)
+	}
+}
+
+// benchmarkDatabase creates a database with n devices spread across n/10
+// users.
+func benchmarkDatabase(b *testing.B, n int) *BoltDatabase {
+	b.Helper()
+	db, err := NewBoltDatabase(b.TempDir() + "/db")
+	if err != nil {
+		b.Fatalf("could not create DB: %v", err)
+	}
+	err = db.db.Update(func(tx *bbolt.Tx) error {
+		for i := 0; i < n; i++ {
+			mac := net.HardwareAddr{0, 0, byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}
+			d := &Device{
+				MACAddress:   mac.String(),
+				Hostname:     fmt.Sprintf("device%d", i),
+				UserNickname: fmt.Sprintf("user%d", i%(n/10)),
+			}
+			if err := db.putDevice(tx, nil, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("could not populate DB: %v", err)
+	}
+	return db
+}
+
+func BenchmarkGetDevicesForUser(b *testing.B) {
+	db := benchmarkDatabase(b, 50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		devices, err := db.GetDevicesForUser("user42")
+		if err != nil {
+			b.Fatalf("could not get devices: %v", err)
+		}
+		if len(devices) != 10 {
+			b.Fatalf("expected 10 devices, got %d", len(devices))
+		}
+	}
+}
+
+// BenchmarkGetDevicesForUserScan is the previous implementation of
+// GetDevicesForUser, a linear scan over all devices.
+func BenchmarkGetDevicesForUserScan(b *testing.B) {
+	db := benchmarkDatabase(b, 50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var devices []*Device
+		err := db.db.View(func(tx *bbolt.Tx) error {
+			return tx.Bucket(bucketDevices).ForEach(func(k, v []byte) error {
+				var device Device
+				if err := json.Unmarshal(v, &device); err != nil {
+					return err
+				}
+				if device.UserNickname == "user42" {
+					devices = append(devices, &device)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			b.Fatalf("could not get devices: %v", err)
+		}
+		if len(devices) != 10 {
+			b.Fatalf("expected 10 devices, got %d", len(devices))
+		}
+	}
+}
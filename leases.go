@@ -14,18 +14,72 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// LeaseSource provides DHCP leases.
+type LeaseSource interface {
+	// Leases returns all known leases, active or not.
+	Leases() ([]*Lease, error)
+}
+
+// MultiLeaseSource combines leases from multiple LeaseSources.
+type MultiLeaseSource []LeaseSource
+
+func (m MultiLeaseSource) Leases() ([]*Lease, error) {
+	var res []*Lease
+	for _, ls := range m {
+		leases, err := ls.Leases()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, leases...)
+	}
+	return res, nil
+}
+
 // KeaLeaseFile provides Leases by parsing a Key DHCPv4 server leasefile.
 type KeaLeaseFile struct {
 	// paths to lease files.
 	paths []string
 }
 
+// NewKeaLeaseFile returns a KeaLeaseFile for a given leasefile path. The
+// previous leasefile (path.2) that Kea keeps during lease file cleanup is
+// also read.
+func NewKeaLeaseFile(path string) *KeaLeaseFile {
+	return &KeaLeaseFile{
+		paths: []string{path, path + ".2"},
+	}
+}
+
 // Lease is a DHCPv4 server lease. It might or might not be currently active.
 type Lease struct {
 	IPAddress  net.IP
 	MACAddress net.HardwareAddr
 	Expires    time.Time
-	Hostname   string
+	// RenewedAt is when the lease was last granted or renewed, if known.
+	// Clients renew their leases periodically (usually after half of the
+	// lease time) while connected, so this is a better indication of recent
+	// activity than Expires.
+	RenewedAt time.Time
+	Hostname  string
+	// ClientID is the DHCP client identifier (option 61) sent by the client,
+	// if any.
+	ClientID string
+}
+
+// Randomized returns true if the lease's MAC address is locally administered,
+// which in practice means it was randomized by the client.
+func (l *Lease) Randomized() bool {
+	return isLocallyAdministered(l.MACAddress)
+}
+
+// isLocallyAdministered returns true if the given MAC address has the
+// locally-administered bit set. Modern phones and laptops use such addresses
+// for per-network or rotating MAC randomization.
+func isLocallyAdministered(mac net.HardwareAddr) bool {
+	if len(mac) == 0 {
+		return false
+	}
+	return mac[0]&0x02 != 0
 }
 
 func getField(parts []string, ix int) string {
@@ -89,13 +143,31 @@ func (k *KeaLeaseFile) leases(path string) ([]*Lease, error) {
 			klog.Warningf("Leasefile lien %q: invalid expire time %q", line, expires)
 		}
 		expiresT := time.Unix(expiresInt, 0)
+		// valid_lifetime is optional, but without it the renewal time is
+		// unknown.
+		var renewedAt time.Time
+		if ix, ok := fieldMap["valid_lifetime"]; ok && err == nil {
+			lifetime := getField(parts, ix)
+			if lifetimeInt, err := strconv.ParseInt(lifetime, 10, 64); err != nil {
+				klog.Warningf("Leasefile line %q: invalid valid_lifetime %q", line, lifetime)
+			} else if lifetimeInt > 0 {
+				renewedAt = time.Unix(expiresInt-lifetimeInt, 0)
+			}
+		}
 		hostname := getField(parts, fieldMap["hostname"])
+		// client_id is optional, as not all clients send one.
+		var clientID string
+		if ix, ok := fieldMap["client_id"]; ok {
+			clientID = getField(parts, ix)
+		}
 
 		l := &Lease{
 			IPAddress:  ip,
 			MACAddress: mac,
 			Expires:    expiresT,
+			RenewedAt:  renewedAt,
 			Hostname:   hostname,
+			ClientID:   clientID,
 		}
 		if existing, ok := resMap[l.MACAddress.String()]; ok {
 			if l.Expires.After(existing.Expires) {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestKeaLeaseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kea-leases4.csv")
+	content := `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id
+10.1.0.23,00:11:22:33:44:55,01:00:11:22:33:44:55,3600,1714590000,1,0,0,laptop,0,,0
+10.1.0.24,00:11:22:33:44:66,,0,1714590000,1,0,0,phone,0,,0
+10.1.0.23,00:11:22:33:44:55,01:00:11:22:33:44:55,3600,1714586400,1,0,0,laptop,0,,0
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write lease file: %v", err)
+	}
+	leases, err := NewKeaLeaseFile(path).Leases()
+	if err != nil {
+		t.Fatalf("could not read leases: %v", err)
+	}
+	want := []*Lease{
+		{
+			IPAddress:  net.ParseIP("10.1.0.23"),
+			MACAddress: mustParseMAC("00:11:22:33:44:55"),
+			Expires:    time.Unix(1714590000, 0),
+			RenewedAt:  time.Unix(1714586400, 0),
+			Hostname:   "laptop",
+			ClientID:   "01:00:11:22:33:44:55",
+		},
+		// Without a lifetime, the renewal time is unknown.
+		{
+			IPAddress:  net.ParseIP("10.1.0.24"),
+			MACAddress: mustParseMAC("00:11:22:33:44:66"),
+			Expires:    time.Unix(1714590000, 0),
+			Hostname:   "phone",
+		},
+	}
+	if diff := cmp.Diff(want, leases); diff != "" {
+		t.Errorf("leases: %s", diff)
+	}
+}
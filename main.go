@@ -2,17 +2,14 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"flag"
-	"fmt"
-	"io"
-	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"sort"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -20,11 +17,13 @@ import (
 )
 
 var (
+	flagConfigFile        = ""
 	flagSecretFile        = "checkinator.secret"
 	flagListen            = ":8080"
 	flagPublicAddress     = "https://at.lab.fa-fo.de/"
 	flagLeaseFile         = "/var/lib/kea/dhcp4.leases"
 	flagDatabaseFile      = "checkinator.db"
+	flagDatabaseType      = "bolt"
 	flagOauthClientID     = ""
 	flagOauthClientSecret = ""
 	flagOauthAuthURL      = "https://git.fa-fo.de/login/oauth/authorize"
@@ -33,90 +32,172 @@ var (
 	flagAPIUsers          = ""
 	flagSpaceName         = "FAFO"
 	flagSpaceURL          = "https://fa-fo.de/"
+	flagAdmins            = ""
+	flagShutdownTimeout   = 30 * time.Second
+	flagSessionLifetime   = 30 * 24 * time.Hour
+	flagCheckInDuration   = 4 * time.Hour
+	flagArrivalDelay      time.Duration
+	flagSeenWithin        time.Duration
+	flagNeighbourIface    = ""
+	flagNeighbourInterval = time.Minute
+	flagDepartureDelay    = 10 * time.Minute
+	flagShowUnclaimed     bool
+	flagSMTPAddr          = ""
+	flagSMTPFrom          = ""
+	flagSMTPUsername      = ""
+	flagSMTPPassword      = ""
+	flagNtfyServer        = ""
+	flagNotifyWebhooks    bool
+	flagMatrixHomeserver  = ""
+	flagMatrixToken       = ""
+	flagMatrixRoom        = ""
+	flagMatrixAnnounce    bool
+	flagTrustedProxies    = "127.0.0.0/8,::1"
+
+	flagDeviceExpiry        time.Duration
+	flagDeviceExpiryWarning = 14 * 24 * time.Hour
+	flagDeviceExpiryAction  = "flag"
 )
 
 type APIUser struct {
-	Username string
-	Password string
+	Username string `toml:"username"`
+	Password string `toml:"password"`
 }
 
 // Service is the main server/service object of checkinator.
 type Service struct {
-	Leases   *KeaLeaseFile
-	Database *BoltDatabase
+	Database Store
 	OAuth2   *oauth2.Config
 	Sessions *Sessions
+	// Config is used to reload the runtime configuration.
+	Config *Config
+
+	runtimeConfig atomic.Pointer[RuntimeConfig]
+	// presence debounces device presence, see getPresence.
+	presence presenceTracker
+	// neighbours, if set, detects present devices by probing the network.
+	neighbours *NeighbourProber
+	// notified rate-limits notification subscriptions.
+	notified notificationLimiter
+	// matrix, if set, is the Matrix bot.
+	matrix *MatrixBot
+	// claims are pending verifications of claims of unclaimed devices.
+	claims claimVerifications
+	// now, if set, replaces time.Now in presence computations (for tests).
+	now func() time.Time
+}
+
+// timeNow returns the current time, as seen by the service.
+func (s *Service) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
 
-	Authorized []APIUser
+// registerFlags defines all command line flags of yacheck. These can also be
+// set from the configuration file and environment, see Config.
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flagConfigFile, "config", flagConfigFile, "Path to TOML configuration file (see README.md)")
+	fs.StringVar(&flagSecretFile, "secret_file", flagSecretFile, "Path to secret file (used to sign/encrypt sessions, see `yacheck secret rotate`)")
+	fs.StringVar(&flagListen, "listen", flagListen, "Address to bind to for HTTP requests")
+	fs.StringVar(&flagPublicAddress, "public_address", flagPublicAddress, "Public address of this instance, used for calculating redircect URLs")
+	fs.StringVar(&flagLeaseFile, "lease_file", flagLeaseFile, "Path to Kea DHCP4 lease file")
+	fs.StringVar(&flagDatabaseFile, "db_file", flagDatabaseFile, "Path to checkinator database file")
+	fs.StringVar(&flagDatabaseType, "db_type", flagDatabaseType, "Type of checkinator database: bolt or sqlite")
+	fs.StringVar(&flagOauthClientID, "oauth_client_id", flagOauthClientID, "OAuth client ID")
+	fs.StringVar(&flagOauthClientSecret, "oauth_client_secret", flagOauthClientSecret, "OAuth client secret")
+	fs.StringVar(&flagOauthAuthURL, "oauth_auth_url", flagOauthAuthURL, "OAuth authorization URL")
+	fs.StringVar(&flagOauthTokenURL, "oauth_token_url", flagOauthTokenURL, "OAuth token URL")
+	fs.StringVar(&flagOauthUserInfoURL, "oauth_user_info_url", flagOauthUserInfoURL, "OAuth OIDC User Info URL")
+	fs.StringVar(&flagAPIUsers, "api_users", flagAPIUsers, "List of API user:password pairs, comma separated")
+	fs.StringVar(&flagSpaceName, "space_name", flagSpaceName, "Name of hackerspace to show in interface")
+	fs.StringVar(&flagSpaceURL, "space_url", flagSpaceURL, "URL of hackerspace to show in interface")
+	fs.StringVar(&flagAdmins, "admins", flagAdmins, "List of usernames of admins, comma separated")
+	fs.StringVar(&flagTrustedProxies, "trusted_proxies", flagTrustedProxies, "List of CIDRs of reverse proxies whose X-Forwarded-For/Forwarded headers are trusted, comma separated")
+	fs.DurationVar(&flagSessionLifetime, "session_lifetime", flagSessionLifetime, "How long users stay logged in without visiting")
+	fs.DurationVar(&flagSeenWithin, "seen_within", flagSeenWithin, "If set, devices are only present if their lease was renewed (or they were seen by neighbour probing) this recently, instead of until their lease expires")
+	fs.StringVar(&flagNeighbourIface, "neighbour_interface", flagNeighbourIface, "If set, periodically probe leased addresses and use the ARP table of this interface to detect present devices (Linux only)")
+	fs.DurationVar(&flagNeighbourInterval, "neighbour_interval", flagNeighbourInterval, "Interval between neighbour probes")
+	fs.DurationVar(&flagArrivalDelay, "arrival_delay", flagArrivalDelay, "How long a device must be present before its owner is shown as present")
+	fs.DurationVar(&flagDepartureDelay, "departure_delay", flagDepartureDelay, "How long a user's devices must be gone before they're no longer shown as present")
+	fs.BoolVar(&flagShowUnclaimed, "show_unclaimed", flagShowUnclaimed, "Show the number of unclaimed devices online on the index page")
+	fs.StringVar(&flagSMTPAddr, "smtp_addr", flagSMTPAddr, "SMTP server (host:port) for e-mail notifications, empty to disable them")
+	fs.StringVar(&flagSMTPFrom, "smtp_from", flagSMTPFrom, "Sender address of e-mail notifications")
+	fs.StringVar(&flagSMTPUsername, "smtp_username", flagSMTPUsername, "SMTP username, if the server requires authentication")
+	fs.StringVar(&flagSMTPPassword, "smtp_password", flagSMTPPassword, "SMTP password, if the server requires authentication")
+	fs.StringVar(&flagNtfyServer, "ntfy_server", flagNtfyServer, "Base URL of an ntfy server for push notifications (eg. https://ntfy.sh), empty to disable them")
+	fs.BoolVar(&flagNotifyWebhooks, "notify_webhooks", flagNotifyWebhooks, "Allow users to receive notifications on webhook URLs of their choice")
+	fs.StringVar(&flagMatrixHomeserver, "matrix_homeserver", flagMatrixHomeserver, "Base URL of a Matrix homeserver (eg. https://matrix.org) for the Matrix bot, empty to disable it")
+	fs.StringVar(&flagMatrixToken, "matrix_access_token", flagMatrixToken, "Access token of the Matrix bot's account")
+	fs.StringVar(&flagMatrixRoom, "matrix_room", flagMatrixRoom, "ID or alias of the Matrix room in which the bot answers !at")
+	fs.BoolVar(&flagMatrixAnnounce, "matrix_announce", flagMatrixAnnounce, "Announce arrivals and departures in the Matrix room")
+	fs.DurationVar(&flagCheckInDuration, "checkin_duration", flagCheckInDuration, "How long manual check-ins last (they can be extended)")
+	fs.DurationVar(&flagShutdownTimeout, "shutdown_timeout", flagShutdownTimeout, "How long to wait for in-flight requests on shutdown")
+	fs.DurationVar(&flagDeviceExpiry, "device_expiry", flagDeviceExpiry, "Expire claimed devices not seen for this long (0 to disable)")
+	fs.DurationVar(&flagDeviceExpiryWarning, "device_expiry_warning", flagDeviceExpiryWarning, "Warn users this long before their devices expire")
+	fs.StringVar(&flagDeviceExpiryAction, "device_expiry_action", flagDeviceExpiryAction, "What to do with expired devices: 'flag' as stale or 'unclaim'")
 }
 
 func main() {
-	flag.StringVar(&flagSecretFile, "secret_file", flagSecretFile, "Path to secret file (used to sign/encrypt sessions)")
-	flag.StringVar(&flagListen, "listen", flagListen, "Address to bind to for HTTP requests")
-	flag.StringVar(&flagPublicAddress, "public_address", flagPublicAddress, "Public address of this instance, used for calculating redircect URLs")
-	flag.StringVar(&flagLeaseFile, "lease_file", flagLeaseFile, "Path to Kea DHCP4 lease file")
-	flag.StringVar(&flagDatabaseFile, "db_file", flagDatabaseFile, "Path to checkinator database file")
-	flag.StringVar(&flagOauthClientID, "oauth_client_id", flagOauthClientID, "OAuth client ID")
-	flag.StringVar(&flagOauthClientSecret, "oauth_client_secret", flagOauthClientSecret, "OAuth client secret")
-	flag.StringVar(&flagOauthAuthURL, "oauth_auth_url", flagOauthAuthURL, "OAuth authorization URL")
-	flag.StringVar(&flagOauthTokenURL, "oauth_token_url", flagOauthTokenURL, "OAuth token URL")
-	flag.StringVar(&flagOauthUserInfoURL, "oauth_user_info_url", flagOauthUserInfoURL, "OAuth OIDC User Info URL")
-	flag.StringVar(&flagAPIUsers, "api_users", flagAPIUsers, "List of API user:password pairs, comma separated")
-	flag.StringVar(&flagSpaceName, "space_name", flagSpaceName, "Name of hackerspace to show in interface")
-	flag.StringVar(&flagSpaceURL, "space_url", flagSpaceURL, "URL of hackerspace to show in interface")
+	registerFlags(flag.CommandLine)
 	flag.Parse()
 
-	var apiUsers []APIUser
-	if flagAPIUsers != "" {
-		for _, s := range strings.Split(flagAPIUsers, ",") {
-			s = strings.TrimSpace(s)
-			parts := strings.Split(s, ":")
-			if len(parts) != 2 {
-				klog.Exitf("Invalid user:password pair %s", s)
-			}
-			apiUsers = append(apiUsers, APIUser{
-				Username: parts[0],
-				Password: parts[1],
-			})
+	config := NewConfig(flag.CommandLine, flagConfigFile)
+	values, configFile, err := config.Apply()
+	if err != nil {
+		klog.Exitf("Invalid configuration: %v", err)
+	}
+	rc, err := NewRuntimeConfig(values, configFile)
+	if err != nil {
+		klog.Exitf("Invalid configuration: %v", err)
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(rc, flag.Args()); err != nil {
+			klog.Exitf("%v", err)
 		}
+		return
 	}
 
 	if flagOauthClientID == "" || flagOauthClientSecret == "" {
 		klog.Exitf("-oauth_client_id and oauth_client_secret must be set")
 	}
-
-	lf := KeaLeaseFile{
-		paths: []string{flagLeaseFile, flagLeaseFile + ".2"},
+	if flagMatrixHomeserver != "" {
+		if u, err := url.Parse(flagMatrixHomeserver); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			klog.Exitf("Invalid -matrix_homeserver %q", flagMatrixHomeserver)
+		}
+		if flagMatrixToken == "" || flagMatrixRoom == "" {
+			klog.Exitf("-matrix_access_token and -matrix_room must be set with -matrix_homeserver")
+		}
 	}
 
 	// Get leases to make sure the user provided a working lease backend.
-	_, err := lf.Leases()
-	if err != nil {
+	if _, err := rc.Leases.Leases(); err != nil {
 		klog.Exitf("Could not get leases: %v", err)
 	}
 
-	db, err := NewBoltDatabase(flagDatabaseFile)
+	db, err := OpenStore(flagDatabaseType, flagDatabaseFile)
 	if err != nil {
 		klog.Exitf("Could not create/use database: %v", err)
 	}
 
-	if _, err := os.Stat(flagSecretFile); os.IsNotExist(err) {
-		var secret [32]byte
-		if _, err := io.ReadFull(rand.Reader, secret[:]); err != nil {
-			klog.Exitf("Could not generate secret: %v", err)
-		}
-		if err := os.WriteFile(flagSecretFile, []byte(hex.EncodeToString(secret[:])), 0600); err != nil {
-			klog.Exitf("Could not write secret: %v", err)
-		}
+	secrets, generated, err := loadSecrets(flagSecretFile)
+	if err != nil {
+		klog.Exitf("%v", err)
+	}
+	if generated {
 		klog.Infof("Generated secret at %s", flagSecretFile)
 	}
-	secret, err := os.ReadFile(flagSecretFile)
-	if err != nil {
-		klog.Exitf("Could not read secret: %v", err)
+	sessions := &Sessions{
+		Lifetime: flagSessionLifetime,
+		Users:    db,
+	}
+	if err := sessions.SetSecrets(secrets); err != nil {
+		klog.Exitf("Invalid secret: %v", err)
 	}
 
 	s := Service{
-		Leases:   &lf,
 		Database: db,
 		OAuth2: &oauth2.Config{
 			ClientID:     flagOauthClientID,
@@ -128,57 +209,140 @@ func main() {
 			},
 			RedirectURL: flagPublicAddress + "oauth/redirect",
 		},
-		Sessions:   &Sessions{Secret: string(secret)},
-		Authorized: apiUsers,
+		Sessions: sessions,
+		Config:   config,
 	}
+	s.runtimeConfig.Store(rc)
 
-	http.HandleFunc("/{$}", s.viewIndex)
-	http.HandleFunc("/api.json", s.viewAPIJSON)
-	http.HandleFunc("/manage", s.viewManage)
-	http.HandleFunc("/claim", s.viewClaim)
-	http.HandleFunc("/unclaim/{mac}", s.viewUnclaim)
-	http.HandleFunc("/oauth/login", s.viewOauthLogin)
-	http.HandleFunc("/oauth/redirect", s.viewOauthRedirect)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", s.viewIndex)
+	mux.HandleFunc("/api.json", s.viewAPIJSON)
+	mux.HandleFunc("/manage", s.viewManage)
+	mux.HandleFunc("/claim", s.viewClaim)
+	mux.HandleFunc("/unclaim/{mac}", s.viewUnclaim)
+	mux.HandleFunc("/device/{mac}/add_address", s.viewDeviceAddAddress)
+	mux.HandleFunc("/device/{mac}/remove_address/{address}", s.viewDeviceRemoveAddress)
+	mux.HandleFunc("POST /device/{mac}/matching", s.viewDeviceMatching)
+	mux.HandleFunc("POST /device/{mac}/visibility", s.viewDeviceVisibility)
+	mux.HandleFunc("POST /device/{mac}/metadata", s.viewDeviceMetadata)
+	mux.HandleFunc("GET /notifications", s.viewNotifications)
+	mux.HandleFunc("POST /notifications", s.viewNotificationsAdd)
+	mux.HandleFunc("POST /notifications/{id}/remove", s.viewNotificationsRemove)
+	mux.HandleFunc("GET /unclaimed", s.viewUnclaimed)
+	mux.HandleFunc("POST /unclaimed/{mac}/claim", s.viewUnclaimedClaim)
+	mux.HandleFunc("POST /unclaimed/{mac}/verify", s.viewUnclaimedVerify)
+	mux.HandleFunc("POST /visibility", s.viewUserVisibility)
+	mux.HandleFunc("/admin/expiry", s.viewAdminExpiry)
+	mux.HandleFunc("/admin/backup", s.viewAdminBackup)
+	mux.HandleFunc("/oauth/login", s.viewOauthLogin)
+	mux.HandleFunc("/equipment", s.viewEquipment)
+	mux.HandleFunc("POST /admin/equipment", s.viewAdminEquipmentAdd)
+	mux.HandleFunc("/admin/equipment/{mac}/remove", s.viewAdminEquipmentRemove)
+	mux.HandleFunc("/admin/users", s.viewAdminUsers)
+	mux.HandleFunc("/admin/users/{user}/revoke_sessions", s.viewAdminRevokeSessions)
+	mux.HandleFunc("/oauth/redirect", s.viewOauthRedirect)
+	mux.HandleFunc("POST /status", s.viewStatus)
+	mux.HandleFunc("POST /api_token", s.viewAPIToken)
+	mux.HandleFunc("/api/v2/", s.viewAPINotFound)
+	mux.HandleFunc("/api/v2/openapi.json", s.viewAPIOpenAPI)
+	mux.HandleFunc("/api/v2/presence", s.viewAPIPresence)
+	mux.HandleFunc("/api/v2/devices", s.viewAPIDevices)
+	mux.HandleFunc("/api/v2/devices/{mac}", s.viewAPIDevice)
+	mux.HandleFunc("/api/v2/admin/devices", s.viewAPIAdminDevices)
+	mux.HandleFunc("/api/v2/admin/leases", s.viewAPIAdminLeases)
+	mux.HandleFunc("/checkin", s.viewCheckIn)
+	mux.HandleFunc("/checkout", s.viewCheckOut)
+	mux.HandleFunc("/logout", s.viewLogout)
+	mux.HandleFunc("/logout/everywhere", s.viewLogoutEverywhere)
 
-	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
+	server := &http.Server{
+		Addr:              flagListen,
+		Handler:           s.Sessions.Renew(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
 
-	go func() {
-		klog.Infof("Listening on %s...", flagListen)
-		err := http.ListenAndServe(flagListen, nil)
-		if err != nil {
-			klog.Exitf("HTTP listener failed: %v", err)
-		}
-	}()
-	<-ctx.Done()
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func (s *Service) getActiveUsers() ([]string, error) {
-	leases, err := s.Leases.Leases()
-	if err != nil {
-		return nil, fmt.Errorf("could not get leases: %w", err)
+	var workers sync.WaitGroup
+	if flagNeighbourIface != "" {
+		s.neighbours = &NeighbourProber{
+			Interface: flagNeighbourIface,
+			Interval:  flagNeighbourInterval,
+			Path:      "/proc/net/arp",
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.neighbours.Run(ctx, s.probeTargets)
+		}()
 	}
-
-	var addrs []net.HardwareAddr
-	for _, lease := range leases {
-		if lease.Expires.Before(time.Now()) {
-			continue
+	if flagMatrixHomeserver != "" {
+		s.matrix = &MatrixBot{
+			Homeserver:  flagMatrixHomeserver,
+			AccessToken: flagMatrixToken,
+			Room:        flagMatrixRoom,
+			Announce:    flagMatrixAnnounce,
 		}
-		addrs = append(addrs, lease.MACAddress)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.matrix.Run(ctx, s.matrixAnswer)
+		}()
 	}
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		s.runDeviceExpiry(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		s.runPresenceChanges(ctx)
+	}()
 
-	devices, err := s.Database.GetDevicesForMacAddresses(addrs)
-	if err != nil {
-		return nil, fmt.Errorf("could not get devices: %w", err)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			klog.Infof("Reloading configuration...")
+			if err := s.reload(); err != nil {
+				klog.Errorf("Could not reload configuration, keeping previous: %v", err)
+				continue
+			}
+			klog.Infof("Configuration reloaded.")
+		}
+	}()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		klog.Infof("Listening on %s...", flagListen)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	exitCode := 0
+	select {
+	case err := <-serveErr:
+		klog.Errorf("HTTP listener failed: %v", err)
+		exitCode = 1
+	case <-ctx.Done():
+		klog.Infof("Shutting down...")
 	}
+	// Make a second signal kill the process immediately.
+	stop()
 
-	userSet := make(map[string]bool)
-	for _, device := range devices {
-		userSet[device.UserNickname] = true
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), flagShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		klog.Errorf("Could not drain HTTP requests: %v", err)
 	}
-	var users []string
-	for k := range userSet {
-		users = append(users, k)
+	workers.Wait()
+	if err := db.Close(); err != nil {
+		klog.Errorf("Could not close database: %v", err)
 	}
-	sort.Strings(users)
-	return users, nil
+	klog.Infof("Shutdown complete.")
+	klog.Flush()
+	os.Exit(exitCode)
 }
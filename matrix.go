@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// matrixSyncTimeout is how long the homeserver may hold sync requests
+	// when there are no new events.
+	matrixSyncTimeout = 30 * time.Second
+	// matrixRetryDelay is how long to wait after a failed request to the
+	// homeserver before retrying.
+	matrixRetryDelay = 10 * time.Second
+	// matrixRequestTimeout is how long any request to the homeserver may
+	// take, which leaves some margin for syncs.
+	matrixRequestTimeout = matrixSyncTimeout + 15*time.Second
+)
+
+// MatrixBot is a Matrix client which answers !at in a room with the list of
+// present users, and optionally announces arrivals and departures there. It
+// uses its own account on the homeserver, identified by AccessToken.
+type MatrixBot struct {
+	// Homeserver is the base URL of the client-server API, eg.
+	// https://matrix.org.
+	Homeserver  string
+	AccessToken string
+	// Room is the ID or alias of the room to join, eg. #fafo:matrix.org.
+	Room string
+	// Announce enables arrival and departure messages.
+	Announce bool
+	// Client is used for all requests. Defaults to http.DefaultClient, as
+	// requests have a deadline of matrixRequestTimeout anyway.
+	Client *http.Client
+
+	mu sync.Mutex
+	// userID is the bot's own user ID, whose messages are ignored.
+	userID string
+	// roomID is the ID of Room, once joined.
+	roomID string
+	// txnStart and txnID make transaction IDs of sent messages unique.
+	txnStart int64
+	txnID    int
+}
+
+// matrixError is an error response of the client-server API.
+type matrixError struct {
+	Status  int
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.ErrCode, e.Message)
+}
+
+// call makes a request to the client-server API. req and res are marshaled
+// and unmarshaled as JSON, if not nil.
+func (b *MatrixBot) call(ctx context.Context, method, path string, query url.Values, req, res any) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	u := strings.TrimSuffix(b.Homeserver, "/") + "/_matrix/client/v3" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	ctx, cancel := context.WithTimeout(ctx, matrixRequestTimeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+b.AccessToken)
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		merr := &matrixError{Status: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(merr)
+		return merr
+	}
+	if res == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("invalid response to %s: %w", path, err)
+	}
+	return nil
+}
+
+// login checks the access token and joins the room.
+func (b *MatrixBot) login(ctx context.Context) error {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.call(ctx, "GET", "/account/whoami", nil, nil, &whoami); err != nil {
+		return fmt.Errorf("could not check access token: %w", err)
+	}
+	var joined struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := b.call(ctx, "POST", "/join/"+url.PathEscape(b.Room), nil, struct{}{}, &joined); err != nil {
+		return fmt.Errorf("could not join %s: %w", b.Room, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.userID = whoami.UserID
+	b.roomID = joined.RoomID
+	return nil
+}
+
+// matrixSync is the part of a sync response the bot is interested in.
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	} `json:"content"`
+}
+
+// sync returns the events since a sync token, waiting up to timeout for new
+// ones.
+func (b *MatrixBot) sync(ctx context.Context, since string, timeout time.Duration) (*matrixSync, error) {
+	query := url.Values{"timeout": {fmt.Sprint(timeout.Milliseconds())}}
+	if since != "" {
+		query.Set("since", since)
+	}
+	var res matrixSync
+	if err := b.call(ctx, "GET", "/sync", query, nil, &res); err != nil {
+		return nil, fmt.Errorf("could not sync: %w", err)
+	}
+	return &res, nil
+}
+
+// Send posts a message to the room. Messages are sent as notices, which by
+// convention other bots don't react to.
+func (b *MatrixBot) Send(ctx context.Context, text string) error {
+	b.mu.Lock()
+	roomID := b.roomID
+	if b.txnStart == 0 {
+		b.txnStart = time.Now().UnixNano()
+	}
+	b.txnID++
+	txnID := fmt.Sprintf("yacheck-%d-%d", b.txnStart, b.txnID)
+	b.mu.Unlock()
+	if roomID == "" {
+		return fmt.Errorf("not joined to %s yet", b.Room)
+	}
+	path := "/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + url.PathEscape(txnID)
+	return b.call(ctx, "PUT", path, nil, map[string]string{
+		"msgtype": "m.notice",
+		"body":    text,
+	}, nil)
+}
+
+// Run logs in and answers commands in the room, until the given context is
+// canceled. answer returns the reply to a command (eg. "!at"), or an empty
+// string if it isn't one.
+func (b *MatrixBot) Run(ctx context.Context, answer func(command string) string) {
+	since := ""
+	for ctx.Err() == nil {
+		if err := b.run(ctx, &since, answer); err != nil && ctx.Err() == nil {
+			klog.Errorf("Matrix: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(matrixRetryDelay):
+			}
+		}
+	}
+}
+
+// run logs in (if necessary) and syncs until an error occurs, updating since
+// as it goes.
+func (b *MatrixBot) run(ctx context.Context, since *string, answer func(command string) string) error {
+	b.mu.Lock()
+	loggedIn := b.roomID != ""
+	b.mu.Unlock()
+	if !loggedIn {
+		if err := b.login(ctx); err != nil {
+			return err
+		}
+		klog.Infof("Matrix: joined %s as %s", b.Room, b.userID)
+	}
+	if *since == "" {
+		// Skip the history, which would have us answer old commands.
+		res, err := b.sync(ctx, "", 0)
+		if err != nil {
+			return err
+		}
+		*since = res.NextBatch
+	}
+	for {
+		res, err := b.sync(ctx, *since, matrixSyncTimeout)
+		if err != nil {
+			return err
+		}
+		*since = res.NextBatch
+		b.mu.Lock()
+		userID, roomID := b.userID, b.roomID
+		b.mu.Unlock()
+		for _, ev := range res.Rooms.Join[roomID].Timeline.Events {
+			if ev.Type != "m.room.message" || ev.Sender == userID || ev.Content.MsgType != "m.text" {
+				continue
+			}
+			reply := answer(strings.TrimSpace(ev.Content.Body))
+			if reply == "" {
+				continue
+			}
+			if err := b.Send(ctx, reply); err != nil {
+				klog.Errorf("Matrix: could not answer %s: %v", ev.Sender, err)
+			}
+		}
+	}
+}
+
+// matrixAnswer answers commands sent to the Matrix bot.
+func (s *Service) matrixAnswer(command string) string {
+	if command != "!at" {
+		return ""
+	}
+	presence, err := s.getPresence()
+	if err != nil {
+		klog.Errorf("Matrix: could not get active users: %v", err)
+		return "Sorry, I couldn't find out who's there."
+	}
+	return presence.Summary(s.cfg().SpaceName)
+}
+
+// Summary describes who is present in a sentence, eg. "At FAFO: alice
+// (🔧 fixing the printer), bob and 2 other people."
+func (p *Presence) Summary(space string) string {
+	var names []string
+	for _, u := range p.Users {
+		name := u.Name
+		if status := strings.TrimSpace(u.Emoji + " " + u.Status); status != "" {
+			name += " (" + status + ")"
+		}
+		names = append(names, name)
+	}
+	switch {
+	case len(names) == 0 && p.Anonymous == 0:
+		return fmt.Sprintf("Nobody is at %s.", space)
+	case len(names) == 0 && p.Anonymous == 1:
+		return fmt.Sprintf("1 person is at %s.", space)
+	case len(names) == 0:
+		return fmt.Sprintf("%d people are at %s.", p.Anonymous, space)
+	case p.Anonymous == 1:
+		names = append(names, "1 other person")
+	case p.Anonymous > 1:
+		names = append(names, fmt.Sprintf("%d other people", p.Anonymous))
+	}
+	return fmt.Sprintf("At %s: %s.", space, joinNames(names))
+}
+
+// announcement returns the message announcing a change of presence in the
+// Matrix room, or an empty string if there's nothing to announce.
+func (c presenceChange) announcement(space string) string {
+	describe := func(names []string, anonymous bool) string {
+		if anonymous {
+			if len(names) == 0 {
+				return "Someone"
+			}
+			names = append(names, "someone else")
+		}
+		return joinNames(names)
+	}
+	var sentences []string
+	if who := describe(c.Arrived, c.AnonymousArrived); who != "" {
+		sentences = append(sentences, fmt.Sprintf("%s arrived at %s.", who, space))
+	}
+	if c.Closed {
+		sentences = append(sentences, fmt.Sprintf("Everyone left %s.", space))
+	} else if who := describe(c.Departed, c.AnonymousDeparted); who != "" {
+		sentences = append(sentences, fmt.Sprintf("%s left %s.", who, space))
+	}
+	return strings.Join(sentences, " ")
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPresenceSummary(t *testing.T) {
+	for _, test := range []struct {
+		presence *Presence
+		want     string
+	}{
+		{&Presence{}, "Nobody is at FAFO."},
+		{&Presence{Anonymous: 1}, "1 person is at FAFO."},
+		{&Presence{Anonymous: 3}, "3 people are at FAFO."},
+		{&Presence{Users: []PresentUser{{Name: "alice"}}}, "At FAFO: alice."},
+		{&Presence{Users: []PresentUser{{Name: "alice", Emoji: "🔧", Status: "fixing the printer"}, {Name: "bob"}}, Anonymous: 2}, "At FAFO: alice (🔧 fixing the printer), bob and 2 other people."},
+		{&Presence{Users: []PresentUser{{Name: "alice", Status: "soldering"}}, Anonymous: 1}, "At FAFO: alice (soldering) and 1 other person."},
+	} {
+		if got := test.presence.Summary("FAFO"); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestPresenceAnnouncement(t *testing.T) {
+	empty := &Presence{}
+	alice := &Presence{Users: []PresentUser{{Name: "alice"}}}
+	aliceBob := &Presence{Users: []PresentUser{{Name: "alice"}, {Name: "bob"}}}
+	visibleAlice := &Presence{Users: alice.Users, visibility: map[string]Visibility{"alice": VisibilityVisible}}
+	for _, test := range []struct {
+		name      string
+		prev, cur *Presence
+		want      string
+	}{
+		{"arrival", alice, aliceBob, "bob arrived at FAFO."},
+		{"departure", aliceBob, alice, "bob left FAFO."},
+		{"close", aliceBob, empty, "Everyone left FAFO."},
+		{"swap", alice, &Presence{Users: []PresentUser{{Name: "bob"}}}, "bob arrived at FAFO. alice left FAFO."},
+		{"anonymous arrival", empty, &Presence{Anonymous: 1}, "Someone arrived at FAFO."},
+		{"anonymous departure", &Presence{Users: alice.Users, Anonymous: 1}, alice, "Someone left FAFO."},
+		{"mixed", &Presence{Anonymous: 1}, &Presence{Users: alice.Users, Anonymous: 2}, "alice and someone else arrived at FAFO."},
+		{"status change", alice, &Presence{Users: []PresentUser{{Name: "alice", Status: "hacking"}}}, ""},
+		// Changes of visibility are neither arrivals nor departures.
+		{"visible to count-only", visibleAlice, &Presence{Anonymous: 1, visibility: map[string]Visibility{"alice": VisibilityCountOnly}}, ""},
+		{"visible to hidden", visibleAlice, &Presence{visibility: map[string]Visibility{"alice": VisibilityHidden}}, ""},
+		{"hidden to visible", &Presence{visibility: map[string]Visibility{"alice": VisibilityHidden}}, visibleAlice, ""},
+		{"visibility change and departure", &Presence{Users: aliceBob.Users, visibility: map[string]Visibility{"alice": VisibilityVisible, "bob": VisibilityVisible}}, &Presence{Anonymous: 1, visibility: map[string]Visibility{"alice": VisibilityCountOnly}}, "bob left FAFO."},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := diffPresence(test.prev, test.cur).announcement("FAFO"); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// fakeHomeserver implements the parts of the Matrix client-server API used by
+// MatrixBot. Each sync returns the next batch of events from syncs, after
+// which syncs block until the request is canceled.
+type fakeHomeserver struct {
+	*httptest.Server
+	syncs chan []matrixEvent
+	sent  chan string
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	t.Helper()
+	hs := &fakeHomeserver{
+		syncs: make(chan []matrixEvent, 10),
+		sent:  make(chan string, 10),
+	}
+	authorized := func(f http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, `{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token"}`)
+				return
+			}
+			f(w, r)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_matrix/client/v3/account/whoami", authorized(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"user_id": "@yacheck:example.com"}`)
+	}))
+	mux.HandleFunc("POST /_matrix/client/v3/join/{room}", authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("room") != "#fafo:example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"errcode": "M_NOT_FOUND", "error": "Unknown room"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"room_id": "!fafo:example.com"}`)
+	}))
+	batch := 0
+	mux.HandleFunc("GET /_matrix/client/v3/sync", authorized(func(w http.ResponseWriter, r *http.Request) {
+		if want := fmt.Sprint(batch); batch > 0 && r.URL.Query().Get("since") != want {
+			t.Errorf("sync since %q, want %q", r.URL.Query().Get("since"), want)
+		}
+		var events []matrixEvent
+		select {
+		case events = <-hs.syncs:
+		case <-r.Context().Done():
+			return
+		}
+		batch++
+		var res matrixSync
+		res.NextBatch = fmt.Sprint(batch)
+		res.Rooms.Join = map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		}{}
+		room := res.Rooms.Join["!fafo:example.com"]
+		room.Timeline.Events = events
+		res.Rooms.Join["!fafo:example.com"] = room
+		json.NewEncoder(w).Encode(res)
+	}))
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{room}/send/m.room.message/{txn}", authorized(func(w http.ResponseWriter, r *http.Request) {
+		var content struct {
+			MsgType string `json:"msgtype"`
+			Body    string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil || content.MsgType != "m.notice" || r.PathValue("room") != "!fafo:example.com" {
+			t.Errorf("unexpected message %+v to %s", content, r.PathValue("room"))
+		}
+		hs.sent <- content.Body
+		fmt.Fprintf(w, `{"event_id": "$%s"}`, r.PathValue("txn"))
+	}))
+	hs.Server = httptest.NewServer(mux)
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func matrixMessage(sender, msgType, body string) matrixEvent {
+	ev := matrixEvent{Type: "m.room.message", Sender: sender}
+	ev.Content.MsgType = msgType
+	ev.Content.Body = body
+	return ev
+}
+
+func TestMatrixBot(t *testing.T) {
+	s := newTestService(t)
+	if err := s.Database.ClaimDevice("alice", mustParseMAC("00:11:22:33:44:55"), "laptop", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	s.cfg().SpaceName = "FAFO"
+	hs := newFakeHomeserver(t)
+	s.matrix = &MatrixBot{Homeserver: hs.URL, AccessToken: "secret", Room: "#fafo:example.com"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.matrix.Run(ctx, s.matrixAnswer)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The history of the initial sync is ignored, as are the bot's own
+	// messages and notices of other bots.
+	hs.syncs <- []matrixEvent{matrixMessage("@bob:example.com", "m.text", "!at")}
+	hs.syncs <- []matrixEvent{
+		matrixMessage("@yacheck:example.com", "m.text", "!at"),
+		matrixMessage("@otherbot:example.com", "m.notice", "!at"),
+		matrixMessage("@bob:example.com", "m.text", "hello"),
+		matrixMessage("@bob:example.com", "m.text", " !at\n"),
+	}
+	var got []string
+	select {
+	case msg := <-hs.sent:
+		got = append(got, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no answer")
+	}
+
+	if err := s.matrix.Send(ctx, "bob arrived at FAFO."); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	got = append(got, <-hs.sent)
+	if diff := cmp.Diff([]string{"At FAFO: alice.", "bob arrived at FAFO."}, got); diff != "" {
+		t.Errorf("sent messages: %s", diff)
+	}
+	select {
+	case msg := <-hs.sent:
+		t.Errorf("unexpected message %q", msg)
+	default:
+	}
+}
+
+func TestMatrixBotLogin(t *testing.T) {
+	hs := newFakeHomeserver(t)
+	for _, test := range []struct {
+		bot  *MatrixBot
+		want string
+	}{
+		{&MatrixBot{Homeserver: hs.URL, AccessToken: "wrong", Room: "#fafo:example.com"}, "M_UNKNOWN_TOKEN"},
+		{&MatrixBot{Homeserver: hs.URL, AccessToken: "secret", Room: "#other:example.com"}, "could not join #other:example.com"},
+	} {
+		err := test.bot.login(context.Background())
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got error %v, want %q", err, test.want)
+		}
+		if err := test.bot.Send(context.Background(), "hello"); err == nil {
+			t.Errorf("could send without joining")
+		}
+	}
+}
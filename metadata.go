@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// deviceNameMaxLength and deviceNotesMaxLength limit device metadata set
+	// by users, in characters.
+	deviceNameMaxLength  = 64
+	deviceNotesMaxLength = 500
+)
+
+// DeviceType is the kind of a device, as set by its owner.
+type DeviceType string
+
+const (
+	DeviceTypeUnknown DeviceType = ""
+	DeviceTypeLaptop  DeviceType = "laptop"
+	DeviceTypePhone   DeviceType = "phone"
+	DeviceTypeTablet  DeviceType = "tablet"
+	DeviceTypeDesktop DeviceType = "desktop"
+	DeviceTypeWatch   DeviceType = "watch"
+	DeviceTypeOther   DeviceType = "other"
+)
+
+// deviceTypes are all valid device types, in the order shown to users.
+var deviceTypes = []DeviceType{DeviceTypeUnknown, DeviceTypeLaptop, DeviceTypePhone, DeviceTypeTablet, DeviceTypeDesktop, DeviceTypeWatch, DeviceTypeOther}
+
+// ParseDeviceType parses a device type as stored or submitted in forms.
+func ParseDeviceType(s string) (DeviceType, error) {
+	for _, t := range deviceTypes {
+		if s == string(t) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("invalid device type %q", s)
+}
+
+// DeviceMetadata is information about a device set by its owner, as opposed
+// to information taken from DHCP leases.
+type DeviceMetadata struct {
+	// Name is shown instead of the hostname, if set.
+	Name  string
+	Type  DeviceType
+	Notes string
+}
+
+// Metadata returns the metadata of a device.
+func (d *Device) Metadata() DeviceMetadata {
+	return DeviceMetadata{
+		Name:  d.Name,
+		Type:  d.Type,
+		Notes: d.Notes,
+	}
+}
+
+// DisplayName returns the name of a device as shown to users: its name, if
+// set, or otherwise its hostname or MAC address.
+func (d *Device) DisplayName() string {
+	switch {
+	case d.Name != "":
+		return d.Name
+	case d.Hostname != "":
+		return d.Hostname
+	}
+	return d.MACAddress
+}
+
+// validate checks metadata for invalid values. Errors are user-presentable.
+func (m *DeviceMetadata) validate() error {
+	if n := utf8.RuneCountInString(m.Name); n > deviceNameMaxLength {
+		return fmt.Errorf("Name is too long (%d characters, at most %d allowed).", n, deviceNameMaxLength)
+	}
+	for _, r := range m.Name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("Name must be a single line of text.")
+		}
+	}
+	if _, err := ParseDeviceType(string(m.Type)); err != nil {
+		return fmt.Errorf("Invalid device type.")
+	}
+	if n := utf8.RuneCountInString(m.Notes); n > deviceNotesMaxLength {
+		return fmt.Errorf("Notes are too long (%d characters, at most %d allowed).", n, deviceNotesMaxLength)
+	}
+	for _, r := range m.Notes {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return fmt.Errorf("Notes must be plain text.")
+		}
+	}
+	return nil
+}
+
+// viewDeviceMetadata sets the name, type and notes of one of the user's
+// devices.
+func (s *Service) viewDeviceMetadata(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+
+	device, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	metadata := DeviceMetadata{
+		Name:  strings.TrimSpace(r.PostFormValue("name")),
+		Type:  DeviceType(r.PostFormValue("type")),
+		Notes: strings.TrimSpace(r.PostFormValue("notes")),
+	}
+	if err := metadata.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err := s.Database.SetDeviceMetadata(session.Username, device, metadata); err != nil {
+		fmt.Fprintf(w, "Could not update device: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
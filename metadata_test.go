@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceMetadata(t *testing.T) {
+	s := newTestService(t)
+	for _, mac := range []string{"00:11:22:33:44:55", "00:11:22:33:44:66"} {
+		if err := s.Database.ClaimDevice("alice", mustParseMAC(mac), "stored-"+mac[len(mac)-2:], ""); err != nil {
+			t.Fatalf("could not claim device: %v", err)
+		}
+	}
+	cookies := s.sessionCookies(&Session{Username: "alice", CSRFToken: "token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	post := func(mac string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		form.Set("csrf_token", "token")
+		r := httptest.NewRequest("POST", "/device/"+mac+"/metadata", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("mac", mac)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		s.viewDeviceMetadata(w, r)
+		return w
+	}
+
+	if w := post("00:11:22:33:44:55", url.Values{"name": {" Work laptop "}, "type": {"laptop"}, "notes": {"Stickers on the lid."}}); w.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, form := range []url.Values{
+		{"type": {"toaster"}},
+		{"name": {strings.Repeat("x", deviceNameMaxLength+1)}},
+		{"name": {"two\nlines"}},
+		{"notes": {strings.Repeat("x", deviceNotesMaxLength+1)}},
+	} {
+		if w := post("00:11:22:33:44:55", form); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected bad request, got %d: %s", form, w.Code, w.Body.String())
+		}
+	}
+	if w := post("00:11:22:33:44:77", url.Values{"name": {"not mine"}}); w.Code == http.StatusFound {
+		t.Errorf("could set metadata of unclaimed device")
+	}
+
+	devices, err := s.Database.GetDevicesForUser("alice")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	want := DeviceMetadata{Name: "Work laptop", Type: DeviceTypeLaptop, Notes: "Stickers on the lid."}
+	if got := devices[0].Metadata(); got != want {
+		t.Errorf("metadata: want %+v, got %+v", want, got)
+	}
+
+	// The management page shows the name, and which devices are online
+	// along with their current lease.
+	r := httptest.NewRequest("GET", "/manage", nil)
+	r.RemoteAddr = "10.1.0.99:1234"
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	s.viewManage(w, r)
+	body := w.Body.String()
+	for _, want := range []string{
+		"<b>Work laptop</b> (laptop)",
+		"Hostname: stored-55",
+		"<b>stored-66</b>",
+		"Stickers on the lid.",
+		"<code>10.1.0.23</code><br>laptop",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("management page doesn't contain %q", want)
+		}
+	}
+	if n := strings.Count(body, "Online now"); n != 1 {
+		t.Errorf("expected one online device, got %d", n)
+	}
+}
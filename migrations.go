@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"k8s.io/klog/v2"
+)
+
+var (
+	// Map from metadata key to value.
+	bucketMeta = []byte("meta")
+
+	// Schema version of the database, as a big-endian uint64. Missing in
+	// databases created before schema versioning was introduced, which are
+	// treated as version 0.
+	metaSchemaVersion = []byte("schema_version")
+)
+
+// migration upgrades the database schema by one version.
+type migration struct {
+	description string
+	fn          func(tx *bbolt.Tx) error
+}
+
+// migrations is the ordered list of all schema migrations. migrations[i]
+// upgrades a database from version i to version i+1, so the current schema
+// version is len(migrations). Never modify or remove existing migrations, only
+// append new ones.
+var migrations = []migration{
+	{"create devices and aliases buckets", migrateCreateBuckets},
+	{"backfill last seen time of legacy devices", migrateBackfillLastSeen},
+	{"build user devices index", rebuildUserIndex},
+	{"create users bucket", migrateCreateUsers},
+	{"create equipment bucket", migrateCreateEquipment},
+	{"create check-ins bucket", migrateCreateCheckIns},
+	{"create subscriptions bucket", migrateCreateSubscriptions},
+}
+
+// schemaVersion is the schema version of databases created by this binary.
+func schemaVersion() uint64 {
+	return uint64(len(migrations))
+}
+
+func getSchemaVersion(tx *bbolt.Tx) uint64 {
+	meta := tx.Bucket(bucketMeta)
+	if meta == nil {
+		return 0
+	}
+	v := meta.Get(metaSchemaVersion)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func setSchemaVersion(tx *bbolt.Tx, version uint64) error {
+	meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+	if err != nil {
+		return err
+	}
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], version)
+	return meta.Put(metaSchemaVersion, v[:])
+}
+
+// migrate brings the database schema up to date. If the database contains any
+// data, a backup copy of it is made next to path before any migrations are
+// run. All migrations run in a single transaction, so a failed migration
+// leaves the database untouched.
+func (b *BoltDatabase) migrate(path string) error {
+	var version uint64
+	var empty bool
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		version = getSchemaVersion(tx)
+		k, _ := tx.Cursor().First()
+		empty = k == nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if version == schemaVersion() {
+		return nil
+	}
+	if version > schemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, schemaVersion())
+	}
+
+	if !empty {
+		backup := fmt.Sprintf("%s.v%d.bak", path, version)
+		err := b.db.View(func(tx *bbolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		})
+		if err != nil {
+			return fmt.Errorf("could not back up database: %w", err)
+		}
+		klog.Infof("Backed up database to %s", backup)
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for ; version < schemaVersion(); version++ {
+			m := migrations[version]
+			klog.Infof("Migrating database to version %d: %s...", version+1, m.description)
+			if err := m.fn(tx); err != nil {
+				return fmt.Errorf("migration to version %d failed: %w", version+1, err)
+			}
+		}
+		return setSchemaVersion(tx, version)
+	})
+}
+
+// migrateCreateBuckets creates the devices and aliases buckets, and populates
+// the aliases bucket from any existing devices.
+func migrateCreateBuckets(tx *bbolt.Tx) error {
+	devices, err := tx.CreateBucketIfNotExists(bucketDevices)
+	if err != nil {
+		return err
+	}
+	aliases, err := tx.CreateBucketIfNotExists(bucketAliases)
+	if err != nil {
+		return err
+	}
+	return devices.ForEach(func(k, v []byte) error {
+		var device Device
+		if err := json.Unmarshal(v, &device); err != nil {
+			klog.Warningf("Device %q could not be unmarshaled: %v", k, err)
+			return nil
+		}
+		for _, ak := range device.aliasKeys() {
+			if existing := aliases.Get(ak); existing != nil && string(existing) != device.MACAddress {
+				klog.Warningf("Device %q: %s already belongs to %q, skipping", k, ak, existing)
+				continue
+			}
+			if err := aliases.Put(ak, []byte(device.MACAddress)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateBackfillLastSeen sets the last seen time of devices claimed before
+// claim and last seen times were tracked to the time of migration. Otherwise
+// these devices would never be expired.
+func migrateBackfillLastSeen(tx *bbolt.Tx) error {
+	devices := tx.Bucket(bucketDevices)
+	now := time.Now()
+	updated := make(map[string][]byte)
+	err := devices.ForEach(func(k, v []byte) error {
+		var device Device
+		if err := json.Unmarshal(v, &device); err != nil {
+			klog.Warningf("Device %q could not be unmarshaled: %v", k, err)
+			return nil
+		}
+		if !device.SeenAt().IsZero() {
+			return nil
+		}
+		device.LastSeenAt = now
+		v, err := json.Marshal(&device)
+		if err != nil {
+			return err
+		}
+		updated[string(k)] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updated {
+		if err := devices.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
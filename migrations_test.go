@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// writeFixture creates a bbolt database at path with the given raw bucket
+// contents, emulating a database written by an older version of checkinator.
+func writeFixture(t *testing.T, path string, buckets map[string]map[string]string) {
+	t.Helper()
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("could not create fixture: %v", err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for name, contents := range buckets {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range contents {
+				if err := b.Put([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not write fixture: %v", err)
+	}
+}
+
+func TestMigrateV0(t *testing.T) {
+	// Version 0: devices bucket only, no schema version, no timestamps.
+	path := t.TempDir() + "/db"
+	writeFixture(t, path, map[string]map[string]string{
+		"devices": {
+			"00:01:02:03:04:05": `{"mac_address":"00:01:02:03:04:05","hostname":"stinkpad","user_nickname":"jane"}`,
+		},
+	})
+
+	db, err := NewBoltDatabase(path)
+	if err != nil {
+		t.Fatalf("could not open DB: %v", err)
+	}
+	if _, err := os.Stat(path + ".v0.bak"); err != nil {
+		t.Errorf("expected backup to exist: %v", err)
+	}
+
+	var version uint64
+	db.db.View(func(tx *bbolt.Tx) error {
+		version = getSchemaVersion(tx)
+		return nil
+	})
+	if want := schemaVersion(); version != want {
+		t.Errorf("schema version is %d, wanted %d", version, want)
+	}
+
+	devices, err := db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].Hostname != "stinkpad" {
+		t.Fatalf("expected stinkpad, got %+v", devices)
+	}
+	if devices[0].LastSeenAt.IsZero() {
+		t.Errorf("last seen time should have been backfilled")
+	}
+
+	// Legacy devices can be used normally.
+	if err := db.AddDeviceAddress("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{2, 1, 2, 3, 4, 5}); err != nil {
+		t.Fatalf("could not add address: %v", err)
+	}
+}
+
+func TestMigrateV1(t *testing.T) {
+	// Version 1: devices with additional addresses and aliases, but devices
+	// claimed before timestamps were tracked.
+	path := t.TempDir() + "/db"
+	writeFixture(t, path, map[string]map[string]string{
+		"meta": {
+			"schema_version": "\x00\x00\x00\x00\x00\x00\x00\x01",
+		},
+		"devices": {
+			"00:01:02:03:04:05": `{"mac_address":"00:01:02:03:04:05","additional_mac_addresses":["02:01:02:03:04:05"],"hostname":"stinkpad","user_nickname":"jane"}`,
+		},
+		"aliases": {
+			"mac/02:01:02:03:04:05": "00:01:02:03:04:05",
+		},
+	})
+
+	db, err := NewBoltDatabase(path)
+	if err != nil {
+		t.Fatalf("could not open DB: %v", err)
+	}
+	if _, err := os.Stat(path + ".v1.bak"); err != nil {
+		t.Errorf("expected backup to exist: %v", err)
+	}
+	devices, err := db.GetDevicesForMacAddresses([]net.HardwareAddr{{2, 1, 2, 3, 4, 5}})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].LastSeenAt.IsZero() {
+		t.Fatalf("expected stinkpad with last seen time, got %+v", devices)
+	}
+}
+
+func TestMigrateNew(t *testing.T) {
+	// New databases are not backed up.
+	path := t.TempDir() + "/db"
+	if _, err := NewBoltDatabase(path); err != nil {
+		t.Fatalf("could not create DB: %v", err)
+	}
+	if _, err := os.Stat(path + ".v0.bak"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no backup, got %v", err)
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	path := t.TempDir() + "/db"
+	writeFixture(t, path, map[string]map[string]string{
+		"meta": {
+			"schema_version": "\x00\x00\x00\x00\x00\x00\x10\x00",
+		},
+	})
+	if _, err := NewBoltDatabase(path); err == nil {
+		t.Fatalf("opening a database from the future should fail")
+	}
+}
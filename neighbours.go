@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// neighbourProbeWait is how long to wait after probing addresses before
+// reading the neighbour table. This gives the kernel time to resolve (or fail
+// to resolve) the probed addresses.
+const neighbourProbeWait = 10 * time.Second
+
+// NeighbourProber periodically probes leased addresses on the local network
+// and records which MAC addresses answer, based on the kernel's ARP table.
+// Devices which stop answering are considered gone once their sighting is
+// older than the presence window (see Service.leaseActiveUntil), which detects
+// devices leaving much quicker than DHCP lease renewals.
+type NeighbourProber struct {
+	// Interface is the network interface whose neighbours are considered.
+	Interface string
+	// Interval between probes.
+	Interval time.Duration
+	// Path to the ARP table, /proc/net/arp.
+	Path string
+
+	mu sync.Mutex
+	// seen maps MAC addresses to when they were last seen in the ARP table.
+	seen map[string]time.Time
+	// probed maps IP addresses to when they were last probed (and the ARP
+	// table read afterwards).
+	probed map[string]time.Time
+}
+
+// SeenAt returns when a MAC address was last seen in the neighbour table, or
+// zero if never.
+func (p *NeighbourProber) SeenAt(mac net.HardwareAddr) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seen[mac.String()]
+}
+
+// ProbedAt returns when an IP address was last probed, or zero if never.
+func (p *NeighbourProber) ProbedAt(ip net.IP) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.probed[ip.String()]
+}
+
+// Run probes the addresses returned by targets every Interval, until the
+// given context is canceled.
+func (p *NeighbourProber) Run(ctx context.Context, targets func() []net.IP) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		if err := p.probe(ctx, targets()); err != nil {
+			klog.Errorf("Neighbour probe failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends a datagram to every target, which makes the kernel (re)resolve
+// their MAC addresses, and then records the MAC addresses in the ARP table.
+func (p *NeighbourProber) probe(ctx context.Context, targets []net.IP) error {
+	for _, ip := range targets {
+		if ip.To4() == nil {
+			continue
+		}
+		// The discard port. Nobody needs to listen, this is only about the
+		// ARP exchange before it.
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: 9})
+		if err != nil {
+			klog.V(1).Infof("Could not probe %s: %v", ip, err)
+			continue
+		}
+		conn.Write([]byte{0})
+		conn.Close()
+	}
+	if len(targets) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(neighbourProbeWait):
+		}
+	}
+
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return fmt.Errorf("could not open ARP table: %w", err)
+	}
+	defer f.Close()
+	macs, err := parseARPTable(f, p.Interface)
+	if err != nil {
+		return fmt.Errorf("could not parse ARP table: %w", err)
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.seen == nil {
+		p.seen = make(map[string]time.Time)
+		p.probed = make(map[string]time.Time)
+	}
+	for _, mac := range macs {
+		p.seen[mac.String()] = now
+	}
+	for _, ip := range targets {
+		if ip.To4() != nil {
+			p.probed[ip.String()] = now
+		}
+	}
+	return nil
+}
+
+// atfComplete is the ARP table flag of resolved entries.
+const atfComplete = 0x2
+
+// parseARPTable parses the Linux ARP table (/proc/net/arp), returning the MAC
+// addresses of all resolved entries on the given interface.
+func parseARPTable(r io.Reader, iface string) ([]net.HardwareAddr, error) {
+	var res []net.HardwareAddr
+	scanner := bufio.NewScanner(r)
+	// Skip header.
+	scanner.Scan()
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || fields[5] != iface {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[2], 0, 32)
+		if err != nil || flags&atfComplete == 0 {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			continue
+		}
+		res = append(res, mac)
+	}
+	return res, scanner.Err()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseARPTable(t *testing.T) {
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+10.1.0.23        0x1         0x2         00:11:22:33:44:55     *        eth1
+10.1.0.24        0x1         0x0         00:00:00:00:00:00     *        eth1
+10.1.0.25        0x1         0x6         00:11:22:33:44:77     *        eth1
+192.168.0.1      0x1         0x2         00:11:22:33:44:88     *        eth0
+`
+	macs, err := parseARPTable(strings.NewReader(table), "eth1")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	want := []net.HardwareAddr{mustParseMAC("00:11:22:33:44:55"), mustParseMAC("00:11:22:33:44:77")}
+	if diff := cmp.Diff(want, macs); diff != "" {
+		t.Errorf("macs: %s", diff)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// notifyTimeout is how long delivering a single notification may take.
+const notifyTimeout = 10 * time.Second
+
+// Notification is a message about a change of presence, sent to subscribers.
+type Notification struct {
+	Event   SubscriptionEvent `json:"event"`
+	Title   string            `json:"title"`
+	Message string            `json:"message"`
+	// Users are the users who arrived, if any (and visible).
+	Users []string  `json:"users,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// Notifier delivers notifications over some channel, eg. e-mail.
+type Notifier interface {
+	// CheckTarget validates a target given by a user, eg. an e-mail
+	// address. Errors are user-presentable.
+	CheckTarget(target string) error
+	// Notify sends a notification to a target.
+	Notify(ctx context.Context, target string, n *Notification) error
+}
+
+// notifierChannel is a kind of Notifier, as configured and chosen by users.
+type notifierChannel struct {
+	Name  string
+	Label string
+	// Target describes what users have to enter as target.
+	Target string
+}
+
+// notifierChannels are all notifier channels, in the order shown to users.
+var notifierChannels = []notifierChannel{
+	{"email", "E-mail", "E-mail address"},
+	{"ntfy", "ntfy", "ntfy topic"},
+	{"webhook", "Webhook", "URL"},
+}
+
+// SMTPNotifier sends notifications as e-mails through an SMTP server.
+type SMTPNotifier struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	From string
+	// Username and Password are used for PLAIN authentication, if set.
+	// net/smtp only allows this over TLS or to localhost.
+	Username string
+	Password string
+}
+
+func (sn *SMTPNotifier) CheckTarget(target string) error {
+	addr, err := mail.ParseAddress(target)
+	if err != nil || addr.Address != target {
+		return fmt.Errorf("Invalid e-mail address.")
+	}
+	return nil
+}
+
+func (sn *SMTPNotifier) Notify(ctx context.Context, target string, n *Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", sn.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", target)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mimeHeader(n.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.At.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&msg, "\r\n%s\r\n", n.Message)
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	return sn.send(ctx, target, msg.Bytes())
+}
+
+// send delivers a message like smtp.SendMail, but within the deadline of the
+// given context, so that unresponsive servers can't block notifications.
+func (sn *SMTPNotifier) send(ctx context.Context, to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(sn.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP server address: %w", err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", sn.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// Also give up as soon as the context is canceled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if sn.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP server doesn't support authentication")
+		}
+		if err := c.Auth(smtp.PlainAuth("", sn.Username, sn.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(sn.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// mimeHeader encodes a header value if it isn't plain ASCII.
+func mimeHeader(s string) string {
+	for _, r := range s {
+		if r >= 0x80 || r < 0x20 {
+			return mime.QEncoding.Encode("utf-8", s)
+		}
+	}
+	return s
+}
+
+// NtfyNotifier sends notifications to topics of an ntfy server.
+type NtfyNotifier struct {
+	// Server is the base URL of the ntfy server, eg. https://ntfy.sh.
+	Server string
+}
+
+// ntfyTopic is the format of ntfy topic names.
+var ntfyTopic = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func (nn *NtfyNotifier) CheckTarget(target string) error {
+	if !ntfyTopic.MatchString(target) {
+		return fmt.Errorf("Invalid ntfy topic (letters, digits, - and _ only).")
+	}
+	return nil
+}
+
+func (nn *NtfyNotifier) Notify(ctx context.Context, target string, n *Notification) error {
+	topic := strings.TrimSuffix(nn.Server, "/") + "/" + target
+	return postNotification(ctx, http.DefaultClient, topic, "text/plain", []byte(n.Message), map[string]string{
+		"Title": mimeHeader(n.Title),
+		"Tags":  "door",
+	})
+}
+
+// WebhookNotifier POSTs notifications as JSON to URLs given by users.
+type WebhookNotifier struct {
+	// Client is used for all requests. Defaults to publicHTTPClient, so that
+	// users can't make yacheck reach internal services.
+	Client *http.Client
+}
+
+func (wn *WebhookNotifier) CheckTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook URL.")
+	}
+	return nil
+}
+
+func (wn *WebhookNotifier) Notify(ctx context.Context, target string, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	client := wn.Client
+	if client == nil {
+		client = publicHTTPClient
+	}
+	return postNotification(ctx, client, target, "application/json", body, nil)
+}
+
+// publicHTTPClient is an HTTP client for URLs given by users. It only
+// connects to public addresses (see checkPublicAddr), without any proxy, and
+// doesn't follow redirects, which could point anywhere.
+var publicHTTPClient = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return checkPublicAddr(address)
+		},
+	}).DialContext
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}()
+
+// checkPublicAddr returns an error if a host:port is a loopback, link-local,
+// private, unspecified or multicast address. It's checked right before
+// connecting, after hostnames have been resolved.
+func checkPublicAddr(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// postNotification POSTs a notification body to a URL.
+func postNotification(ctx context.Context, client *http.Client, url, contentType string, body []byte, headers map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
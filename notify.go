@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"k8s.io/klog/v2"
+)
+
+// maxSubscriptions is the maximum number of notification subscriptions per
+// user.
+const maxSubscriptions = 20
+
+// SubscriptionEvent is a change of presence users can subscribe to.
+type SubscriptionEvent string
+
+const (
+	// EventArrival is the arrival of any of a set of users, or of anyone.
+	EventArrival SubscriptionEvent = "arrival"
+	// EventOpen is the first arrival at the empty space.
+	EventOpen SubscriptionEvent = "open"
+	// EventClose is the last departure from the space.
+	EventClose SubscriptionEvent = "close"
+)
+
+// Subscription is a user's request to be notified of presence changes.
+type Subscription struct {
+	ID       string            `json:"id"`
+	Username string            `json:"username"`
+	Event    SubscriptionEvent `json:"event"`
+	// Users are the users whose arrival is notified, for arrival
+	// subscriptions. If empty, anyone's arrival is.
+	Users []string `json:"users,omitempty"`
+	// Channel is the name of the notifier used, see notifierChannels.
+	Channel string `json:"channel"`
+	// Target is where the notifier sends notifications, eg. an e-mail
+	// address.
+	Target string `json:"target"`
+	// QuietStart and QuietEnd are the start and end of daily quiet hours (in
+	// server local time), in minutes after midnight. No notifications are
+	// sent during quiet hours. If equal, there are none.
+	QuietStart int `json:"quiet_start,omitempty"`
+	QuietEnd   int `json:"quiet_end,omitempty"`
+	// MinInterval is the minimum time between two notifications.
+	MinInterval time.Duration `json:"min_interval,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// Map from subscription ID to serialized Subscription.
+var bucketSubscriptions = []byte("subscriptions")
+
+// migrateCreateSubscriptions creates the subscriptions bucket.
+func migrateCreateSubscriptions(tx *bbolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(bucketSubscriptions)
+	return err
+}
+
+func (b *BoltDatabase) GetSubscriptions() ([]*Subscription, error) {
+	var res []*Subscription
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketSubscriptions).ForEach(func(k, v []byte) error {
+			var sub Subscription
+			if err := json.Unmarshal(v, &sub); err != nil {
+				klog.Warningf("Subscription %q could not be unmarshaled: %v", k, err)
+				return nil
+			}
+			res = append(res, &sub)
+			return nil
+		})
+	})
+	sortSubscriptions(res)
+	return res, err
+}
+
+func (b *BoltDatabase) PutSubscription(sub *Subscription) error {
+	v, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketSubscriptions)
+		if existing := bucket.Get([]byte(sub.ID)); existing != nil {
+			var e Subscription
+			if err := json.Unmarshal(existing, &e); err == nil && e.Username != sub.Username {
+				return fmt.Errorf("subscription %s belongs to another user", sub.ID)
+			}
+		}
+		return bucket.Put([]byte(sub.ID), v)
+	})
+}
+
+func (b *BoltDatabase) RemoveSubscription(user, id string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketSubscriptions)
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("no such subscription")
+		}
+		var sub Subscription
+		if err := json.Unmarshal(v, &sub); err != nil {
+			return fmt.Errorf("could not unmarshal subscription: %w", err)
+		}
+		if sub.Username != user {
+			return fmt.Errorf("no such subscription")
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// sortSubscriptions sorts subscriptions by username, then creation time.
+func sortSubscriptions(subs []*Subscription) {
+	sort.SliceStable(subs, func(i, j int) bool {
+		if subs[i].Username != subs[j].Username {
+			return subs[i].Username < subs[j].Username
+		}
+		if !subs[i].CreatedAt.Equal(subs[j].CreatedAt) {
+			return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+		}
+		return subs[i].ID < subs[j].ID
+	})
+}
+
+// quietAt returns true if t is within the subscription's quiet hours.
+func (sub *Subscription) quietAt(t time.Time) bool {
+	if sub.QuietStart == sub.QuietEnd {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if sub.QuietStart < sub.QuietEnd {
+		return m >= sub.QuietStart && m < sub.QuietEnd
+	}
+	// Quiet hours span midnight.
+	return m >= sub.QuietStart || m < sub.QuietEnd
+}
+
+// QuietHours describes the quiet hours of a subscription, or returns an empty
+// string if there are none.
+func (sub *Subscription) QuietHours() string {
+	if sub.QuietStart == sub.QuietEnd {
+		return ""
+	}
+	return formatMinutes(sub.QuietStart) + "–" + formatMinutes(sub.QuietEnd)
+}
+
+func formatMinutes(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// parseMinutes parses a time of day (HH:MM) into minutes after midnight.
+func parseMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// presenceChange is the difference between two Presences relevant to
+// subscriptions.
+type presenceChange struct {
+	// Arrived are the (visible) users who arrived.
+	Arrived []string
+	// AnonymousArrived is true if any count-only users arrived.
+	AnonymousArrived bool
+	// Departed are the (visible) users who left.
+	Departed []string
+	// AnonymousDeparted is true if any count-only users left.
+	AnonymousDeparted bool
+	// Opened and Closed are true if the space was empty before or after,
+	// respectively. Hidden users don't count.
+	Opened bool
+	Closed bool
+}
+
+// diffPresence returns the change from prev to cur. Users who were present all
+// along, but changed their visibility (eg. from visible to count-only), neither
+// arrived nor departed. This is only known if both Presences come from
+// getPresence.
+func diffPresence(prev, cur *Presence) presenceChange {
+	var c presenceChange
+	if prev.visibility != nil && cur.visibility != nil {
+		for _, u := range cur.Users {
+			if _, ok := prev.visibility[u.Name]; !ok {
+				c.Arrived = append(c.Arrived, u.Name)
+			}
+		}
+		for _, u := range prev.Users {
+			if _, ok := cur.visibility[u.Name]; !ok {
+				c.Departed = append(c.Departed, u.Name)
+			}
+		}
+		for name, v := range cur.visibility {
+			if _, ok := prev.visibility[name]; !ok && v == VisibilityCountOnly {
+				c.AnonymousArrived = true
+			}
+		}
+		for name, v := range prev.visibility {
+			if _, ok := cur.visibility[name]; !ok && v == VisibilityCountOnly {
+				c.AnonymousDeparted = true
+			}
+		}
+	} else {
+		was := make(map[string]bool)
+		for _, u := range prev.Users {
+			was[u.Name] = true
+		}
+		for _, u := range cur.Users {
+			if !was[u.Name] {
+				c.Arrived = append(c.Arrived, u.Name)
+			}
+			delete(was, u.Name)
+		}
+		for _, u := range prev.Users {
+			if was[u.Name] {
+				c.Departed = append(c.Departed, u.Name)
+			}
+		}
+		c.AnonymousArrived = cur.Anonymous > prev.Anonymous
+		c.AnonymousDeparted = cur.Anonymous < prev.Anonymous
+	}
+	before := len(prev.Users) + prev.Anonymous
+	after := len(cur.Users) + cur.Anonymous
+	arrived := len(c.Arrived) > 0 || c.AnonymousArrived
+	departed := len(c.Departed) > 0 || c.AnonymousDeparted
+	c.Opened = before == 0 && after > 0 && arrived
+	c.Closed = before > 0 && after == 0 && departed
+	return c
+}
+
+// joinNames formats a list of names for messages, eg. "alice, bob and carol".
+func joinNames(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// notification returns the notification for a subscription about a change of
+// presence, or nil if the subscription isn't interested. Users aren't
+// notified about their own arrival.
+func (sub *Subscription) notification(c presenceChange, space string, now time.Time) *Notification {
+	var arrived []string
+	for _, name := range c.Arrived {
+		if name != sub.Username {
+			arrived = append(arrived, name)
+		}
+	}
+	who := joinNames(arrived)
+	if c.AnonymousArrived {
+		if who == "" {
+			who = "someone"
+		} else {
+			who += " and someone else"
+		}
+	}
+
+	n := &Notification{
+		Event: sub.Event,
+		At:    now,
+	}
+	switch sub.Event {
+	case EventArrival:
+		if len(sub.Users) > 0 {
+			arrived = slices.DeleteFunc(arrived, func(name string) bool {
+				return !slices.Contains(sub.Users, name)
+			})
+			who = joinNames(arrived)
+		}
+		if who == "" {
+			return nil
+		}
+		if who == "someone" {
+			who = "Someone"
+		}
+		n.Users = arrived
+		n.Title = fmt.Sprintf("Arrival at %s", space)
+		n.Message = fmt.Sprintf("%s arrived at %s.", who, space)
+	case EventOpen:
+		if !c.Opened || who == "" {
+			return nil
+		}
+		n.Users = arrived
+		n.Title = fmt.Sprintf("%s is open", space)
+		n.Message = fmt.Sprintf("%s is open, %s arrived.", space, who)
+	case EventClose:
+		if !c.Closed {
+			return nil
+		}
+		n.Title = fmt.Sprintf("%s is empty", space)
+		n.Message = fmt.Sprintf("Everyone left %s.", space)
+	default:
+		return nil
+	}
+	return n
+}
+
+// notificationLimiter enforces the minimum interval between notifications of
+// subscriptions. It's kept in memory only.
+type notificationLimiter struct {
+	mu sync.Mutex
+	// last are the times of the last notification, by subscription ID.
+	last map[string]time.Time
+}
+
+// allow returns true (and records the notification) if a subscription may be
+// notified at now.
+func (l *notificationLimiter) allow(sub *Subscription, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.last[sub.ID]; ok && now.Sub(last) < sub.MinInterval {
+		return false
+	}
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	l.last[sub.ID] = now
+	return true
+}
+
+// notifySubscribers notifies all subscriptions interested in a change of
+// presence, outside of their quiet hours and rate limits.
+func (s *Service) notifySubscribers(ctx context.Context, change presenceChange) {
+	if len(change.Arrived) == 0 && !change.AnonymousArrived && !change.Closed {
+		return
+	}
+	subs, err := s.Database.GetSubscriptions()
+	if err != nil {
+		klog.Errorf("Notifications: could not get subscriptions: %v", err)
+		return
+	}
+	rc := s.cfg()
+	now := s.timeNow()
+	for _, sub := range subs {
+		n := sub.notification(change, rc.SpaceName, now)
+		if n == nil || sub.quietAt(now) || !s.notified.allow(sub, now) {
+			continue
+		}
+		notifier := rc.Notifiers[sub.Channel]
+		if notifier == nil {
+			klog.Warningf("Notifications: %s is not configured, not notifying %s", sub.Channel, sub.Username)
+			continue
+		}
+		if err := notifier.Notify(ctx, sub.Target, n); err != nil {
+			klog.Errorf("Notifications: could not notify %s via %s: %v", sub.Username, sub.Channel, err)
+		}
+	}
+}
+
+// subscriptionIntervals are the minimum intervals between notifications
+// users can choose from.
+var subscriptionIntervals = []time.Duration{0, 15 * time.Minute, time.Hour, 4 * time.Hour, 24 * time.Hour}
+
+// formatInterval describes a minimum interval between notifications.
+func formatInterval(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "no limit"
+	case d%(24*time.Hour) == 0:
+		return pluralize(int(d/(24*time.Hour)), "day")
+	case d%time.Hour == 0:
+		return pluralize(int(d/time.Hour), "hour")
+	}
+	return pluralize(int(d/time.Minute), "minute")
+}
+
+func pluralize(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// parseSubscription builds a subscription from a submitted form. Errors are
+// user-presentable.
+func (s *Service) parseSubscription(r *http.Request, user string) (*Subscription, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate subscription ID.")
+	}
+	sub := &Subscription{
+		ID:        id,
+		Username:  user,
+		Event:     SubscriptionEvent(r.PostFormValue("event")),
+		Channel:   r.PostFormValue("channel"),
+		Target:    strings.TrimSpace(r.PostFormValue("target")),
+		CreatedAt: s.timeNow(),
+	}
+	switch sub.Event {
+	case EventArrival:
+		sub.Users = strings.FieldsFunc(r.PostFormValue("users"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		if len(sub.Users) > maxSubscriptions {
+			return nil, fmt.Errorf("Too many users.")
+		}
+	case EventOpen, EventClose:
+	default:
+		return nil, fmt.Errorf("Invalid event.")
+	}
+
+	notifier := s.cfg().Notifiers[sub.Channel]
+	if notifier == nil {
+		return nil, fmt.Errorf("Invalid or unavailable notification channel.")
+	}
+	if err := notifier.CheckTarget(sub.Target); err != nil {
+		return nil, err
+	}
+
+	if v := r.PostFormValue("quiet_start"); v != "" {
+		if sub.QuietStart, err = parseMinutes(v); err != nil {
+			return nil, fmt.Errorf("Invalid start of quiet hours.")
+		}
+	}
+	if v := r.PostFormValue("quiet_end"); v != "" {
+		if sub.QuietEnd, err = parseMinutes(v); err != nil {
+			return nil, fmt.Errorf("Invalid end of quiet hours.")
+		}
+	}
+
+	interval, err := time.ParseDuration(r.PostFormValue("min_interval"))
+	if err != nil || !slices.Contains(subscriptionIntervals, interval) {
+		return nil, fmt.Errorf("Invalid notification interval.")
+	}
+	sub.MinInterval = interval
+	return sub, nil
+}
+
+// userSubscriptions returns the subscriptions of a user.
+func (s *Service) userSubscriptions(user string) ([]*Subscription, error) {
+	subs, err := s.Database.GetSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(subs, func(sub *Subscription) bool {
+		return sub.Username != user
+	}), nil
+}
+
+// viewNotifications shows the user's notification subscriptions and allows
+// adding new ones.
+func (s *Service) viewNotifications(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	subs, err := s.userSubscriptions(session.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get your subscriptions: %v", err)
+		return
+	}
+
+	rc := s.cfg()
+	var channels []notifierChannel
+	for _, c := range notifierChannels {
+		if rc.Notifiers[c.Name] != nil {
+			channels = append(channels, c)
+		}
+	}
+	token := s.csrfToken(w, session)
+	templateNotifications.Execute(w, map[string]any{
+		"Username":      session.Username,
+		"CSRFToken":     token,
+		"Subscriptions": subs,
+		"Channels":      channels,
+		"Intervals":     subscriptionIntervals,
+		"SpaceName":     rc.SpaceName,
+	})
+}
+
+// viewNotificationsAdd adds a notification subscription for the user.
+func (s *Service) viewNotificationsAdd(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	subs, err := s.userSubscriptions(session.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get your subscriptions: %v", err)
+		return
+	}
+	if len(subs) >= maxSubscriptions {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "You can't have more than %d subscriptions.", maxSubscriptions)
+		return
+	}
+	sub, err := s.parseSubscription(r, session.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err := s.Database.PutSubscription(sub); err != nil {
+		fmt.Fprintf(w, "Could not subscribe: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
+
+// viewNotificationsRemove removes one of the user's subscriptions.
+func (s *Service) viewNotificationsRemove(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	if err := s.Database.RemoveSubscription(session.Username, r.PathValue("id")); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not unsubscribe: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
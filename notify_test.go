@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSubscriptionNotification(t *testing.T) {
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	empty := &Presence{}
+	alice := &Presence{Users: []PresentUser{{Name: "alice"}}}
+	aliceBob := &Presence{Users: []PresentUser{{Name: "alice"}, {Name: "bob"}}}
+	anonymous := &Presence{Anonymous: 1}
+
+	for _, test := range []struct {
+		name      string
+		sub       Subscription
+		prev, cur *Presence
+		want      string
+	}{
+		{"arrival of anyone", Subscription{Event: EventArrival}, alice, aliceBob, "bob arrived at FAFO."},
+		{"arrival of several", Subscription{Event: EventArrival}, empty, aliceBob, "alice and bob arrived at FAFO."},
+		{"anonymous arrival", Subscription{Event: EventArrival}, alice, &Presence{Users: alice.Users, Anonymous: 1}, "Someone arrived at FAFO."},
+		{"arrival of selected", Subscription{Event: EventArrival, Users: []string{"bob"}}, empty, aliceBob, "bob arrived at FAFO."},
+		{"arrival of others", Subscription{Event: EventArrival, Users: []string{"carol"}}, empty, aliceBob, ""},
+		{"selected ignores anonymous", Subscription{Event: EventArrival, Users: []string{"carol"}}, empty, anonymous, ""},
+		{"own arrival", Subscription{Username: "alice", Event: EventArrival}, empty, alice, ""},
+		{"departure", Subscription{Event: EventArrival}, aliceBob, alice, ""},
+		{"open", Subscription{Event: EventOpen}, empty, aliceBob, "FAFO is open, alice and bob arrived."},
+		{"open by anonymous", Subscription{Event: EventOpen}, empty, anonymous, "FAFO is open, someone arrived."},
+		{"open by self", Subscription{Username: "alice", Event: EventOpen}, empty, alice, ""},
+		{"already open", Subscription{Event: EventOpen}, alice, aliceBob, ""},
+		{"close", Subscription{Event: EventClose}, aliceBob, empty, "Everyone left FAFO."},
+		{"not closed", Subscription{Event: EventClose}, aliceBob, anonymous, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			n := test.sub.notification(diffPresence(test.prev, test.cur), "FAFO", now)
+			got := ""
+			if n != nil {
+				got = n.Message
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, time.Local)
+	}
+	night := &Subscription{QuietStart: 22 * 60, QuietEnd: 7 * 60}
+	lunch := &Subscription{QuietStart: 12 * 60, QuietEnd: 13*60 + 30}
+	for _, test := range []struct {
+		sub  *Subscription
+		at   time.Time
+		want bool
+	}{
+		{night, at(23, 0), true},
+		{night, at(3, 0), true},
+		{night, at(7, 0), false},
+		{night, at(21, 59), false},
+		{lunch, at(12, 0), true},
+		{lunch, at(13, 29), true},
+		{lunch, at(13, 30), false},
+		{&Subscription{}, at(3, 0), false},
+	} {
+		if got := test.sub.quietAt(test.at); got != test.want {
+			t.Errorf("%s at %s: got %v, want %v", test.sub.QuietHours(), test.at.Format("15:04"), got, test.want)
+		}
+	}
+}
+
+// fakeSMTPServer runs a minimal SMTP server accepting all mail, returning its
+// address and a channel of received messages.
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				io.WriteString(conn, "220 localhost ESMTP\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+					case "EHLO":
+						io.WriteString(conn, "250-localhost\r\n250 8BITMIME\r\n")
+					case "DATA":
+						io.WriteString(conn, "354 Go ahead\r\n")
+						var msg strings.Builder
+						for {
+							line, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if line == ".\r\n" {
+								break
+							}
+							msg.WriteString(line)
+						}
+						messages <- msg.String()
+						io.WriteString(conn, "250 OK\r\n")
+					case "QUIT":
+						io.WriteString(conn, "221 Bye\r\n")
+						return
+					default:
+						io.WriteString(conn, "250 OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	// A server which accepts connections, but never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	sn := &SMTPNotifier{Addr: l.Addr().String(), From: "yacheck@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sn.Notify(ctx, "jane@example.com", &Notification{Title: "FAFO is open"}); err == nil {
+		t.Errorf("notified unresponsive server")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("gave up after %v", d)
+	}
+}
+
+func TestNotifySubscribers(t *testing.T) {
+	s := newTestService(t)
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return now }
+
+	smtpAddr, mails := fakeSMTPServer(t)
+	type request struct {
+		Path  string
+		Title string
+		Body  string
+	}
+	requests := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.URL.Path, r.Header.Get("Title"), string(body)}
+	}))
+	defer srv.Close()
+
+	s.cfg().SpaceName = "FAFO"
+	s.cfg().Notifiers = map[string]Notifier{
+		"email":   &SMTPNotifier{Addr: smtpAddr, From: "yacheck@example.com"},
+		"ntfy":    &NtfyNotifier{Server: srv.URL},
+		"webhook": &WebhookNotifier{Client: srv.Client()},
+	}
+	for _, sub := range []*Subscription{
+		{ID: "1", Username: "jane", Event: EventArrival, Users: []string{"alice"}, Channel: "email", Target: "jane@example.com", MinInterval: time.Hour},
+		{ID: "2", Username: "joe", Event: EventOpen, Channel: "ntfy", Target: "joe-fafo"},
+		{ID: "3", Username: "jim", Event: EventClose, Channel: "webhook", Target: srv.URL + "/hook"},
+		// Quiet at 18:00.
+		{ID: "4", Username: "jen", Event: EventArrival, Channel: "ntfy", Target: "jen", QuietStart: 17 * 60, QuietEnd: 19 * 60},
+	} {
+		if err := s.Database.PutSubscription(sub); err != nil {
+			t.Fatalf("could not subscribe: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	empty := &Presence{}
+	alice := &Presence{Users: []PresentUser{{Name: "alice"}}}
+	s.notifySubscribers(ctx, diffPresence(empty, alice))
+
+	select {
+	case mail := <-mails:
+		for _, want := range []string{"To: jane@example.com\r\n", "Subject: Arrival at FAFO\r\n", "\r\n\r\nalice arrived at FAFO.\r\n"} {
+			if !strings.Contains(mail, want) {
+				t.Errorf("mail doesn't contain %q: %s", want, mail)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no mail received")
+	}
+	if diff := cmp.Diff(request{"/joe-fafo", "FAFO is open", "FAFO is open, alice arrived."}, <-requests); diff != "" {
+		t.Errorf("ntfy request: %s", diff)
+	}
+
+	s.notifySubscribers(ctx, diffPresence(alice, empty))
+	req := <-requests
+	var n Notification
+	if err := json.Unmarshal([]byte(req.Body), &n); err != nil {
+		t.Fatalf("could not unmarshal webhook: %v", err)
+	}
+	if req.Path != "/hook" || n.Event != EventClose || n.Message != "Everyone left FAFO." {
+		t.Errorf("unexpected webhook request %+v", req)
+	}
+
+	// Jane's subscription is rate limited.
+	now = now.Add(30 * time.Minute)
+	s.notifySubscribers(ctx, diffPresence(empty, alice))
+	<-requests // joe
+	select {
+	case mail := <-mails:
+		t.Errorf("rate limited subscription notified: %s", mail)
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case req := <-requests:
+		t.Errorf("unexpected request %+v", req)
+	default:
+	}
+}
+
+func TestWebhookNotifierPublicOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL)
+	}))
+	defer srv.Close()
+	n := &Notification{Event: EventOpen, Message: "FAFO is open."}
+	if err := (&WebhookNotifier{}).Notify(context.Background(), srv.URL+"/hook", n); err == nil || !strings.Contains(err.Error(), "non-public address") {
+		t.Errorf("got error %v, want refusal to connect", err)
+	}
+
+	for _, test := range []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.0.23:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"[fd00::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"[::]:80", false},
+		{"224.0.0.1:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+	} {
+		if err := checkPublicAddr(test.addr); (err == nil) != test.public {
+			t.Errorf("%s: got error %v, want public %v", test.addr, err, test.public)
+		}
+	}
+
+	redirect := httptest.NewServer(http.RedirectHandler("http://127.0.0.1/", http.StatusFound))
+	defer redirect.Close()
+	client := *publicHTTPClient
+	client.Transport = nil
+	if err := (&WebhookNotifier{Client: &client}).Notify(context.Background(), redirect.URL, n); err == nil || !strings.Contains(err.Error(), "302") {
+		t.Errorf("got error %v, want unfollowed redirect", err)
+	}
+}
+
+func TestNotificationsPage(t *testing.T) {
+	s := newTestService(t)
+	s.cfg().Notifiers = map[string]Notifier{"email": &SMTPNotifier{Addr: "localhost:25", From: "yacheck@example.com"}}
+	cookies := s.sessionCookies(&Session{Username: "jane", CSRFToken: "token", ExpiresAt: time.Now().Add(time.Hour)})
+	request := func(method, path string, form url.Values, view http.HandlerFunc) *httptest.ResponseRecorder {
+		t.Helper()
+		form.Set("csrf_token", "token")
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if parts := strings.Split(path, "/"); len(parts) > 2 {
+			r.SetPathValue("id", parts[2])
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		view(w, r)
+		return w
+	}
+
+	valid := url.Values{"event": {"arrival"}, "users": {"alice, bob"}, "channel": {"email"}, "target": {"jane@example.com"}, "quiet_start": {"22:00"}, "quiet_end": {"07:00"}, "min_interval": {"15m0s"}}
+	if w := request("POST", "/notifications", valid, s.viewNotificationsAdd); w.Code != http.StatusFound {
+		t.Fatalf("subscribe: got %d: %s", w.Code, w.Body.String())
+	}
+	for name, change := range map[string]url.Values{
+		"event":        {"event": {"leave"}},
+		"channel":      {"channel": {"ntfy"}},
+		"target":       {"target": {"jane"}},
+		"quiet hours":  {"quiet_start": {"25:00"}},
+		"min interval": {"min_interval": {"1s"}},
+	} {
+		form := url.Values{}
+		for k, v := range valid {
+			form[k] = v
+		}
+		for k, v := range change {
+			form[k] = v
+		}
+		if w := request("POST", "/notifications", form, s.viewNotificationsAdd); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid %s: got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+
+	subs, err := s.Database.GetSubscriptions()
+	if err != nil {
+		t.Fatalf("could not get subscriptions: %v", err)
+	}
+	if len(subs) != 1 {
+		t.Fatalf("expected one subscription, got %d", len(subs))
+	}
+	sub := subs[0]
+	if diff := cmp.Diff([]string{"alice", "bob"}, sub.Users); diff != "" {
+		t.Errorf("users: %s", diff)
+	}
+	if sub.QuietHours() != "22:00–07:00" || sub.MinInterval != 15*time.Minute {
+		t.Errorf("unexpected subscription %+v", sub)
+	}
+
+	body := request("GET", "/notifications", url.Values{}, s.viewNotifications).Body.String()
+	for _, want := range []string{"alice, bob arrives", "<code>jane@example.com</code>", "22:00–07:00", "15 minutes", `<option value="email">E-mail</option>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page doesn't contain %q", want)
+		}
+	}
+	if strings.Contains(body, `value="ntfy"`) {
+		t.Errorf("unconfigured channel offered")
+	}
+
+	if w := request("POST", "/notifications/"+sub.ID+"/remove", url.Values{}, s.viewNotificationsRemove); w.Code != http.StatusFound {
+		t.Fatalf("unsubscribe: got %d: %s", w.Code, w.Body.String())
+	}
+	if subs, _ := s.Database.GetSubscriptions(); len(subs) != 0 {
+		t.Errorf("subscription not removed: %+v", subs)
+	}
+}
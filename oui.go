@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ouiDatabase maps IEEE OUIs (MAC address prefixes) to vendors, one per line
+// as hex prefix and vendor name separated by a tab. It's generated from the
+// IEEE MA-L registry by `yacheck oui generate`, see generateOUIDatabase. Run
+// `go generate` to download the registry and regenerate it.
+//
+//go:embed oui.txt
+var ouiDatabase string
+
+//go:generate sh -c "curl -fsSL -o oui.csv https://standards-oui.ieee.org/oui/oui.csv && go run . oui generate -in oui.csv -out oui.txt"
+
+var (
+	ouiOnce    sync.Once
+	ouiVendors map[uint32]string
+)
+
+// macVendor returns the vendor of the device with a given MAC address, or an
+// empty string if it's unknown. Locally administered (randomized) addresses
+// never have a vendor.
+func macVendor(mac net.HardwareAddr) string {
+	if len(mac) < 3 || isLocallyAdministered(mac) {
+		return ""
+	}
+	ouiOnce.Do(func() {
+		ouiVendors = parseOUIDatabase(ouiDatabase)
+	})
+	return ouiVendors[uint32(mac[0])<<16|uint32(mac[1])<<8|uint32(mac[2])]
+}
+
+// generateOUIDatabase converts the IEEE MA-L registry in CSV format (oui.csv,
+// as published at https://standards-oui.ieee.org/oui/oui.csv) into the format
+// of ouiDatabase, returning the number of entries written. Entries of other
+// registries (MA-M, MA-S), which assign longer prefixes, are skipped.
+func generateOUIDatabase(r io.Reader, w io.Writer) (int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 4
+	header, err := cr.Read()
+	if err != nil {
+		return 0, fmt.Errorf("could not read header: %w", err)
+	}
+	if header[0] != "Registry" || header[1] != "Assignment" || header[2] != "Organization Name" {
+		return 0, fmt.Errorf("unexpected header %q, is this the IEEE oui.csv?", header)
+	}
+
+	vendors := make(map[string]string)
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not read record: %w", err)
+		}
+		if record[0] != "MA-L" {
+			continue
+		}
+		prefix := strings.ToUpper(record[1])
+		if _, err := strconv.ParseUint(prefix, 16, 32); err != nil || len(prefix) != 6 {
+			return 0, fmt.Errorf("invalid assignment %q", record[1])
+		}
+		// Names sometimes contain line breaks or runs of spaces.
+		vendors[prefix] = strings.Join(strings.Fields(record[2]), " ")
+	}
+
+	if len(vendors) == 0 {
+		return 0, fmt.Errorf("no MA-L assignments found")
+	}
+
+	prefixes := make([]string, 0, len(vendors))
+	for prefix := range vendors {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	bw := bufio.NewWriter(w)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(bw, "%s\t%s\n", prefix, vendors[prefix])
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(prefixes), nil
+}
+
+// parseOUIDatabase parses the format of ouiDatabase, skipping invalid lines.
+func parseOUIDatabase(s string) map[uint32]string {
+	res := make(map[uint32]string)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		prefix, vendor, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok || len(prefix) != 6 {
+			continue
+		}
+		oui, err := strconv.ParseUint(prefix, 16, 32)
+		if err != nil {
+			continue
+		}
+		res[uint32(oui)] = vendor
+	}
+	return res
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMACVendor(t *testing.T) {
+	for _, test := range []struct {
+		mac  string
+		want string
+	}{
+		{"b8:27:eb:12:34:56", "Raspberry Pi Foundation"},
+		{"00:50:56:00:00:01", "VMware, Inc."},
+		{"00:00:00:00:00:01", ""},
+		// Locally administered.
+		{"ba:27:eb:12:34:56", ""},
+	} {
+		if got := macVendor(mustParseMAC(test.mac)); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.mac, got, test.want)
+		}
+	}
+}
+
+func TestGenerateOUIDatabase(t *testing.T) {
+	csv := `Registry,Assignment,Organization Name,Organization Address
+MA-L,B827EB,Raspberry Pi Foundation,Mitchell Wood House Caldecote Cambridgeshire US CB23 7NU 
+MA-M,70B3D5F,Some  Company,Somewhere
+MA-L,000393,"Apple,  Inc.",1 Infinite Loop Cupertino CA US 95014 
+MA-L,00000c,Cisco Systems  Inc,170 West Tasman Drive San Jose CA US 95134 
+`
+	var out strings.Builder
+	n, err := generateOUIDatabase(strings.NewReader(csv), &out)
+	if err != nil {
+		t.Fatalf("could not generate database: %v", err)
+	}
+	want := "00000C\tCisco Systems Inc\n000393\tApple, Inc.\nB827EB\tRaspberry Pi Foundation\n"
+	if n != 3 || out.String() != want {
+		t.Errorf("got %d entries:\n%s\nwant:\n%s", n, out.String(), want)
+	}
+	vendors := parseOUIDatabase(out.String())
+	if got := vendors[0x000393]; got != "Apple, Inc." {
+		t.Errorf("parsed vendor: got %q", got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"MAC,Vendor\n",
+		"Registry,Assignment,Organization Name,Organization Address\n",
+		"Registry,Assignment,Organization Name,Organization Address\nMA-L,XYZ,Foo,Bar\n",
+	} {
+		if _, err := generateOUIDatabase(strings.NewReader(invalid), io.Discard); err == nil {
+			t.Errorf("%q: expected error", invalid)
+		}
+	}
+}
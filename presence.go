@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// runPresenceChanges periodically checks the list of present users, which
+// also keeps presenceTracker up to date. Whenever the list changes, it POSTs it
+// to all configured webhooks, notifies subscribers and announces the change in
+// the Matrix room. It runs until the given context is canceled.
+func (s *Service) runPresenceChanges(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	var last *Presence
+	for {
+		presence, err := s.getPresence()
+		if err != nil {
+			klog.Errorf("Could not get active users: %v", err)
+		} else {
+			// Don't notify on startup, as nothing changed as far as we
+			// know.
+			if last != nil && !presence.Equal(last) {
+				s.presenceChanged(ctx, last, presence)
+			}
+			last = presence
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// presenceChanged tells everyone interested about a change of presence.
+func (s *Service) presenceChanged(ctx context.Context, prev, cur *Presence) {
+	rc := s.cfg()
+	for _, url := range rc.Webhooks {
+		if err := postWebhook(ctx, url, cur); err != nil {
+			klog.Errorf("Webhook %s failed: %v", url, err)
+		}
+	}
+	change := diffPresence(prev, cur)
+	s.notifySubscribers(ctx, change)
+	if s.matrix != nil && s.matrix.Announce {
+		if msg := change.announcement(rc.SpaceName); msg != "" {
+			if err := s.matrix.Send(ctx, msg); err != nil {
+				klog.Errorf("Matrix: could not announce: %v", err)
+			}
+		}
+	}
+}
+
+// Presence is who is currently at the space, as shown to others.
+type Presence struct {
+	// Users are the visible present users, sorted by name.
+	Users []PresentUser
+	// Anonymous is the number of present users who only want to be counted.
+	Anonymous int
+	// visibility is the visibility of every present user, including hidden
+	// ones. It's only used to tell changes of visibility from arrivals and
+	// departures (see diffPresence), and never shown to anyone.
+	visibility map[string]Visibility
+}
+
+// PresentUser is a visible present user.
+type PresentUser struct {
+	Name string
+	// Manual is true if the user is only present because they checked in
+	// manually, without any of their devices being present.
+	Manual bool
+	// Status and Emoji are the user's status message, if any.
+	Status string
+	Emoji  string
+	// ArrivedAt is when the user arrived (or checked in).
+	ArrivedAt time.Time
+	// Devices is the number of the user's devices currently present.
+	Devices int
+}
+
+// Equal returns true if both presences are the same, as shown to others.
+func (p *Presence) Equal(o *Presence) bool {
+	return slices.Equal(p.Users, o.Users) && p.Anonymous == o.Anonymous
+}
+
+// JSON returns the presence as served by /api.json.
+func (p *Presence) JSON() *JSONTop {
+	res := JSONTop{
+		Users:     make([]JSONUser, 0, len(p.Users)),
+		Anonymous: p.Anonymous,
+	}
+	for _, user := range p.Users {
+		res.Users = append(res.Users, JSONUser{
+			Login:  user.Name,
+			Manual: user.Manual,
+			Status: user.Status,
+			Emoji:  user.Emoji,
+		})
+	}
+	return &res
+}
+
+// presenceTracker debounces device-based presence of users, so that devices
+// briefly dropping off the network don't make users flap. A user is only
+// considered arrived once their devices have been present for the arrival
+// delay, and departed once their leases have been expired (or gone) for the
+// departure delay.
+//
+// The tracker is updated whenever presence is computed, which happens at least
+// every minute (see runPresenceChanges), so the UI, the API, webhooks,
+// notifications and the Matrix bot all see the same state.
+type presenceTracker struct {
+	mu    sync.Mutex
+	users map[string]*trackedUser
+	// present are the users present (after debouncing, or checked in) as of
+	// the last call to departures.
+	present map[string]bool
+}
+
+// trackedUser is the debouncing state of a user with present devices, or
+// whose devices have recently left.
+type trackedUser struct {
+	// since is when the user's devices appeared.
+	since time.Time
+	// lastSeen is when any of the user's devices was last seen present.
+	lastSeen time.Time
+	// expires is when the last lease of the user's devices expires, as of
+	// lastSeen.
+	expires time.Time
+	// visibility is the user's visibility as of lastSeen.
+	visibility Visibility
+	// left is when the user's devices left, if they were noticed to be gone.
+	left time.Time
+}
+
+// leftAt returns when the user's devices left, or zero if they might still be
+// present.
+func (u *trackedUser) leftAt(now time.Time) time.Time {
+	if u.left.IsZero() && u.expires.Before(now) {
+		return u.expires
+	}
+	return u.left
+}
+
+// seenUser is a user with present devices.
+type seenUser struct {
+	visibility Visibility
+	// expires is when the last lease of the user's devices expires.
+	expires time.Time
+}
+
+// update records the users whose devices are present at now and returns the
+// state of users considered present after debouncing.
+func (t *presenceTracker) update(seen map[string]seenUser, now time.Time, arrival, departure time.Duration) map[string]trackedUser {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.users == nil {
+		t.users = make(map[string]*trackedUser)
+	}
+
+	for user, su := range seen {
+		u, ok := t.users[user]
+		// Users gone for longer than the departure delay are new arrivals,
+		// even if no update happened in the meantime to forget them.
+		if ok {
+			if left := u.leftAt(now); !left.IsZero() && now.Sub(left) >= departure {
+				ok = false
+			}
+		}
+		if !ok {
+			u = &trackedUser{since: now}
+			t.users[user] = u
+		}
+		// Concurrent updates might come in slightly out of order.
+		if !now.Before(u.lastSeen) {
+			u.lastSeen = now
+			u.expires = su.expires
+			u.visibility = su.visibility
+			u.left = time.Time{}
+		}
+	}
+
+	res := make(map[string]trackedUser)
+	for user, u := range t.users {
+		if _, ok := seen[user]; !ok && u.left.IsZero() {
+			// Leases which vanished before expiring (eg. were released)
+			// are gone since they were last seen.
+			u.left = u.lastSeen
+			if u.expires.Before(now) {
+				u.left = u.expires
+			}
+		}
+		if !u.left.IsZero() && now.Sub(u.left) >= departure {
+			delete(t.users, user)
+			continue
+		}
+		// Users who left before arriving are never shown.
+		if u.lastSeen.Sub(u.since) >= arrival {
+			res[user] = *u
+		}
+	}
+	return res
+}
+
+// departures records the users currently present (after debouncing, or checked
+// in) and returns those who were present at the last call, but no longer are.
+// Nobody departs on the first call, as nobody was known to be present before.
+func (t *presenceTracker) departures(present map[string]bool) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res []string
+	for user := range t.present {
+		if !present[user] {
+			res = append(res, user)
+		}
+	}
+	t.present = present
+	sort.Strings(res)
+	return res
+}
+
+// getPresence returns who is currently at the space, based on active leases
+// (other than those of equipment) and manual check-ins, respecting device and
+// user visibility. A user with multiple present devices is shown as visibly as
+// the most visible of them. Device presence is debounced according to the
+// arrival and departure delays, while manual check-ins take effect
+// immediately and use the user's visibility.
+func (s *Service) getPresence() (*Presence, error) {
+	rc := s.cfg()
+	leases, err := rc.Leases.Leases()
+	if err != nil {
+		return nil, fmt.Errorf("could not get leases: %w", err)
+	}
+	equipment, err := s.Database.GetEquipment()
+	if err != nil {
+		return nil, fmt.Errorf("could not get equipment: %w", err)
+	}
+	isEquipment := make(map[string]bool)
+	for _, e := range equipment {
+		isEquipment[e.MACAddress] = true
+	}
+
+	now := s.timeNow()
+	var active []*Lease
+	for _, lease := range leases {
+		if !s.leaseActiveUntil(lease).After(now) {
+			continue
+		}
+		// Equipment could still match a device by client ID or hostname.
+		if isEquipment[lease.MACAddress.String()] {
+			continue
+		}
+		active = append(active, lease)
+	}
+
+	devices, err := s.Database.GetDevicesForLeases(active)
+	if err != nil {
+		return nil, fmt.Errorf("could not get devices: %w", err)
+	}
+	checkIns, err := s.Database.GetCheckIns(now)
+	if err != nil {
+		return nil, fmt.Errorf("could not get check-ins: %w", err)
+	}
+
+	users := make(map[string]*User)
+	getUser := func(name string) (*User, error) {
+		if user, ok := users[name]; ok {
+			return user, nil
+		}
+		user, err := s.Database.GetUser(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not get user: %w", err)
+		}
+		users[name] = user
+		return user, nil
+	}
+
+	seen := make(map[string]seenUser)
+	count := make(map[string]int)
+	for _, device := range devices {
+		user, err := getUser(device.UserNickname)
+		if err != nil {
+			return nil, err
+		}
+		v := effectiveVisibility(device, user)
+		// Hidden devices aren't revealed by the device count either.
+		if v != VisibilityHidden {
+			count[device.UserNickname]++
+		}
+		su, ok := seen[device.UserNickname]
+		if !ok || v.rank() > su.visibility.rank() {
+			su.visibility = v
+		}
+		for _, lease := range active {
+			if until := s.leaseActiveUntil(lease); leaseMatches(device, lease) && until.After(su.expires) {
+				su.expires = until
+			}
+		}
+		seen[device.UserNickname] = su
+	}
+	visibility := make(map[string]Visibility)
+	arrived := make(map[string]time.Time)
+	for user, u := range s.presence.update(seen, now, rc.ArrivalDelay, rc.DepartureDelay) {
+		visibility[user] = u.visibility
+		arrived[user] = u.since
+	}
+	manual := make(map[string]bool)
+	for _, c := range checkIns {
+		if _, ok := visibility[c.Username]; ok {
+			// Present by device anyway.
+			continue
+		}
+		user, err := getUser(c.Username)
+		if err != nil {
+			return nil, err
+		}
+		visibility[c.Username] = effectiveVisibility(&Device{}, user)
+		arrived[c.Username] = c.CheckedInAt
+		manual[c.Username] = true
+	}
+
+	present := make(map[string]bool)
+	for name := range visibility {
+		present[name] = true
+	}
+	for _, name := range s.presence.departures(present) {
+		user, err := getUser(name)
+		if err != nil {
+			return nil, err
+		}
+		if user.Status == nil || !user.Status.ClearOnLeave {
+			continue
+		}
+		if err := s.Database.SetUserStatus(name, nil); err != nil {
+			klog.Errorf("Could not clear status of %s: %v", name, err)
+		}
+	}
+
+	p := Presence{visibility: visibility}
+	for name, v := range visibility {
+		switch v {
+		case VisibilityVisible:
+			user, err := getUser(name)
+			if err != nil {
+				return nil, err
+			}
+			pu := PresentUser{
+				Name:      name,
+				Manual:    manual[name],
+				ArrivedAt: arrived[name],
+				Devices:   count[name],
+			}
+			if status := user.Status; status != nil {
+				pu.Status = status.Text
+				pu.Emoji = status.Emoji
+			}
+			p.Users = append(p.Users, pu)
+		case VisibilityCountOnly:
+			p.Anonymous++
+		}
+	}
+	sort.Slice(p.Users, func(i, j int) bool {
+		return p.Users[i].Name < p.Users[j].Name
+	})
+	return &p, nil
+}
+
+// leaseActiveUntil returns until when the device holding a lease is
+// considered present, based on the lease alone. That's when the lease expires
+// or, with seen_within set, that long after the lease was last renewed.
+func (rc *RuntimeConfig) leaseActiveUntil(lease *Lease) time.Time {
+	until := lease.Expires
+	if rc.SeenWithin > 0 && !lease.RenewedAt.IsZero() {
+		if renewal := lease.RenewedAt.Add(rc.SeenWithin); renewal.Before(until) {
+			until = renewal
+		}
+	}
+	return until
+}
+
+// leaseActiveUntil returns until when the device holding a lease is
+// considered present, see RuntimeConfig.leaseActiveUntil. With neighbour
+// probing, devices are present for seen_within (or two probe intervals) after
+// they were last seen instead, as long as their lease hasn't expired. Until the
+// lease's address was probed after its last renewal, sightings only extend
+// presence.
+func (s *Service) leaseActiveUntil(lease *Lease) time.Time {
+	rc := s.cfg()
+	until := rc.leaseActiveUntil(lease)
+	if s.neighbours == nil {
+		return until
+	}
+	window := rc.SeenWithin
+	if window == 0 {
+		window = 2 * s.neighbours.Interval
+	}
+	var neighbour time.Time
+	if seen := s.neighbours.SeenAt(lease.MACAddress); !seen.IsZero() {
+		neighbour = seen.Add(window)
+	}
+	if probed := s.neighbours.ProbedAt(lease.IPAddress); !probed.IsZero() && !probed.Before(lease.RenewedAt) {
+		// The prober knows whether the device is still around.
+		if neighbour.After(lease.Expires) {
+			return lease.Expires
+		}
+		return neighbour
+	}
+	if neighbour.After(until) {
+		until = neighbour
+	}
+	return until
+}
+
+// probeTargets returns the addresses of all unexpired leases, for neighbour
+// probing.
+func (s *Service) probeTargets() []net.IP {
+	leases, err := s.cfg().Leases.Leases()
+	if err != nil {
+		klog.Errorf("Neighbour probe: could not get leases: %v", err)
+		return nil
+	}
+	now := time.Now()
+	var res []net.IP
+	for _, lease := range leases {
+		if lease.Expires.After(now) {
+			res = append(res, lease.IPAddress)
+		}
+	}
+	return res
+}
+
+// activeLease returns the lease of a device which is active (per
+// leaseActiveUntil) at now and expires last, or nil if there is none.
+func (s *Service) activeLease(d *Device, leases []*Lease, now time.Time) *Lease {
+	var res *Lease
+	for _, lease := range leases {
+		if !leaseMatches(d, lease) || !s.leaseActiveUntil(lease).After(now) {
+			continue
+		}
+		if res == nil || lease.Expires.After(res.Expires) {
+			res = lease
+		}
+	}
+	return res
+}
+
+// leaseMatches returns true if the lease could belong to the device, see
+// Store.GetDevicesForLeases.
+func leaseMatches(d *Device, lease *Lease) bool {
+	mac := lease.MACAddress.String()
+	for _, addr := range d.Addresses() {
+		if addr == mac {
+			return true
+		}
+	}
+	if d.MatchClientID && d.ClientID != "" && d.ClientID == lease.ClientID {
+		return true
+	}
+	return d.MatchHostname && d.Hostname != "" && d.Hostname == lease.Hostname
+}
+
+// leaseOwner returns the device a lease belongs to among devices, as returned
+// by Store.GetDevicesForLeases, or nil. Like the stores, it prefers devices
+// matching the MAC address over those matching by client ID or hostname.
+func leaseOwner(devices []*Device, lease *Lease) *Device {
+	mac := lease.MACAddress.String()
+	for _, d := range devices {
+		if slices.Contains(d.Addresses(), mac) {
+			return d
+		}
+	}
+	for _, d := range devices {
+		if leaseMatches(d, lease) {
+			return d
+		}
+	}
+	return nil
+}
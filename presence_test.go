@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// ignoreArrival ignores arrival times when comparing present users.
+var ignoreArrival = cmpopts.IgnoreFields(PresentUser{}, "ArrivedAt")
+
+// ignoreVisibility ignores the visibility of all present users, including
+// hidden ones, when comparing presences.
+var ignoreVisibility = cmpopts.IgnoreUnexported(Presence{})
+
+func TestPresenceTracker(t *testing.T) {
+	var tracker presenceTracker
+	start := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	arrival, departure := 2*time.Minute, 10*time.Minute
+
+	// seen returns users with present devices, whose leases expire 5 minutes
+	// after at.
+	seen := func(at time.Duration, users map[string]Visibility) map[string]seenUser {
+		res := make(map[string]seenUser)
+		for user, v := range users {
+			res[user] = seenUser{visibility: v, expires: start.Add(at + 5*time.Minute)}
+		}
+		return res
+	}
+	visible := VisibilityVisible
+	for i, step := range []struct {
+		at   time.Duration
+		seen map[string]Visibility
+		want map[string]Visibility
+	}{
+		// Alice arrives, but isn't shown until the arrival delay passed.
+		{0, map[string]Visibility{"alice": visible}, map[string]Visibility{}},
+		{time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{}},
+		// Her phone drops off briefly, which doesn't delay her arrival.
+		{90 * time.Second, nil, map[string]Visibility{}},
+		{2 * time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{"alice": visible}},
+		// Bob only stays for a minute, and is never shown.
+		{3 * time.Minute, map[string]Visibility{"alice": visible, "bob": visible}, map[string]Visibility{"alice": visible}},
+		{4 * time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{"alice": visible}},
+		// Alice's visibility changes take effect immediately.
+		{5 * time.Minute, map[string]Visibility{"alice": VisibilityCountOnly}, map[string]Visibility{"alice": VisibilityCountOnly}},
+		// Alice's lease vanishes, but she's still shown until the
+		// departure delay passed.
+		{6 * time.Minute, nil, map[string]Visibility{"alice": VisibilityCountOnly}},
+		{14 * time.Minute, nil, map[string]Visibility{"alice": VisibilityCountOnly}},
+		{15 * time.Minute, nil, map[string]Visibility{}},
+		// When she comes back, she has to arrive again.
+		{16 * time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{}},
+		{18 * time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{"alice": visible}},
+		// Her lease expires at 23 minutes, without any update in between.
+		{30 * time.Minute, nil, map[string]Visibility{"alice": visible}},
+		{33 * time.Minute, nil, map[string]Visibility{}},
+		// Same if she comes back before the tracker noticed her leaving.
+		{34 * time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{}},
+		{36 * time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{"alice": visible}},
+		{60 * time.Minute, map[string]Visibility{"alice": visible}, map[string]Visibility{}},
+	} {
+		got := make(map[string]Visibility)
+		for user, u := range tracker.update(seen(step.at, step.seen), start.Add(step.at), arrival, departure) {
+			got[user] = u.visibility
+		}
+		if diff := cmp.Diff(step.want, got); diff != "" {
+			t.Errorf("step %d (%s): %s", i, step.at, diff)
+		}
+	}
+}
+
+func TestPresenceDebounce(t *testing.T) {
+	s := newTestService(t)
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.cfg().ArrivalDelay = 5 * time.Minute
+	s.cfg().DepartureDelay = 10 * time.Minute
+
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	if err := s.Database.ClaimDevice("alice", mac, "", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	s.cfg().Leases = staticLeases{{
+		IPAddress:  net.IPv4(10, 1, 0, 1),
+		MACAddress: mac,
+		Expires:    now.Add(20 * time.Minute),
+	}}
+
+	check := func(want ...PresentUser) {
+		t.Helper()
+		p, err := s.getPresence()
+		if err != nil {
+			t.Fatalf("could not get presence: %v", err)
+		}
+		if diff := cmp.Diff(&Presence{Users: want}, p, ignoreVisibility); diff != "" {
+			t.Errorf("presence at %s: %s", now.Format("15:04"), diff)
+		}
+	}
+
+	arrived := now
+	check()
+	now = now.Add(5 * time.Minute)
+	check(PresentUser{Name: "alice", ArrivedAt: arrived, Devices: 1})
+	// The lease expires, but alice is only gone after the departure delay.
+	now = now.Add(16 * time.Minute)
+	check(PresentUser{Name: "alice", ArrivedAt: arrived})
+	now = now.Add(10 * time.Minute)
+	check()
+
+	// Manual check-ins aren't delayed.
+	if err := s.Database.CheckIn(&CheckIn{Username: "bob", CheckedInAt: now, Until: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("could not check in: %v", err)
+	}
+	check(PresentUser{Name: "bob", Manual: true, ArrivedAt: now})
+}
+
+func TestLeaseActiveUntil(t *testing.T) {
+	s := newTestService(t)
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	lease := &Lease{
+		IPAddress:  net.ParseIP("10.1.0.23"),
+		MACAddress: mustParseMAC("00:11:22:33:44:55"),
+		RenewedAt:  now.Add(-50 * time.Minute),
+		Expires:    now.Add(10 * time.Minute),
+	}
+
+	// By default, leases count until they expire.
+	if got, want := s.leaseActiveUntil(lease), now.Add(10*time.Minute); !got.Equal(want) {
+		t.Errorf("expiry-based: got %s, want %s", got, want)
+	}
+	// With seen_within, only until some time after their renewal.
+	s.cfg().SeenWithin = 35 * time.Minute
+	if got, want := s.leaseActiveUntil(lease), now.Add(-15*time.Minute); !got.Equal(want) {
+		t.Errorf("renewal-based: got %s, want %s", got, want)
+	}
+	// Unless the device was seen on the network since.
+	s.neighbours = &NeighbourProber{
+		seen: map[string]time.Time{"00:11:22:33:44:55": now.Add(-time.Minute)},
+	}
+	if got, want := s.leaseActiveUntil(lease), now.Add(34*time.Minute); !got.Equal(want) {
+		t.Errorf("neighbour-based: got %s, want %s", got, want)
+	}
+
+	// Once its address was probed after the renewal, a device which stopped
+	// answering is gone when its last sighting is too old, even if it
+	// renewed its lease recently...
+	renewed := &Lease{
+		IPAddress:  net.ParseIP("10.1.0.23"),
+		MACAddress: mustParseMAC("00:11:22:33:44:55"),
+		RenewedAt:  now.Add(-10 * time.Minute),
+		Expires:    now.Add(50 * time.Minute),
+	}
+	s.neighbours = &NeighbourProber{
+		seen:   map[string]time.Time{"00:11:22:33:44:55": now.Add(-40 * time.Minute)},
+		probed: map[string]time.Time{"10.1.0.23": now.Add(-time.Minute)},
+	}
+	if got, want := s.leaseActiveUntil(renewed), now.Add(-5*time.Minute); !got.Equal(want) {
+		t.Errorf("stopped answering: got %s, want %s", got, want)
+	}
+	// ... or if it was never seen at all.
+	s.neighbours.seen = nil
+	if got := s.leaseActiveUntil(renewed); got.After(now) {
+		t.Errorf("never answered: got %s, want before %s", got, now)
+	}
+	// Sightings don't extend presence past the lease's expiry.
+	s.neighbours.seen = map[string]time.Time{"00:11:22:33:44:55": now.Add(-time.Minute)}
+	if got, want := s.leaseActiveUntil(lease), now.Add(10*time.Minute); !got.Equal(want) {
+		t.Errorf("probed after expiry: got %s, want %s", got, want)
+	}
+	// Addresses not probed since the renewal (eg. new leases) fall back to
+	// the lease.
+	s.neighbours.probed = map[string]time.Time{"10.1.0.23": now.Add(-20 * time.Minute)}
+	s.neighbours.seen = nil
+	if got, want := s.leaseActiveUntil(renewed), now.Add(25*time.Minute); !got.Equal(want) {
+		t.Errorf("not probed since renewal: got %s, want %s", got, want)
+	}
+}
+
+func TestPresenceChanged(t *testing.T) {
+	s := newTestService(t)
+	s.cfg().SpaceName = "FAFO"
+	webhooks := make(chan JSONTop, 10)
+	ntfy := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hook" {
+			var res JSONTop
+			json.NewDecoder(r.Body).Decode(&res)
+			webhooks <- res
+			return
+		}
+		ntfy <- r.URL.Path
+	}))
+	defer srv.Close()
+	s.cfg().Webhooks = []string{srv.URL + "/hook"}
+	s.cfg().Notifiers = map[string]Notifier{"ntfy": &NtfyNotifier{Server: srv.URL}}
+	if err := s.Database.PutSubscription(&Subscription{ID: "1", Username: "joe", Event: EventOpen, Channel: "ntfy", Target: "joe"}); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+	hs := newFakeHomeserver(t)
+	s.matrix = &MatrixBot{Homeserver: hs.URL, AccessToken: "secret", Room: "#fafo:example.com", Announce: true}
+	if err := s.matrix.login(context.Background()); err != nil {
+		t.Fatalf("could not log in: %v", err)
+	}
+
+	s.presenceChanged(context.Background(), &Presence{}, &Presence{Users: []PresentUser{{Name: "alice"}}})
+	if res := <-webhooks; len(res.Users) != 1 || res.Users[0].Login != "alice" {
+		t.Errorf("unexpected webhook %+v", res)
+	}
+	if path := <-ntfy; path != "/joe" {
+		t.Errorf("unexpected notification to %s", path)
+	}
+	if msg := <-hs.sent; msg != "alice arrived at FAFO." {
+		t.Errorf("unexpected announcement %q", msg)
+	}
+}
+
+func TestPresenceVisibilityChange(t *testing.T) {
+	s := newTestService(t)
+	if err := s.Database.ClaimDevice("alice", mustParseMAC("00:11:22:33:44:55"), "laptop", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	last, err := s.getPresence()
+	if err != nil {
+		t.Fatalf("could not get presence: %v", err)
+	}
+	for _, v := range []Visibility{VisibilityCountOnly, VisibilityHidden, VisibilityVisible} {
+		if err := s.Database.SetUserVisibility("alice", v); err != nil {
+			t.Fatalf("could not set visibility: %v", err)
+		}
+		p, err := s.getPresence()
+		if err != nil {
+			t.Fatalf("could not get presence: %v", err)
+		}
+		if p.Equal(last) {
+			t.Errorf("%s: presence didn't change", v)
+		}
+		if diff := cmp.Diff(presenceChange{}, diffPresence(last, p)); diff != "" {
+			t.Errorf("%s: visibility change: %s", v, diff)
+		}
+		last = p
+	}
+}
+
+func TestLeaseOwner(t *testing.T) {
+	byMAC := &Device{MACAddress: "00:11:22:33:44:66", UserNickname: "alice"}
+	byClientID := &Device{MACAddress: "00:11:22:33:44:55", UserNickname: "bob", ClientID: "01:02", MatchClientID: true}
+	devices := []*Device{byClientID, byMAC}
+	for _, test := range []struct {
+		lease *Lease
+		want  *Device
+	}{
+		{&Lease{MACAddress: mustParseMAC("00:11:22:33:44:66"), ClientID: "01:02"}, byMAC},
+		{&Lease{MACAddress: mustParseMAC("00:11:22:33:44:77"), ClientID: "01:02"}, byClientID},
+		{&Lease{MACAddress: mustParseMAC("00:11:22:33:44:77")}, nil},
+	} {
+		if got := leaseOwner(devices, test.lease); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.lease.MACAddress, got, test.want)
+		}
+	}
+}
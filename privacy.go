@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Visibility controls how a present device (and thus its user) is shown to
+// others.
+type Visibility string
+
+const (
+	// VisibilityDefault means a device uses its user's visibility, and a user
+	// is visible.
+	VisibilityDefault Visibility = ""
+	// VisibilityVisible shows the user by name.
+	VisibilityVisible Visibility = "visible"
+	// VisibilityCountOnly counts the user as present, without naming them.
+	VisibilityCountOnly Visibility = "count_only"
+	// VisibilityHidden doesn't show the user as present at all.
+	VisibilityHidden Visibility = "hidden"
+)
+
+// ParseVisibility parses a visibility as submitted in forms or stored in
+// exports.
+func ParseVisibility(s string) (Visibility, error) {
+	switch v := Visibility(s); v {
+	case VisibilityDefault, VisibilityVisible, VisibilityCountOnly, VisibilityHidden:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid visibility %q", s)
+	}
+}
+
+// rank orders visibilities from least to most visible.
+func (v Visibility) rank() int {
+	switch v {
+	case VisibilityHidden:
+		return 0
+	case VisibilityCountOnly:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// effectiveVisibility returns the visibility of a device, taking its user's
+// visibility into account.
+func effectiveVisibility(d *Device, u *User) Visibility {
+	if d.Visibility != VisibilityDefault {
+		return d.Visibility
+	}
+	if u.Visibility != VisibilityDefault {
+		return u.Visibility
+	}
+	return VisibilityVisible
+}
+
+// viewDeviceVisibility sets the visibility of one of the user's devices.
+func (s *Service) viewDeviceVisibility(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+
+	device, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	visibility, err := ParseVisibility(r.PostFormValue("visibility"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid visibility.")
+		return
+	}
+	if err := s.Database.SetDeviceVisibility(session.Username, device, visibility); err != nil {
+		fmt.Fprintf(w, "Could not update device: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
+
+// viewUserVisibility sets the default visibility of the user's devices.
+func (s *Service) viewUserVisibility(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	visibility, err := ParseVisibility(r.PostFormValue("visibility"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid visibility.")
+		return
+	}
+	if err := s.Database.SetUserVisibility(session.Username, visibility); err != nil {
+		fmt.Fprintf(w, "Could not update visibility: %v", err)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
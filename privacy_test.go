@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPresence(t *testing.T) {
+	s := newTestService(t)
+	var leases staticLeases
+	lease := func(mac net.HardwareAddr) {
+		leases = append(leases, &Lease{
+			IPAddress:  net.IPv4(10, 1, 0, byte(len(leases)+1)),
+			MACAddress: mac,
+			Expires:    time.Now().Add(time.Hour),
+		})
+	}
+	claim := func(user string, mac net.HardwareAddr, v Visibility) {
+		t.Helper()
+		if err := s.Database.ClaimDevice(user, mac, "", ""); err != nil {
+			t.Fatalf("could not claim device: %v", err)
+		}
+		if err := s.Database.SetDeviceVisibility(user, mac, v); err != nil {
+			t.Fatalf("could not set visibility: %v", err)
+		}
+		lease(mac)
+	}
+
+	// Visible by default.
+	claim("alice", net.HardwareAddr{0, 0, 0, 0, 0, 1}, VisibilityDefault)
+	// Hidden tablet doesn't hide visible laptop.
+	claim("bob", net.HardwareAddr{0, 0, 0, 0, 0, 2}, VisibilityHidden)
+	claim("bob", net.HardwareAddr{0, 0, 0, 0, 0, 3}, VisibilityDefault)
+	// Only a hidden tablet present.
+	claim("carol", net.HardwareAddr{0, 0, 0, 0, 0, 4}, VisibilityHidden)
+	// Count-only by user default, with two devices counted once.
+	claim("dave", net.HardwareAddr{0, 0, 0, 0, 0, 5}, VisibilityDefault)
+	claim("dave", net.HardwareAddr{0, 0, 0, 0, 0, 6}, VisibilityDefault)
+	if err := s.Database.SetUserVisibility("dave", VisibilityCountOnly); err != nil {
+		t.Fatalf("could not set visibility: %v", err)
+	}
+	// Hidden by user default, but one device explicitly visible.
+	claim("eve", net.HardwareAddr{0, 0, 0, 0, 0, 7}, VisibilityDefault)
+	claim("eve", net.HardwareAddr{0, 0, 0, 0, 0, 8}, VisibilityCountOnly)
+	if err := s.Database.SetUserVisibility("eve", VisibilityHidden); err != nil {
+		t.Fatalf("could not set visibility: %v", err)
+	}
+	s.cfg().Leases = leases
+
+	p, err := s.getPresence()
+	if err != nil {
+		t.Fatalf("could not get presence: %v", err)
+	}
+	want := &Presence{Users: []PresentUser{{Name: "alice", Devices: 1}, {Name: "bob", Devices: 1}}, Anonymous: 2}
+	if diff := cmp.Diff(*want, *p, ignoreArrival, ignoreVisibility); diff != "" {
+		t.Errorf("presence: %s", diff)
+	}
+
+	// The index page and API show the same.
+	s.cfg().APIUsers = []APIUser{{"api", "secret"}}
+	r := httptest.NewRequest("GET", "/api.json", nil)
+	r.SetBasicAuth("api", "secret")
+	w := httptest.NewRecorder()
+	s.viewAPIJSON(w, r)
+	if got := strings.TrimSpace(w.Body.String()); got != `{"users":[{"login":"alice"},{"login":"bob"}],"anonymous":2}` {
+		t.Errorf("api: got %s", got)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range s.sessionCookies(&Session{Username: "alice", ExpiresAt: time.Now().Add(time.Hour)}) {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	s.viewIndex(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "and 2 anonymous people") {
+		t.Errorf("index: expected anonymous count, got %d: %s", w.Code, body)
+	}
+	for _, hidden := range []string{"carol", "dave", "eve"} {
+		if strings.Contains(body, hidden) {
+			t.Errorf("index: shows %s", hidden)
+		}
+	}
+
+	// Settings are shown in the management panel.
+	r = httptest.NewRequest("GET", "/manage", nil)
+	for _, c := range s.sessionCookies(&Session{Username: "eve", ExpiresAt: time.Now().Add(time.Hour)}) {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	s.viewManage(w, r)
+	body = w.Body.String()
+	if !strings.Contains(body, `<option value="hidden" selected>don't show you at all`) || !strings.Contains(body, `<option value="count_only" selected>Count only`) {
+		t.Errorf("manage: settings not shown: %s", body)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies is a list of networks of reverse proxies whose forwarding
+// headers (X-Forwarded-For, Forwarded) are trusted.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or plain
+// addresses.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var res TrustedProxies
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+			}
+			addr = addr.Unmap()
+			res = append(res, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+		}
+		res = append(res, prefix.Masked())
+	}
+	return res, nil
+}
+
+// Contains returns whether an address belongs to a trusted proxy.
+func (t TrustedProxies) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client making a request. Forwarding
+// headers are only honoured if the request comes from a trusted proxy, and
+// then only walked right-to-left for as long as hops are trusted proxies
+// themselves. This way, a client cannot spoof its address by sending its own
+// forwarding headers.
+//
+// The Forwarded header (RFC 7239) takes precedence over X-Forwarded-For if
+// both are present.
+func (t TrustedProxies) ClientAddr(r *http.Request) (netip.Addr, error) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("could not parse remote address %q: %w", r.RemoteAddr, err)
+	}
+	addr := peer.Addr().Unmap()
+	if !t.Contains(addr) {
+		return addr, nil
+	}
+
+	var hops []string
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		hops = forwardedHops(fwd)
+	} else {
+		for _, xff := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(xff, ",")...)
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid forwarded address from trusted proxy %s: %w", addr, err)
+		}
+		addr = hop
+		if !t.Contains(addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
+// forwardedHops returns the 'for' parameters of all elements of Forwarded
+// headers, in order. Elements without one are returned as empty strings, as
+// they still denote a hop.
+func forwardedHops(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hop = strings.Trim(v, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address from a forwarding header, optionally with a port
+// and/or in brackets.
+func parseHop(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("unparseable hop %q", s)
+	}
+	return addr.Unmap(), nil
+}
+
+// netIP converts an address for comparison with leases.
+func netIP(addr netip.Addr) net.IP {
+	return net.IP(addr.AsSlice())
+}
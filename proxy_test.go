@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := ParseTrustedProxies("127.0.0.1, 10.0.0.0/24, fd00::/64")
+	if err != nil {
+		t.Fatalf("could not parse trusted proxies: %v", err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		remote    string
+		xff       []string
+		forwarded []string
+		want      string
+		wantErr   bool
+	}{
+		{name: "direct", remote: "10.1.0.23:1234", want: "10.1.0.23"},
+		{name: "direct ipv6", remote: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{name: "direct ipv4 mapped", remote: "[::ffff:10.1.0.23]:1234", want: "10.1.0.23"},
+		{name: "proxied", remote: "127.0.0.1:1234", xff: []string{"10.1.0.23"}, want: "10.1.0.23"},
+		{name: "proxied without header", remote: "127.0.0.1:1234", want: "127.0.0.1"},
+		{name: "proxy chain", remote: "127.0.0.1:1234", xff: []string{"10.1.0.23, 10.0.0.2"}, want: "10.1.0.23"},
+		{name: "multiple headers", remote: "127.0.0.1:1234", xff: []string{"10.1.0.23", "10.0.0.2"}, want: "10.1.0.23"},
+		{name: "all hops trusted", remote: "127.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+
+		// Spoofing attempts.
+		{name: "spoof from untrusted", remote: "192.0.2.1:1234", xff: []string{"10.1.0.23"}, want: "192.0.2.1"},
+		{name: "spoof forwarded from untrusted", remote: "192.0.2.1:1234", forwarded: []string{"for=10.1.0.23"}, want: "192.0.2.1"},
+		{name: "spoof through proxy", remote: "127.0.0.1:1234", xff: []string{"10.1.0.23, 192.0.2.1"}, want: "192.0.2.1"},
+		{name: "spoof trusted hop through proxy", remote: "127.0.0.1:1234", xff: []string{"10.1.0.23, 10.0.0.2, 192.0.2.1"}, want: "192.0.2.1"},
+		{name: "spoof garbage", remote: "127.0.0.1:1234", xff: []string{"10.1.0.23, hello"}, wantErr: true},
+		{name: "garbage beyond untrusted hop", remote: "127.0.0.1:1234", xff: []string{"hello, 192.0.2.1"}, want: "192.0.2.1"},
+
+		// RFC 7239.
+		{name: "forwarded", remote: "127.0.0.1:1234", forwarded: []string{"for=10.1.0.23;proto=https;by=127.0.0.1"}, want: "10.1.0.23"},
+		{name: "forwarded chain", remote: "127.0.0.1:1234", forwarded: []string{`for=10.1.0.23, For="10.0.0.2:4711"`}, want: "10.1.0.23"},
+		{name: "forwarded ipv6", remote: "127.0.0.1:1234", forwarded: []string{`for="[2001:db8:cafe::17]:4711"`}, want: "2001:db8:cafe::17"},
+		{name: "forwarded ipv6 without port", remote: "127.0.0.1:1234", forwarded: []string{`for="[2001:db8:cafe::17]"`}, want: "2001:db8:cafe::17"},
+		{name: "forwarded obfuscated", remote: "127.0.0.1:1234", forwarded: []string{"for=_hidden"}, wantErr: true},
+		{name: "forwarded without for", remote: "127.0.0.1:1234", forwarded: []string{"proto=https"}, wantErr: true},
+		{name: "forwarded over xff", remote: "127.0.0.1:1234", forwarded: []string{"for=10.1.0.23"}, xff: []string{"10.1.0.42"}, want: "10.1.0.23"},
+		{name: "forwarded spoof through proxy", remote: "127.0.0.1:1234", forwarded: []string{"for=10.1.0.23, for=192.0.2.1"}, want: "192.0.2.1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remote
+			for _, v := range test.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			for _, v := range test.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+			got, err := proxies.ClientAddr(r)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.String() != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, s := range []string{"hello", "10.0.0.0/33", "10.0.0.1/"} {
+		if _, err := ParseTrustedProxies(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The secret file contains one secret per line. The first line is the current
+// secret, used to seal new sessions. Further lines are previous secrets, for
+// which existing sessions are still accepted. Blank lines and lines starting
+// with # are ignored.
+
+// generateSecret returns a new random secret.
+func generateSecret() (string, error) {
+	var secret [32]byte
+	if _, err := io.ReadFull(rand.Reader, secret[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret[:]), nil
+}
+
+// newID generates a random identifier for records in the database, eg.
+// subscriptions.
+func newID() (string, error) {
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// readSecrets reads all secrets from a secret file, current one first.
+func readSecrets(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var secrets []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("%s contains no secrets", path)
+	}
+	return secrets, nil
+}
+
+// writeSecrets atomically replaces the secret file.
+func writeSecrets(path string, secrets []string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(strings.Join(secrets, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadSecrets reads the secret file, generating it with a new secret if it
+// doesn't exist yet. The returned bool is true if the file was generated.
+func loadSecrets(path string) ([]string, bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		secret, err := generateSecret()
+		if err != nil {
+			return nil, false, fmt.Errorf("could not generate secret: %w", err)
+		}
+		if err := writeSecrets(path, []string{secret}); err != nil {
+			return nil, false, fmt.Errorf("could not write secret: %w", err)
+		}
+		return []string{secret}, true, nil
+	}
+	secrets, err := readSecrets(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not read secret: %w", err)
+	}
+	return secrets, false, nil
+}
+
+// rotateSecrets adds a new current secret to the secret file, keeping at most
+// keep previous secrets.
+func rotateSecrets(path string, keep int) ([]string, error) {
+	secrets, err := readSecrets(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret: %w", err)
+	}
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate secret: %w", err)
+	}
+	secrets = append([]string{secret}, secrets...)
+	if len(secrets) > keep+1 {
+		secrets = secrets[:keep+1]
+	}
+	if err := writeSecrets(path, secrets); err != nil {
+		return nil, fmt.Errorf("could not write secret: %w", err)
+	}
+	return secrets, nil
+}
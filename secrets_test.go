@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRotateSecrets(t *testing.T) {
+	path := t.TempDir() + "/secret"
+	first, generated, err := loadSecrets(path)
+	if err != nil || !generated || len(first) != 1 {
+		t.Fatalf("could not generate secret file: %v %v %v", first, generated, err)
+	}
+
+	var secrets []string
+	for i := 0; i < 3; i++ {
+		if secrets, err = rotateSecrets(path, 1); err != nil {
+			t.Fatalf("could not rotate secrets: %v", err)
+		}
+	}
+	read, _, err := loadSecrets(path)
+	if err != nil {
+		t.Fatalf("could not read secrets: %v", err)
+	}
+	if diff := cmp.Diff(read, secrets); diff != "" {
+		t.Errorf("secret file: %s", diff)
+	}
+	if len(read) != 2 || read[0] == first[0] || read[1] == first[0] {
+		t.Errorf("expected new secret and one previous one, got %v", read)
+	}
+}
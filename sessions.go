@@ -5,9 +5,12 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/nacl/secretbox"
 	"k8s.io/klog/v2"
@@ -16,7 +19,16 @@ import (
 // Sessions is a simple 'session' data manager. It stores a serialized Session
 // structure in the users' cookies, encrypted and signed using a secret key.
 type Sessions struct {
-	Secret string
+	// Lifetime of logged in sessions. Sessions are renewed by Renew when less
+	// than half of it is left.
+	Lifetime time.Duration
+	// Users, if set, is used to check that sessions haven't been revoked.
+	Users interface {
+		GetUser(username string) (*User, error)
+	}
+
+	// keys derived from secrets, see SetSecrets.
+	keys atomic.Pointer[[][32]byte]
 }
 
 // Session is confidential data stored in a user's cookie.
@@ -24,16 +36,43 @@ type Session struct {
 	Username      string `json:"username"`
 	OAuthState    string `json:"oauth_state"`
 	OAuthVerifier string `json:"oauth_verifier"`
+	// CSRFToken must be sent along with all state-changing requests.
+	CSRFToken string `json:"csrf_token"`
+	// IssuedAt is when the user logged in.
+	IssuedAt time.Time `json:"issued_at"`
+	// ExpiresAt is when the session stops being valid, unless renewed.
+	ExpiresAt time.Time `json:"expires_at"`
+	// Generation is the user's session generation at login (see User).
+	Generation uint64 `json:"generation"`
 }
 
-func (s *Sessions) key() [32]byte {
-	return sha256.Sum256([]byte(s.Secret))
+// SetSecrets sets the secrets used to encrypt sessions. The first secret is
+// the current one, used for new sessions. Other secrets are previous ones,
+// still accepted for existing sessions, which are then resealed with the
+// current secret by Renew. This can be called at any time.
+func (s *Sessions) SetSecrets(secrets []string) error {
+	if len(secrets) == 0 {
+		return fmt.Errorf("no secrets")
+	}
+	keys := make([][32]byte, len(secrets))
+	for i, secret := range secrets {
+		keys[i] = sha256.Sum256([]byte(secret))
+	}
+	s.keys.Store(&keys)
+	return nil
 }
 
 // Get retrives the Session stored in a user's cookies, or nil if not present
-// (or invalid).
+// (or invalid, expired or revoked).
 func (s *Sessions) Get(r *http.Request) *Session {
-	secretKey := s.key()
+	session, _ := s.get(r)
+	return session
+}
+
+// get is Get, additionally returning whether the session was sealed with a
+// previous secret.
+func (s *Sessions) get(r *http.Request) (*Session, bool) {
+	keys := *s.keys.Load()
 
 	cookies := r.Cookies()
 	for _, cookie := range cookies {
@@ -49,7 +88,15 @@ func (s *Sessions) Get(r *http.Request) *Session {
 		}
 		var decryptNonce [24]byte
 		copy(decryptNonce[:], encrypted[:24])
-		decrypted, ok := secretbox.Open(nil, encrypted[24:], &decryptNonce, &secretKey)
+		var decrypted []byte
+		var ok, previous bool
+		for i := range keys {
+			decrypted, ok = secretbox.Open(nil, encrypted[24:], &decryptNonce, &keys[i])
+			if ok {
+				previous = i > 0
+				break
+			}
+		}
 		if !ok {
 			continue
 		}
@@ -58,14 +105,28 @@ func (s *Sessions) Get(r *http.Request) *Session {
 		if err := json.Unmarshal(decrypted, &res); err != nil {
 			continue
 		}
-		return &res
+		// Sessions from before expiry was introduced are treated as expired.
+		if res.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		if res.Username != "" && s.Users != nil {
+			user, err := s.Users.GetUser(res.Username)
+			if err != nil {
+				klog.Errorf("failed to get user %q: %v", res.Username, err)
+				return nil, false
+			}
+			if user.SessionGeneration != res.Generation {
+				continue
+			}
+		}
+		return &res, previous
 	}
-	return nil
+	return nil, false
 }
 
 // Set saves the given Session into the user's cookies.
 func (s *Sessions) Set(w http.ResponseWriter, data *Session) {
-	secretKey := s.key()
+	secretKey := (*s.keys.Load())[0]
 
 	decrypted, err := json.Marshal(data)
 	if err != nil {
@@ -83,6 +144,38 @@ func (s *Sessions) Set(w http.ResponseWriter, data *Session) {
 		Value:    base64.URLEncoding.EncodeToString(encrypted),
 		Secure:   strings.HasPrefix(flagPublicAddress, "https://"),
 		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 		Path:     "/",
+		Expires:  data.ExpiresAt,
+	})
+}
+
+// Clear removes the session from the user's cookies.
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session2",
+		Secure:   strings.HasPrefix(flagPublicAddress, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+		MaxAge:   -1,
+	})
+}
+
+// Renew wraps a handler, extending the expiry of logged in sessions which
+// have less than half of their lifetime left, so that active users stay
+// logged in. Sessions sealed with a previous secret are resealed with the
+// current one.
+func (s *Sessions) Renew(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, previous := s.get(r)
+		renew := session != nil && session.Username != "" && time.Until(session.ExpiresAt) < s.Lifetime/2
+		if renew {
+			session.ExpiresAt = time.Now().Add(s.Lifetime)
+		}
+		if renew || previous {
+			s.Set(w, session)
+		}
+		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// statusMaxLength is the maximum length of status messages, in
+	// characters.
+	statusMaxLength = 80
+	// statusEmojiMaxLength is the maximum length of status emoji, in code
+	// points. Emoji with skin tones or ZWJ sequences consist of multiple.
+	statusEmojiMaxLength = 16
+)
+
+// Status is a short message of what a user is up to, shown next to their name
+// while they're present.
+type Status struct {
+	Text  string `json:"text,omitempty"`
+	Emoji string `json:"emoji,omitempty"`
+	// SetAt is when the status was set.
+	SetAt time.Time `json:"set_at"`
+	// ClearOnLeave clears the status once the user leaves (after the
+	// departure delay), see getPresence.
+	ClearOnLeave bool `json:"clear_on_leave,omitempty"`
+}
+
+// NewStatus validates user input for a status. A nil Status is returned if
+// both text and emoji are empty, which clears the status. Errors are
+// user-presentable.
+func NewStatus(text, emoji string, clearOnLeave bool, now time.Time) (*Status, error) {
+	text = strings.TrimSpace(text)
+	emoji = strings.TrimSpace(emoji)
+	if text == "" && emoji == "" {
+		return nil, nil
+	}
+	if !utf8.ValidString(text) || !utf8.ValidString(emoji) {
+		return nil, fmt.Errorf("Status must be valid UTF-8.")
+	}
+	if n := utf8.RuneCountInString(text); n > statusMaxLength {
+		return nil, fmt.Errorf("Status is too long (%d characters, at most %d allowed).", n, statusMaxLength)
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) {
+			return nil, fmt.Errorf("Status must be a single line of text.")
+		}
+	}
+	if utf8.RuneCountInString(emoji) > statusEmojiMaxLength {
+		return nil, fmt.Errorf("Emoji is too long.")
+	}
+	for _, r := range emoji {
+		// Zero width joiners and tags are used in emoji sequences.
+		if r < utf8.RuneSelf || !(unicode.IsGraphic(r) || r == '\u200d' || (r >= 0xe0020 && r <= 0xe007f)) {
+			return nil, fmt.Errorf("Emoji must be an emoji.")
+		}
+	}
+	return &Status{
+		Text:         text,
+		Emoji:        emoji,
+		SetAt:        now,
+		ClearOnLeave: clearOnLeave,
+	}, nil
+}
+
+// viewStatus sets or clears the user's status message.
+func (s *Service) viewStatus(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	status, err := NewStatus(r.PostFormValue("status"), r.PostFormValue("emoji"), r.PostFormValue("clear_on_leave") == "on", time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if err := s.Database.SetUserStatus(session.Username, status); err != nil {
+		fmt.Fprintf(w, "Could not set status: %v", err)
+		return
+	}
+	// The status can be set from both the index and management pages.
+	next := "/manage"
+	if r.PostFormValue("next") == "/" {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewStatus(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		text, emoji string
+		ok          bool
+	}{
+		{"", "", true},
+		{"Soldering the LED sign", "", true},
+		{"", "👩🏽‍💻", true},
+		{"Fixing the 3D printer", "🏴󠁧󠁢󠁳󠁣󠁴󠁿", true},
+		{strings.Repeat("a", statusMaxLength), "", true},
+		{strings.Repeat("ą", statusMaxLength+1), "", false},
+		{"two\nlines", "", false},
+		{"", ":)", false},
+		{"", "🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥", false},
+	} {
+		_, err := NewStatus(tc.text, tc.emoji, false, now)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("NewStatus(%q, %q): got error %v, want ok %v", tc.text, tc.emoji, err, tc.ok)
+		}
+	}
+}
+
+func TestStatusShown(t *testing.T) {
+	s := newTestService(t)
+	if err := s.Database.ClaimDevice("alice", mustParseMAC("00:11:22:33:44:55"), "", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	s.cfg().APIUsers = []APIUser{{"api", "secret"}}
+	cookies := s.sessionCookies(&Session{Username: "alice", CSRFToken: "token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	// alice sets her status from home, then arrives.
+	r := httptest.NewRequest("POST", "/status", strings.NewReader("csrf_token=token&next=/&emoji=%F0%9F%94%A5&status=%3Cb%3Ehot%3C/b%3E&clear_on_leave=on"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	s.viewStatus(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("expected redirect to index, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := s.getPresence(); err != nil {
+		t.Fatalf("could not get presence: %v", err)
+	}
+	// Restarts don't clear it.
+	s.presence = presenceTracker{}
+
+	// The status is escaped on the index page.
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	s.viewIndex(w, r)
+	if body := w.Body.String(); !strings.Contains(body, `<span class="status">🔥 &lt;b&gt;hot&lt;/b&gt;</span>`) {
+		t.Errorf("index: status not shown: %s", body)
+	}
+
+	// And part of the API, also escaped for consumers embedding it in HTML.
+	r = httptest.NewRequest("GET", "/api.json", nil)
+	r.SetBasicAuth("api", "secret")
+	w = httptest.NewRecorder()
+	s.viewAPIJSON(w, r)
+	if got, want := strings.TrimSpace(w.Body.String()), `{"users":[{"login":"alice","status":"\u003cb\u003ehot\u003c/b\u003e","emoji":"🔥"}],"anonymous":0}`; got != want {
+		t.Errorf("api: got %s, want %s", got, want)
+	}
+
+	// Once alice leaves, the status is cleared.
+	leases := s.cfg().Leases
+	s.cfg().Leases = staticLeases{}
+	if _, err := s.getPresence(); err != nil {
+		t.Fatalf("could not get presence: %v", err)
+	}
+	user, err := s.Database.GetUser("alice")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if user.Status != nil {
+		t.Errorf("status not cleared after leaving: %+v", user.Status)
+	}
+	s.cfg().Leases = leases
+	p, err := s.getPresence()
+	if err != nil {
+		t.Fatalf("could not get presence: %v", err)
+	}
+	if len(p.Users) != 1 || p.Users[0].Status != "" {
+		t.Errorf("status still shown after coming back: %+v", p.Users)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	// ErrConflict is returned (wrapped) by Store.ImportDevice when a device
+	// conflicts with an existing one.
+	ErrConflict = errors.New("conflict")
+	// ErrLocked is returned (wrapped) when opening a Store that is already in
+	// use by another process, eg. a running server.
+	ErrLocked = errors.New("database is locked by another process")
+)
+
+// Store is the persistent storage of checkinator data (claimed devices).
+type Store interface {
+	// GetDevicesForMacAddresses returns a list of devices that match the
+	// given MAC addresses, either by their primary or additional MAC
+	// addresses.
+	GetDevicesForMacAddresses(macAddresses []net.HardwareAddr) ([]*Device, error)
+	// GetDevicesForLeases returns a list of devices that match the given
+	// leases. Leases are matched to devices by MAC address, and by DHCP
+	// client ID and hostname for devices which have opted into that.
+	GetDevicesForLeases(leases []*Lease) ([]*Device, error)
+	// GetDevicesForUser returns a list of devices managed by a given user.
+	GetDevicesForUser(user string) ([]*Device, error)
+	// GetDevices returns all devices, sorted by MAC address.
+	GetDevices() ([]*Device, error)
+
+	// ClaimDevice marks a device with a given mac address, hostname and DHCP
+	// client ID as managed/claimed by the given user.
+	//
+	// If the same user already claimed this device (by MAC address, primary
+	// or additional) the hostname and client ID are updated (upsert
+	// semantics).
+	//
+	// If some other user already claim this device (by MAC address) an error
+	// is returned.
+	ClaimDevice(user string, macAddress net.HardwareAddr, hostname, clientID string) error
+	// UnclaimDevice releases a device from being managed by the user. If the
+	// device is managed by some other user, an error is returned. The device
+	// can be given by any of its MAC addresses.
+	UnclaimDevice(user string, macAddress net.HardwareAddr) error
+	// AddDeviceAddress adds an additional MAC address to a user's device. If
+	// the address is already the primary address of another device of that
+	// user, that device is merged into this one. If the address belongs to
+	// some other user, an error is returned.
+	AddDeviceAddress(user string, device, macAddress net.HardwareAddr) error
+	// RemoveDeviceAddress removes an additional MAC address from a user's
+	// device. The primary address of a device cannot be removed, the device
+	// should be unclaimed instead.
+	RemoveDeviceAddress(user string, device, macAddress net.HardwareAddr) error
+	// SetDeviceMatching configures whether leases should be matched to a
+	// user's device by DHCP client ID and/or hostname, in addition to MAC
+	// addresses.
+	SetDeviceMatching(user string, device net.HardwareAddr, clientID, hostname bool) error
+	// SetDeviceVisibility sets the visibility of a user's device, overriding
+	// the user's default visibility. The device can be given by any of its
+	// MAC addresses. If it doesn't exist or belongs to another user, an error
+	// is returned and nothing is changed.
+	SetDeviceVisibility(user string, device net.HardwareAddr, visibility Visibility) error
+	// SetDeviceMetadata replaces the name, type and notes of a user's
+	// device, which must have been validated by the caller (see
+	// DeviceMetadata.validate). Like SetDeviceVisibility, it fails without
+	// changing anything if the device doesn't belong to the user.
+	SetDeviceMetadata(user string, device net.HardwareAddr, metadata DeviceMetadata) error
+
+	// GetEquipment returns all equipment of the space.
+	GetEquipment() ([]*Equipment, error)
+	// PutEquipment marks a MAC address as equipment, or updates existing
+	// equipment. If the address is claimed by a user, an error wrapping
+	// ErrConflict is returned. Claiming equipment fails.
+	PutEquipment(e *Equipment) error
+	// RemoveEquipment removes a MAC address from equipment, allowing it to
+	// be claimed again.
+	RemoveEquipment(mac net.HardwareAddr) error
+
+	// CheckIn stores a manual check-in, replacing any previous check-in of
+	// the same user.
+	CheckIn(c *CheckIn) error
+	// CheckOut removes a user's manual check-in, if any.
+	CheckOut(user string) error
+	// GetCheckIns returns all manual check-ins which haven't expired at now,
+	// sorted by username.
+	GetCheckIns(now time.Time) ([]*CheckIn, error)
+
+	// GetSubscriptions returns all notification subscriptions, sorted by
+	// username and creation time.
+	GetSubscriptions() ([]*Subscription, error)
+	// PutSubscription stores a subscription, replacing an existing one with
+	// the same ID. If that belongs to another user, an error is returned.
+	PutSubscription(sub *Subscription) error
+	// RemoveSubscription removes a user's subscription. If there is no such
+	// subscription of the user, an error is returned.
+	RemoveSubscription(user, id string) error
+
+	// RenameUser moves all devices and data (settings, check-in and
+	// subscriptions) of a user to a different user, revoking the sessions
+	// of the old name. It refuses to overwrite the target user's settings
+	// or check-in. It returns the number of devices moved.
+	RenameUser(from, to string) (int, error)
+	// GetUser returns the stored data of a user, or a zero User (with only
+	// Username set) if there is none.
+	GetUser(username string) (*User, error)
+	// RevokeSessions invalidates all existing sessions of a user by
+	// incrementing their session generation.
+	RevokeSessions(username string) error
+	// SetUserVisibility sets the default visibility of a user's devices.
+	SetUserVisibility(username string, visibility Visibility) error
+	// SetUserStatus sets (or, if nil, clears) a user's status message.
+	SetUserStatus(username string, status *Status) error
+	// SetUserAPIToken sets the hash of a user's API token, replacing any
+	// previous one. An empty hash revokes the token.
+	SetUserAPIToken(username, hash string) error
+	// GetUserByAPIToken returns the user with the given API token hash, or
+	// nil if there is none.
+	GetUserByAPIToken(hash string) (*User, error)
+	// GetUsers returns all users with stored data, sorted by username.
+	GetUsers() ([]*User, error)
+
+	// MarkDevicesSeen sets the last seen time of all devices matching the
+	// given leases, clearing their stale flag. Last seen times are only
+	// updated once they're lastSeenGranularity old.
+	MarkDevicesSeen(leases []*Lease, at time.Time) error
+	// ExpireDevices finds all devices which haven't been seen since cutoff,
+	// and either unclaims them (if unclaim is true) or flags them as stale.
+	// Devices which have never been seen and have no claim time are skipped.
+	// The affected devices are returned. If dryRun is true, the database is
+	// not modified.
+	ExpireDevices(cutoff time.Time, unclaim, dryRun bool) ([]*Device, error)
+
+	// ImportDevice stores a device as given, eg. from an export. If an
+	// identical device already exists, nothing is done. If the device
+	// conflicts with an existing device (by any of its MAC addresses, or its
+	// client ID or hostname matching) an error wrapping ErrConflict is
+	// returned.
+	ImportDevice(device *Device) error
+
+	// Check performs a full consistency check of the database and returns a
+	// list of all problems found.
+	Check() ([]string, error)
+	// Close closes the underlying database.
+	Close() error
+}
+
+// Backuper is implemented by Stores which can write a consistent snapshot of
+// their underlying database file while in use.
+type Backuper interface {
+	// Backup writes a copy of the database file to w, returning the number of
+	// bytes written.
+	Backup(w io.Writer) (int64, error)
+}
+
+var (
+	_ Store    = &BoltDatabase{}
+	_ Store    = &SQLiteDatabase{}
+	_ Backuper = &BoltDatabase{}
+	_ Backuper = &SQLiteDatabase{}
+)
+
+// OpenStore opens a Store of a given type ("bolt" or "sqlite") at a given path,
+// creating it if needed.
+func OpenStore(kind, path string) (Store, error) {
+	switch kind {
+	case "bolt":
+		return NewBoltDatabase(path)
+	case "sqlite":
+		return NewSQLiteDatabase(path)
+	default:
+		return nil, fmt.Errorf("unknown database type %q", kind)
+	}
+}
+
+// devicesEqual returns true if two devices have the same data.
+func devicesEqual(a, b *Device) bool {
+	if len(a.AdditionalMACAddresses) != len(b.AdditionalMACAddresses) {
+		return false
+	}
+	for i := range a.AdditionalMACAddresses {
+		if a.AdditionalMACAddresses[i] != b.AdditionalMACAddresses[i] {
+			return false
+		}
+	}
+	return a.MACAddress == b.MACAddress &&
+		a.Hostname == b.Hostname &&
+		a.UserNickname == b.UserNickname &&
+		a.ClientID == b.ClientID &&
+		a.MatchClientID == b.MatchClientID &&
+		a.MatchHostname == b.MatchHostname &&
+		a.ClaimedAt.Equal(b.ClaimedAt) &&
+		a.LastSeenAt.Equal(b.LastSeenAt) &&
+		a.Stale == b.Stale &&
+		a.Visibility == b.Visibility &&
+		a.Metadata() == b.Metadata()
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// ignoreTimestamps ignores Device fields which are set from the current time.
+var ignoreTimestamps = cmpopts.IgnoreFields(Device{}, "ClaimedAt", "LastSeenAt")
+
+// storeTypes are all Store implementations, which are tested against the same
+// conformance suite by TestStores.
+var storeTypes = []string{"bolt", "sqlite"}
+
+// storeTests is the conformance suite that all Store implementations must
+// pass.
+var storeTests = []struct {
+	name string
+	fn   func(t *testing.T, db Store)
+}{
+	{"Basic", testStoreBasic},
+	{"Addresses", testStoreAddresses},
+	{"Expiry", testStoreExpiry},
+	{"RenameUser", testStoreRenameUser},
+	{"Users", testStoreUsers},
+	{"Visibility", testStoreVisibility},
+	{"Equipment", testStoreEquipment},
+	{"CheckIns", testStoreCheckIns},
+	{"DeviceMetadata", testStoreDeviceMetadata},
+	{"Subscriptions", testStoreSubscriptions},
+}
+
+func TestStores(t *testing.T) {
+	for _, kind := range storeTypes {
+		for _, test := range storeTests {
+			t.Run(kind+"/"+test.name, func(t *testing.T) {
+				db, err := OpenStore(kind, t.TempDir()+"/db")
+				if err != nil {
+					t.Fatalf("could not create DB: %v", err)
+				}
+				defer db.Close()
+				test.fn(t, db)
+
+				// No test should leave the database in an inconsistent state.
+				problems, err := db.Check()
+				if err != nil {
+					t.Fatalf("could not check DB: %v", err)
+				}
+				if len(problems) != 0 {
+					t.Errorf("database inconsistent: %v", problems)
+				}
+			})
+		}
+	}
+}
+
+func TestStoreLocked(t *testing.T) {
+	for _, kind := range storeTypes {
+		t.Run(kind, func(t *testing.T) {
+			path := t.TempDir() + "/db"
+			db, err := OpenStore(kind, path)
+			if err != nil {
+				t.Fatalf("could not create DB: %v", err)
+			}
+			if _, err := OpenStore(kind, path); !errors.Is(err, ErrLocked) {
+				t.Fatalf("expected second open to fail with ErrLocked, got %v", err)
+			}
+			db.Close()
+			db, err = OpenStore(kind, path)
+			if err != nil {
+				t.Fatalf("could not reopen DB: %v", err)
+			}
+			db.Close()
+		})
+	}
+}
+
+func testStoreBasic(t *testing.T, db Store) {
+	if err := db.ClaimDevice("jane", net.HardwareAddr([]byte{0, 1, 2, 3, 4, 5}), "stinkpad", ""); err != nil {
+		t.Fatalf("could not claim first device: %v", err)
+	}
+	if err := db.ClaimDevice("joe", net.HardwareAddr([]byte{0, 1, 2, 3, 4, 6}), "crapbook", ""); err != nil {
+		t.Fatalf("could not claim second device: %v", err)
+	}
+
+	devices, err := db.GetDevicesForMacAddresses([]net.HardwareAddr{
+		{0, 1, 2, 3, 4, 5},
+		{0, 1, 2, 3, 4, 6},
+		{0, 1, 2, 3, 4, 7},
+	})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if diff := cmp.Diff(devices, []*Device{
+		{MACAddress: "00:01:02:03:04:05", UserNickname: "jane", Hostname: "stinkpad"},
+		{MACAddress: "00:01:02:03:04:06", UserNickname: "joe", Hostname: "crapbook"},
+	}, ignoreTimestamps); diff != "" {
+		t.Error(diff)
+	}
+
+	// Attempt to double claim device.
+	if err := db.ClaimDevice("joe", net.HardwareAddr([]byte{0, 1, 2, 3, 4, 5}), "crapbook", ""); err == nil {
+		t.Fatalf("should not be able to double claim device")
+	}
+
+	// Update joe's device - this should work.
+	if err := db.ClaimDevice("joe", net.HardwareAddr([]byte{0, 1, 2, 3, 4, 6}), "crapbook2", ""); err != nil {
+		t.Fatalf("could not update second device: %v", err)
+	}
+
+	devices, err = db.GetDevicesForMacAddresses([]net.HardwareAddr{
+		{0, 1, 2, 3, 4, 6},
+		{0, 1, 2, 3, 4, 7},
+	})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if diff := cmp.Diff(devices, []*Device{
+		{MACAddress: "00:01:02:03:04:06", UserNickname: "joe", Hostname: "crapbook2"},
+	}, ignoreTimestamps); diff != "" {
+		t.Error(diff)
+	}
+
+	// Unclaim jane's device.
+	if err := db.UnclaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}); err != nil {
+		t.Fatalf("could not unclaim device: %v", err)
+	}
+
+	// Falsely unclaim joe's device as jane's.
+	if err := db.UnclaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 6}); err == nil {
+		t.Fatalf("should not be able to unclaim someone else's device")
+	}
+
+	devices, err = db.GetDevicesForMacAddresses([]net.HardwareAddr{
+		{0, 1, 2, 3, 4, 5},
+		{0, 1, 2, 3, 4, 6},
+		{0, 1, 2, 3, 4, 7},
+	})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if diff := cmp.Diff(devices, []*Device{
+		{MACAddress: "00:01:02:03:04:06", UserNickname: "joe", Hostname: "crapbook2"},
+	}, ignoreTimestamps); diff != "" {
+		t.Error(diff)
+	}
+
+}
+
+func testStoreAddresses(t *testing.T, db Store) {
+
+	phone := net.HardwareAddr{0x02, 1, 2, 3, 4, 5}
+	rotated := net.HardwareAddr{0x06, 1, 2, 3, 4, 5}
+	if err := db.ClaimDevice("jane", phone, "pixel", "01:02:01:02:03:04:05"); err != nil {
+		t.Fatalf("could not claim phone: %v", err)
+	}
+	// Phone rotated its address, and jane claimed it again as a new device.
+	if err := db.ClaimDevice("jane", rotated, "pixel", "01:06:01:02:03:04:05"); err != nil {
+		t.Fatalf("could not claim rotated phone: %v", err)
+	}
+	if err := db.ClaimDevice("joe", net.HardwareAddr{0, 1, 2, 3, 4, 6}, "crapbook", ""); err != nil {
+		t.Fatalf("could not claim joe's device: %v", err)
+	}
+
+	// Merge rotated address into the original phone.
+	if err := db.AddDeviceAddress("jane", phone, rotated); err != nil {
+		t.Fatalf("could not add address: %v", err)
+	}
+	// Joe's address can't be stolen.
+	if err := db.AddDeviceAddress("jane", phone, net.HardwareAddr{0, 1, 2, 3, 4, 6}); err == nil {
+		t.Fatalf("should not be able to add someone else's address")
+	}
+
+	devices, err := db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if diff := cmp.Diff(devices, []*Device{
+		{MACAddress: "02:01:02:03:04:05", AdditionalMACAddresses: []string{"06:01:02:03:04:05"}, UserNickname: "jane", Hostname: "pixel", ClientID: "01:02:01:02:03:04:05"},
+	}, ignoreTimestamps); diff != "" {
+		t.Error(diff)
+	}
+
+	// Both addresses resolve to the same device.
+	devices, err = db.GetDevicesForMacAddresses([]net.HardwareAddr{phone, rotated})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].MACAddress != "02:01:02:03:04:05" {
+		t.Errorf("expected single phone device, got %+v", devices)
+	}
+
+	// A completely new address is only matched by hostname once enabled.
+	unknown := &Lease{MACAddress: net.HardwareAddr{0x0a, 1, 2, 3, 4, 5}, Hostname: "pixel"}
+	devices, err = db.GetDevicesForLeases([]*Lease{unknown})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("expected no devices, got %+v", devices)
+	}
+	if err := db.SetDeviceMatching("jane", rotated, false, true); err != nil {
+		t.Fatalf("could not set matching: %v", err)
+	}
+	devices, err = db.GetDevicesForLeases([]*Lease{unknown})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].UserNickname != "jane" {
+		t.Errorf("expected jane's phone, got %+v", devices)
+	}
+	// Joe can't match by the same hostname.
+	if err := db.ClaimDevice("joe", net.HardwareAddr{0, 1, 2, 3, 4, 6}, "pixel", ""); err != nil {
+		t.Fatalf("could not update joe's device: %v", err)
+	}
+	if err := db.SetDeviceMatching("joe", net.HardwareAddr{0, 1, 2, 3, 4, 6}, false, true); err == nil {
+		t.Fatalf("should not be able to match by a hostname already matched by another device")
+	}
+
+	// Removing the additional address makes it unknown again, and unclaiming
+	// cleans up the hostname match.
+	if err := db.RemoveDeviceAddress("jane", phone, rotated); err != nil {
+		t.Fatalf("could not remove address: %v", err)
+	}
+	if err := db.UnclaimDevice("jane", phone); err != nil {
+		t.Fatalf("could not unclaim: %v", err)
+	}
+	devices, err = db.GetDevicesForLeases([]*Lease{unknown, {MACAddress: rotated}})
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("expected no devices, got %+v", devices)
+	}
+}
+
+func testStoreExpiry(t *testing.T, db Store) {
+
+	laptop := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	phone := net.HardwareAddr{0, 1, 2, 3, 4, 6}
+	if err := db.ClaimDevice("jane", laptop, "stinkpad", ""); err != nil {
+		t.Fatalf("could not claim laptop: %v", err)
+	}
+	if err := db.ClaimDevice("jane", phone, "pixel", ""); err != nil {
+		t.Fatalf("could not claim phone: %v", err)
+	}
+
+	// A month later, only the phone is still around.
+	later := time.Now().Add(30 * 24 * time.Hour)
+	if err := db.MarkDevicesSeen([]*Lease{{MACAddress: phone}}, later); err != nil {
+		t.Fatalf("could not mark devices as seen: %v", err)
+	}
+	// Seeing it again shortly after doesn't rewrite it.
+	if err := db.MarkDevicesSeen([]*Lease{{MACAddress: phone}}, later.Add(10*time.Minute)); err != nil {
+		t.Fatalf("could not mark devices as seen: %v", err)
+	}
+	if devices, err := db.GetDevicesForMacAddresses([]net.HardwareAddr{phone}); err != nil || len(devices) != 1 || !devices[0].LastSeenAt.Equal(later) {
+		t.Errorf("expected last seen time %s, got %+v (%v)", later, devices, err)
+	}
+
+	cutoff := later.Add(-7 * 24 * time.Hour)
+	for _, dryRun := range []bool{true, false} {
+		expired, err := db.ExpireDevices(cutoff, false, dryRun)
+		if err != nil {
+			t.Fatalf("could not expire devices: %v", err)
+		}
+		if diff := cmp.Diff(expired, []*Device{
+			{MACAddress: "00:01:02:03:04:05", UserNickname: "jane", Hostname: "stinkpad"},
+		}, ignoreTimestamps); diff != "" {
+			t.Errorf("dryRun %v: %s", dryRun, diff)
+		}
+	}
+	devices, err := db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 2 || !devices[0].Stale || devices[1].Stale {
+		t.Fatalf("expected laptop to be flagged as stale, got %+v", devices)
+	}
+
+	// Flagging again is a no-op, but unclaiming removes the laptop.
+	expired, err := db.ExpireDevices(cutoff, false, false)
+	if err != nil {
+		t.Fatalf("could not expire devices: %v", err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("expected no newly flagged devices, got %+v", expired)
+	}
+	if _, err := db.ExpireDevices(cutoff, true, false); err != nil {
+		t.Fatalf("could not expire devices: %v", err)
+	}
+	devices, err = db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].Hostname != "pixel" || !devices[0].LastSeenAt.Equal(later) {
+		t.Fatalf("expected only phone to remain, got %+v", devices)
+	}
+}
+
+func testStoreRenameUser(t *testing.T, db Store) {
+	if err := db.ClaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, "stinkpad", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := db.ClaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 6}, "pixel", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := db.ClaimDevice("joe", net.HardwareAddr{0, 1, 2, 3, 4, 7}, "crapbook", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+
+	if err := db.SetUserVisibility("jane", VisibilityCountOnly); err != nil {
+		t.Fatalf("could not set visibility: %v", err)
+	}
+	status := &Status{Text: "soldering", SetAt: time.Now().Truncate(time.Second)}
+	if err := db.SetUserStatus("jane", status); err != nil {
+		t.Fatalf("could not set status: %v", err)
+	}
+	if err := db.SetUserAPIToken("jane", "hash"); err != nil {
+		t.Fatalf("could not set API token: %v", err)
+	}
+	checkIn := &CheckIn{Username: "jane", CheckedInAt: time.Now().Truncate(time.Second), Until: time.Now().Add(time.Hour).Truncate(time.Second)}
+	if err := db.CheckIn(checkIn); err != nil {
+		t.Fatalf("could not check in: %v", err)
+	}
+	if err := db.PutSubscription(&Subscription{ID: "1", Username: "jane", Event: EventOpen, Channel: "email", Target: "jane@example.com"}); err != nil {
+		t.Fatalf("could not subscribe: %v", err)
+	}
+
+	n, err := db.RenameUser("jane", "joe")
+	if err != nil {
+		t.Fatalf("could not rename user: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 devices to be moved, got %d", n)
+	}
+	devices, err := db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("expected no devices for jane, got %+v", devices)
+	}
+	devices, err = db.GetDevicesForUser("joe")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 3 {
+		t.Errorf("expected 3 devices for joe, got %+v", devices)
+	}
+
+	// Settings, check-ins and subscriptions moved along, and sessions of the
+	// old name are revoked.
+	user, err := db.GetUser("joe")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if diff := cmp.Diff(&User{Username: "joe", Visibility: VisibilityCountOnly, Status: status, APITokenHash: "hash"}, user); diff != "" {
+		t.Errorf("renamed user: %s", diff)
+	}
+	if user, err := db.GetUserByAPIToken("hash"); err != nil || user == nil || user.Username != "joe" {
+		t.Errorf("API token doesn't belong to joe: %+v (%v)", user, err)
+	}
+	user, err = db.GetUser("jane")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if diff := cmp.Diff(&User{Username: "jane", SessionGeneration: 1}, user); diff != "" {
+		t.Errorf("old user: %s", diff)
+	}
+	checkIns, err := db.GetCheckIns(time.Now())
+	if err != nil {
+		t.Fatalf("could not get check-ins: %v", err)
+	}
+	if len(checkIns) != 1 || checkIns[0].Username != "joe" {
+		t.Errorf("expected check-in of joe, got %+v", checkIns)
+	}
+	subs, err := db.GetSubscriptions()
+	if err != nil {
+		t.Fatalf("could not get subscriptions: %v", err)
+	}
+	if len(subs) != 1 || subs[0].Username != "joe" {
+		t.Errorf("expected subscription of joe, got %+v", subs)
+	}
+
+	// Settings of the target user aren't overwritten.
+	if err := db.SetUserVisibility("jim", VisibilityHidden); err != nil {
+		t.Fatalf("could not set visibility: %v", err)
+	}
+	if _, err := db.RenameUser("joe", "jim"); err == nil {
+		t.Errorf("rename overwrote settings of jim")
+	}
+	if devices, err := db.GetDevicesForUser("joe"); err != nil || len(devices) != 3 {
+		t.Errorf("failed rename moved devices: %+v (%v)", devices, err)
+	}
+}
+
+func testStoreUsers(t *testing.T, db Store) {
+	user, err := db.GetUser("jane")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if diff := cmp.Diff(user, &User{Username: "jane"}); diff != "" {
+		t.Errorf("unknown user: %s", diff)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := db.RevokeSessions("jane"); err != nil {
+			t.Fatalf("could not revoke sessions: %v", err)
+		}
+	}
+	user, err = db.GetUser("jane")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if diff := cmp.Diff(user, &User{Username: "jane", SessionGeneration: 2}); diff != "" {
+		t.Errorf("after revocation: %s", diff)
+	}
+	user, err = db.GetUser("joe")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if user.SessionGeneration != 0 {
+		t.Errorf("other user affected by revocation: %+v", user)
+	}
+
+	status := &Status{Text: "Soldering", Emoji: "🔥", SetAt: time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC), ClearOnLeave: true}
+	if err := db.SetUserStatus("jane", status); err != nil {
+		t.Fatalf("could not set status: %v", err)
+	}
+	user, err = db.GetUser("jane")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if diff := cmp.Diff(user, &User{Username: "jane", SessionGeneration: 2, Status: status}); diff != "" {
+		t.Errorf("after setting status: %s", diff)
+	}
+	if err := db.SetUserStatus("jane", nil); err != nil {
+		t.Fatalf("could not clear status: %v", err)
+	}
+	user, err = db.GetUser("jane")
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if user.Status != nil {
+		t.Errorf("status not cleared: %+v", user.Status)
+	}
+
+	if err := db.SetUserAPIToken("jane", "hash"); err != nil {
+		t.Fatalf("could not set API token: %v", err)
+	}
+	for hash, want := range map[string]string{"hash": "jane", "other": "", "": ""} {
+		user, err := db.GetUserByAPIToken(hash)
+		if err != nil {
+			t.Fatalf("could not get user by API token: %v", err)
+		}
+		var got string
+		if user != nil {
+			got = user.Username
+		}
+		if got != want {
+			t.Errorf("API token %q: got user %q, want %q", hash, got, want)
+		}
+	}
+	if err := db.SetUserAPIToken("jane", ""); err != nil {
+		t.Fatalf("could not revoke API token: %v", err)
+	}
+	if user, err := db.GetUserByAPIToken("hash"); err != nil || user != nil {
+		t.Errorf("revoked API token: got %+v, %v", user, err)
+	}
+}
+
+func testStoreDeviceMetadata(t *testing.T, db Store) {
+	laptop := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	if err := db.ClaimDevice("jane", laptop, "laptop", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	metadata := DeviceMetadata{Name: "work laptop", Type: DeviceTypeLaptop, Notes: "the one with stickers"}
+	if err := db.SetDeviceMetadata("joe", laptop, metadata); err == nil {
+		t.Errorf("could set metadata of someone else's device")
+	}
+	if err := db.SetDeviceMetadata("jane", laptop, metadata); err != nil {
+		t.Fatalf("could not set metadata: %v", err)
+	}
+	// Reclaiming updates the hostname but keeps metadata.
+	if err := db.ClaimDevice("jane", laptop, "laptop-2", ""); err != nil {
+		t.Fatalf("could not reclaim device: %v", err)
+	}
+	devices, err := db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices, want 1", len(devices))
+	}
+	if diff := cmp.Diff(metadata, devices[0].Metadata()); diff != "" {
+		t.Errorf("metadata: %s", diff)
+	}
+	if want, got := "work laptop", devices[0].DisplayName(); want != got {
+		t.Errorf("display name: want %q, got %q", want, got)
+	}
+	if err := db.SetDeviceMetadata("jane", laptop, DeviceMetadata{}); err != nil {
+		t.Fatalf("could not clear metadata: %v", err)
+	}
+	devices, err = db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if want, got := "laptop-2", devices[0].DisplayName(); want != got {
+		t.Errorf("display name: want %q, got %q", want, got)
+	}
+}
+
+func testStoreVisibility(t *testing.T, db Store) {
+	if err := db.ClaimDevice("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, "tablet", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := db.SetDeviceVisibility("jane", net.HardwareAddr{0, 1, 2, 3, 4, 5}, VisibilityHidden); err != nil {
+		t.Fatalf("could not set device visibility: %v", err)
+	}
+	if err := db.SetDeviceVisibility("joe", net.HardwareAddr{0, 1, 2, 3, 4, 5}, VisibilityVisible); err == nil {
+		t.Errorf("could set visibility of someone else's device")
+	}
+	devices, err := db.GetDevicesForUser("jane")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].Visibility != VisibilityHidden {
+		t.Errorf("device visibility not stored, got %+v", devices)
+	}
+
+	// User settings are kept separately from sessions.
+	if err := db.RevokeSessions("jane"); err != nil {
+		t.Fatalf("could not revoke sessions: %v", err)
+	}
+	if err := db.SetUserVisibility("jane", VisibilityCountOnly); err != nil {
+		t.Fatalf("could not set user visibility: %v", err)
+	}
+	if err := db.SetUserVisibility("joe", VisibilityHidden); err != nil {
+		t.Fatalf("could not set user visibility: %v", err)
+	}
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatalf("could not get users: %v", err)
+	}
+	want := []*User{
+		{Username: "jane", SessionGeneration: 1, Visibility: VisibilityCountOnly},
+		{Username: "joe", Visibility: VisibilityHidden},
+	}
+	if diff := cmp.Diff(want, users); diff != "" {
+		t.Errorf("users: %s", diff)
+	}
+}
+
+func testStoreEquipment(t *testing.T, db Store) {
+	printer := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	laptop := net.HardwareAddr{0, 1, 2, 3, 4, 6}
+	if err := db.PutEquipment(&Equipment{MACAddress: printer.String(), Description: "Printer", AddedBy: "q3k"}); err != nil {
+		t.Fatalf("could not add equipment: %v", err)
+	}
+	// Updates are fine.
+	if err := db.PutEquipment(&Equipment{MACAddress: "00-01-02-03-04-05", Description: "Laser printer", AddedBy: "q3k"}); err != nil {
+		t.Fatalf("could not update equipment: %v", err)
+	}
+	equipment, err := db.GetEquipment()
+	if err != nil {
+		t.Fatalf("could not get equipment: %v", err)
+	}
+	want := []*Equipment{{MACAddress: printer.String(), Description: "Laser printer", AddedBy: "q3k"}}
+	if diff := cmp.Diff(want, equipment); diff != "" {
+		t.Errorf("equipment: %s", diff)
+	}
+
+	// Equipment can't be claimed, neither directly nor as an additional
+	// address.
+	if err := db.ClaimDevice("jane", printer, "printer", ""); err == nil {
+		t.Errorf("could claim equipment")
+	}
+	if err := db.ClaimDevice("jane", laptop, "laptop", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := db.AddDeviceAddress("jane", laptop, printer); err == nil {
+		t.Errorf("could add equipment address to device")
+	}
+	if err := db.ImportDevice(&Device{MACAddress: printer.String(), UserNickname: "jane"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("importing equipment as device: expected conflict, got %v", err)
+	}
+
+	// Claimed devices can't become equipment.
+	if err := db.PutEquipment(&Equipment{MACAddress: laptop.String(), Description: "Laptop"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("marking claimed device as equipment: expected conflict, got %v", err)
+	}
+
+	// Removed equipment can be claimed again.
+	if err := db.RemoveEquipment(printer); err != nil {
+		t.Fatalf("could not remove equipment: %v", err)
+	}
+	if err := db.ClaimDevice("jane", printer, "printer", ""); err != nil {
+		t.Errorf("could not claim removed equipment: %v", err)
+	}
+	equipment, err = db.GetEquipment()
+	if err != nil {
+		t.Fatalf("could not get equipment: %v", err)
+	}
+	if len(equipment) != 0 {
+		t.Errorf("expected no equipment, got %+v", equipment)
+	}
+}
+
+func testStoreCheckIns(t *testing.T, db Store) {
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	for _, c := range []*CheckIn{
+		{Username: "jane", CheckedInAt: now.Add(-time.Hour), Until: now.Add(time.Hour)},
+		{Username: "bob", CheckedInAt: now.Add(-5 * time.Hour), Until: now.Add(-time.Hour)},
+		{Username: "alice", CheckedInAt: now, Until: now.Add(4 * time.Hour)},
+	} {
+		if err := db.CheckIn(c); err != nil {
+			t.Fatalf("could not check in: %v", err)
+		}
+	}
+	// Checking in again replaces the previous check-in.
+	if err := db.CheckIn(&CheckIn{Username: "jane", CheckedInAt: now.Add(-time.Hour), Until: now.Add(3 * time.Hour)}); err != nil {
+		t.Fatalf("could not extend check-in: %v", err)
+	}
+
+	checkIns, err := db.GetCheckIns(now)
+	if err != nil {
+		t.Fatalf("could not get check-ins: %v", err)
+	}
+	want := []*CheckIn{
+		{Username: "alice", CheckedInAt: now, Until: now.Add(4 * time.Hour)},
+		{Username: "jane", CheckedInAt: now.Add(-time.Hour), Until: now.Add(3 * time.Hour)},
+	}
+	if diff := cmp.Diff(want, checkIns); diff != "" {
+		t.Errorf("check-ins: %s", diff)
+	}
+
+	if err := db.CheckOut("alice"); err != nil {
+		t.Fatalf("could not check out: %v", err)
+	}
+	// Checking out without being checked in is fine.
+	if err := db.CheckOut("bob"); err != nil {
+		t.Fatalf("could not check out: %v", err)
+	}
+	checkIns, err = db.GetCheckIns(now)
+	if err != nil {
+		t.Fatalf("could not get check-ins: %v", err)
+	}
+	if diff := cmp.Diff(want[1:], checkIns); diff != "" {
+		t.Errorf("check-ins after check-out: %s", diff)
+	}
+}
+
+func testStoreSubscriptions(t *testing.T, db Store) {
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	subs := []*Subscription{
+		{ID: "b", Username: "jane", Event: EventArrival, Users: []string{"alice", "bob"}, Channel: "email", Target: "jane@example.com", QuietStart: 22 * 60, QuietEnd: 7 * 60, MinInterval: time.Hour, CreatedAt: now},
+		{ID: "a", Username: "jane", Event: EventClose, Channel: "ntfy", Target: "jane", CreatedAt: now.Add(time.Minute)},
+		{ID: "c", Username: "alice", Event: EventOpen, Channel: "webhook", Target: "https://example.com/hook", CreatedAt: now},
+	}
+	for _, sub := range subs {
+		if err := db.PutSubscription(sub); err != nil {
+			t.Fatalf("could not put subscription: %v", err)
+		}
+	}
+	if err := db.PutSubscription(&Subscription{ID: "a", Username: "joe", Event: EventOpen, Channel: "ntfy", Target: "joe"}); err == nil {
+		t.Errorf("could replace someone else's subscription")
+	}
+	got, err := db.GetSubscriptions()
+	if err != nil {
+		t.Fatalf("could not get subscriptions: %v", err)
+	}
+	if diff := cmp.Diff([]*Subscription{subs[2], subs[0], subs[1]}, got); diff != "" {
+		t.Errorf("subscriptions: %s", diff)
+	}
+
+	if err := db.RemoveSubscription("alice", "a"); err == nil {
+		t.Errorf("could remove someone else's subscription")
+	}
+	if err := db.RemoveSubscription("jane", "x"); err == nil {
+		t.Errorf("could remove nonexistent subscription")
+	}
+	if err := db.RemoveSubscription("jane", "a"); err != nil {
+		t.Fatalf("could not remove subscription: %v", err)
+	}
+	got, err = db.GetSubscriptions()
+	if err != nil {
+		t.Fatalf("could not get subscriptions: %v", err)
+	}
+	if diff := cmp.Diff([]*Subscription{subs[2], subs[0]}, got); diff != "" {
+		t.Errorf("subscriptions after removal: %s", diff)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// claimVerificationTimeout is how long users have to finish claiming a device
+// from the device itself after starting to claim it from the list of unclaimed
+// devices.
+const claimVerificationTimeout = 15 * time.Minute
+
+// unclaimedLeases returns the active leases (other than those of equipment)
+// which don't belong to any claimed device, one per MAC address, sorted by MAC
+// address.
+func (s *Service) unclaimedLeases() ([]*Lease, error) {
+	leases, err := s.cfg().Leases.Leases()
+	if err != nil {
+		return nil, fmt.Errorf("could not get leases: %w", err)
+	}
+	equipment, err := s.Database.GetEquipment()
+	if err != nil {
+		return nil, fmt.Errorf("could not get equipment: %w", err)
+	}
+	isEquipment := make(map[string]bool)
+	for _, e := range equipment {
+		isEquipment[e.MACAddress] = true
+	}
+
+	now := s.timeNow()
+	latest := make(map[string]*Lease)
+	for _, lease := range leases {
+		mac := lease.MACAddress.String()
+		if isEquipment[mac] || !s.leaseActiveUntil(lease).After(now) {
+			continue
+		}
+		if l, ok := latest[mac]; !ok || lease.Expires.After(l.Expires) {
+			latest[mac] = lease
+		}
+	}
+	active := make([]*Lease, 0, len(latest))
+	for _, lease := range latest {
+		active = append(active, lease)
+	}
+	devices, err := s.Database.GetDevicesForLeases(active)
+	if err != nil {
+		return nil, fmt.Errorf("could not get devices: %w", err)
+	}
+
+	var res []*Lease
+	for _, lease := range active {
+		claimed := false
+		for _, d := range devices {
+			if leaseMatches(d, lease) {
+				claimed = true
+				break
+			}
+		}
+		if !claimed {
+			res = append(res, lease)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].MACAddress.String() < res[j].MACAddress.String()
+	})
+	return res, nil
+}
+
+// claimVerifications keeps track of users claiming devices from the list of
+// unclaimed devices. As these usually aren't the devices the users are
+// connecting from, they have to prove ownership by finishing the claim from the
+// device itself. Lease renewals are no proof, as devices renew their leases
+// periodically on their own. Pending claims are kept in memory only.
+type claimVerifications struct {
+	mu sync.Mutex
+	// pending are claims by MAC address. Only one user at a time can claim
+	// a device.
+	pending map[string]*claimVerification
+}
+
+type claimVerification struct {
+	Username  string
+	StartedAt time.Time
+}
+
+// ExpiresAt is when the claim has to be verified by.
+func (v *claimVerification) ExpiresAt() time.Time {
+	return v.StartedAt.Add(claimVerificationTimeout)
+}
+
+// start starts a user's claim of the device holding a lease. Errors are
+// user-presentable.
+func (c *claimVerifications) start(user string, lease *Lease, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[string]*claimVerification)
+	}
+	for mac, v := range c.pending {
+		if !now.Before(v.ExpiresAt()) {
+			delete(c.pending, mac)
+		}
+	}
+	mac := lease.MACAddress.String()
+	if v, ok := c.pending[mac]; ok && v.Username != user {
+		return fmt.Errorf("Someone else is already claiming this device, try again in a few minutes.")
+	}
+	c.pending[mac] = &claimVerification{
+		Username:  user,
+		StartedAt: now,
+	}
+	return nil
+}
+
+// get returns a user's pending claim of a device, or nil if there is none.
+func (c *claimVerifications) get(user string, mac net.HardwareAddr, now time.Time) *claimVerification {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.pending[mac.String()]
+	if !ok || v.Username != user || !now.Before(v.ExpiresAt()) {
+		return nil
+	}
+	return v
+}
+
+func (c *claimVerifications) remove(mac net.HardwareAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, mac.String())
+}
+
+// unclaimedDevice is an unclaimed device as shown to users.
+type unclaimedDevice struct {
+	*Lease
+	Vendor string
+	// Claim is the user's pending claim of the device, if any.
+	Claim *claimVerification
+	// Current is true if the user is connecting from the device, and can
+	// thus finish claiming it.
+	Current bool
+}
+
+// viewUnclaimed lists the unclaimed devices which are online, allowing users
+// to claim them.
+func (s *Service) viewUnclaimed(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+
+	leases, err := s.unclaimedLeases()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get unclaimed devices: %v", err)
+		return
+	}
+	current, _, err := s.currentLease(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	now := s.timeNow()
+	devices := make([]unclaimedDevice, 0, len(leases))
+	for _, lease := range leases {
+		devices = append(devices, unclaimedDevice{
+			Lease:   lease,
+			Vendor:  macVendor(lease.MACAddress),
+			Claim:   s.claims.get(session.Username, lease.MACAddress, now),
+			Current: current != nil && current.MACAddress.String() == lease.MACAddress.String(),
+		})
+	}
+
+	token := s.csrfToken(w, session)
+	templateUnclaimed.Execute(w, map[string]any{
+		"Username":  session.Username,
+		"CSRFToken": token,
+		"Devices":   devices,
+		"SpaceName": s.cfg().SpaceName,
+	})
+}
+
+// unclaimedLease returns the lease of an unclaimed device, or nil if the
+// device isn't online or is claimed.
+func (s *Service) unclaimedLease(mac net.HardwareAddr) (*Lease, error) {
+	leases, err := s.unclaimedLeases()
+	if err != nil {
+		return nil, err
+	}
+	for _, lease := range leases {
+		if lease.MACAddress.String() == mac.String() {
+			return lease, nil
+		}
+	}
+	return nil, nil
+}
+
+// viewUnclaimedClaim starts claiming an unclaimed device.
+func (s *Service) viewUnclaimedClaim(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	lease, err := s.unclaimedLease(mac)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if lease == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Device %s isn't online or was already claimed.", mac)
+		return
+	}
+	if err := s.claims.start(session.Username, lease, s.timeNow()); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	http.Redirect(w, r, "/unclaimed", http.StatusFound)
+}
+
+// viewUnclaimedVerify finishes claiming an unclaimed device. The request has to
+// come from the device itself.
+func (s *Service) viewUnclaimedVerify(w http.ResponseWriter, r *http.Request) {
+	session := s.Sessions.Get(r)
+	if session == nil || session.Username == "" {
+		http.Redirect(w, r, "/oauth/login", http.StatusFound)
+		return
+	}
+	mac, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid MAC address.")
+		return
+	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+	claim := s.claims.get(session.Username, mac, s.timeNow())
+	if claim == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "You're not claiming device %s, or your claim has expired. Start again from the list of unclaimed devices.", mac)
+		return
+	}
+	lease, err := s.unclaimedLease(mac)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if lease == nil {
+		s.claims.remove(mac)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Device %s isn't online or was already claimed.", mac)
+		return
+	}
+	current, _, err := s.currentLease(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if current == nil || current.MACAddress.String() != mac.String() {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Finish claiming device %s from the device itself: open the list of unclaimed devices on it, logged in as %s.", mac, session.Username)
+		return
+	}
+	if err := s.Database.ClaimDevice(session.Username, mac, lease.Hostname, lease.ClientID); err != nil {
+		fmt.Fprintf(w, "Could not claim device: %v", err)
+		return
+	}
+	s.claims.remove(mac)
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnclaimed(t *testing.T) {
+	s := newTestService(t)
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	pi := &Lease{
+		IPAddress:  net.ParseIP("10.1.0.30"),
+		MACAddress: mustParseMAC("b8:27:eb:00:00:01"),
+		Expires:    now.Add(time.Hour),
+		RenewedAt:  now.Add(-time.Hour),
+		Hostname:   "raspberrypi",
+	}
+	s.cfg().Leases = staticLeases{
+		{IPAddress: net.ParseIP("10.1.0.23"), MACAddress: mustParseMAC("00:11:22:33:44:55"), Expires: now.Add(time.Hour), Hostname: "laptop"},
+		pi,
+		{IPAddress: net.ParseIP("10.1.0.31"), MACAddress: mustParseMAC("02:00:00:00:00:01"), Expires: now.Add(time.Hour)},
+		// Expired.
+		{IPAddress: net.ParseIP("10.1.0.32"), MACAddress: mustParseMAC("00:11:22:33:44:77"), Expires: now.Add(-time.Hour)},
+		// Equipment.
+		{IPAddress: net.ParseIP("10.1.0.33"), MACAddress: mustParseMAC("00:11:22:33:44:88"), Expires: now.Add(time.Hour)},
+	}
+	s.cfg().ShowUnclaimed = true
+	if err := s.Database.ClaimDevice("alice", mustParseMAC("00:11:22:33:44:55"), "laptop", ""); err != nil {
+		t.Fatalf("could not claim device: %v", err)
+	}
+	if err := s.Database.PutEquipment(&Equipment{MACAddress: "00:11:22:33:44:88", Description: "Printer"}); err != nil {
+		t.Fatalf("could not add equipment: %v", err)
+	}
+
+	// remote is the address requests come from, by default that of no lease.
+	remote := "192.0.2.1:1234"
+	request := func(user, method, path string, view http.HandlerFunc) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(url.Values{"csrf_token": {"token"}}.Encode()))
+		r.RemoteAddr = remote
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if parts := strings.Split(path, "/"); len(parts) > 2 {
+			r.SetPathValue("mac", parts[2])
+		}
+		for _, c := range s.sessionCookies(&Session{Username: user, CSRFToken: "token", ExpiresAt: time.Now().Add(time.Hour)}) {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		view(w, r)
+		return w
+	}
+
+	if body := request("bob", "GET", "/", s.viewIndex).Body.String(); !strings.Contains(body, "2 unidentified devices online") {
+		t.Errorf("index doesn't show unclaimed devices: %s", body)
+	}
+	body := request("bob", "GET", "/unclaimed", s.viewUnclaimed).Body.String()
+	for _, want := range []string{
+		"<td>raspberrypi</td>\n            <td>Raspberry Pi Foundation</td>",
+		"<td><i>Unknown</i></td>\n            <td><span class=\"randomized\"",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in page, got %s", want, body)
+		}
+	}
+	for _, notWant := range []string{"00:11:22:33:44:55", "00:11:22:33:44:77", "00:11:22:33:44:88"} {
+		if strings.Contains(body, notWant) {
+			t.Errorf("unexpected %s in page", notWant)
+		}
+	}
+
+	if w := request("bob", "POST", "/unclaimed/b8:27:eb:00:00:01/claim", s.viewUnclaimedClaim); w.Code != http.StatusFound {
+		t.Fatalf("claim: got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("carol", "POST", "/unclaimed/b8:27:eb:00:00:01/claim", s.viewUnclaimedClaim); w.Code != http.StatusConflict {
+		t.Errorf("concurrent claim: got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("bob", "POST", "/unclaimed/00:11:22:33:44:55/claim", s.viewUnclaimedClaim); w.Code != http.StatusNotFound {
+		t.Errorf("claim of claimed device: got %d: %s", w.Code, w.Body.String())
+	}
+	if body := request("bob", "GET", "/unclaimed", s.viewUnclaimed).Body.String(); !strings.Contains(body, "Open this page on the device before 18:15") || strings.Contains(body, "Finish claiming") {
+		t.Errorf("pending claim not shown: %s", body)
+	}
+
+	// A periodic lease renewal is no proof of ownership, the claim has to be
+	// finished from the device itself.
+	now = now.Add(time.Minute)
+	pi.RenewedAt = now
+	pi.Expires = now.Add(2 * time.Hour)
+	if w := request("bob", "POST", "/unclaimed/b8:27:eb:00:00:01/verify", s.viewUnclaimedVerify); w.Code != http.StatusForbidden {
+		t.Errorf("verify from another device: got %d: %s", w.Code, w.Body.String())
+	}
+	remote = "10.1.0.30:1234"
+	if w := request("carol", "POST", "/unclaimed/b8:27:eb:00:00:01/verify", s.viewUnclaimedVerify); w.Code != http.StatusNotFound {
+		t.Errorf("verify of someone else's claim: got %d: %s", w.Code, w.Body.String())
+	}
+	if body := request("bob", "GET", "/unclaimed", s.viewUnclaimed).Body.String(); !strings.Contains(body, "Finish claiming") {
+		t.Errorf("claim can't be finished from the device: %s", body)
+	}
+	if w := request("bob", "POST", "/unclaimed/b8:27:eb:00:00:01/verify", s.viewUnclaimedVerify); w.Code != http.StatusFound {
+		t.Fatalf("verify: got %d: %s", w.Code, w.Body.String())
+	}
+	devices, err := s.Database.GetDevicesForUser("bob")
+	if err != nil {
+		t.Fatalf("could not get devices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].MACAddress != "b8:27:eb:00:00:01" || devices[0].Hostname != "raspberrypi" {
+		t.Errorf("device not claimed: %+v", devices)
+	}
+	if body := request("bob", "GET", "/", s.viewIndex).Body.String(); !strings.Contains(body, "1 unidentified device online") {
+		t.Errorf("index doesn't show unclaimed device: %s", body)
+	}
+
+	// Claims expire.
+	remote = "10.1.0.31:1234"
+	if w := request("carol", "POST", "/unclaimed/02:00:00:00:00:01/claim", s.viewUnclaimedClaim); w.Code != http.StatusFound {
+		t.Fatalf("claim: got %d: %s", w.Code, w.Body.String())
+	}
+	now = now.Add(claimVerificationTimeout)
+	if w := request("carol", "POST", "/unclaimed/02:00:00:00:00:01/verify", s.viewUnclaimedVerify); w.Code != http.StatusNotFound {
+		t.Errorf("verify of expired claim: got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// User is the stored per-user data in the database. Users don't need to have
+// any stored data, in which case a zero User is used.
+type User struct {
+	Username string `json:"username"`
+	// SessionGeneration is incremented to revoke all existing sessions of a
+	// user. Sessions carry the generation they were issued with and are only
+	// valid if it matches.
+	SessionGeneration uint64 `json:"session_generation,omitempty"`
+	// Visibility is the default visibility of the user's devices.
+	Visibility Visibility `json:"visibility,omitempty"`
+	// Status is what the user is up to, if set.
+	Status *Status `json:"status,omitempty"`
+	// APITokenHash is the hex SHA-256 hash of the user's API token, if any.
+	APITokenHash string `json:"api_token_hash,omitempty"`
+}
+
+// hasSettings returns true if the user has any settings (as opposed to only a
+// session generation).
+func (u *User) hasSettings() bool {
+	return u.Visibility != VisibilityDefault || u.Status != nil || u.APITokenHash != ""
+}
+
+// Map from username to serialized User.
+var bucketUsers = []byte("users")
+
+// migrateCreateUsers creates the users bucket.
+func migrateCreateUsers(tx *bbolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists(bucketUsers)
+	return err
+}
+
+func getUser(tx *bbolt.Tx, username string) (*User, error) {
+	user := User{Username: username}
+	v := tx.Bucket(bucketUsers).Get([]byte(username))
+	if v == nil {
+		return &user, nil
+	}
+	if err := json.Unmarshal(v, &user); err != nil {
+		return nil, fmt.Errorf("user %q could not be unmarshaled: %w", username, err)
+	}
+	return &user, nil
+}
+
+func putUser(tx *bbolt.Tx, user *User) error {
+	v, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUsers).Put([]byte(user.Username), v)
+}
+
+func (b *BoltDatabase) GetUser(username string) (*User, error) {
+	var user *User
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		user, err = getUser(tx, username)
+		return err
+	})
+	return user, err
+}
+
+func (b *BoltDatabase) RevokeSessions(username string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		user.SessionGeneration++
+		return putUser(tx, user)
+	})
+}
+
+func (b *BoltDatabase) SetUserVisibility(username string, visibility Visibility) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		user.Visibility = visibility
+		return putUser(tx, user)
+	})
+}
+
+func (b *BoltDatabase) SetUserStatus(username string, status *Status) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		user.Status = status
+		return putUser(tx, user)
+	})
+}
+
+func (b *BoltDatabase) SetUserAPIToken(username, hash string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		user.APITokenHash = hash
+		return putUser(tx, user)
+	})
+}
+
+// GetUserByAPIToken scans all users, of which there aren't many.
+func (b *BoltDatabase) GetUserByAPIToken(hash string) (*User, error) {
+	if hash == "" {
+		return nil, nil
+	}
+	var res *User
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			user, err := getUser(tx, string(k))
+			if err != nil {
+				return err
+			}
+			if user.APITokenHash == hash {
+				res = user
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (b *BoltDatabase) GetUsers() ([]*User, error) {
+	var res []*User
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			user, err := getUser(tx, string(k))
+			if err != nil {
+				return err
+			}
+			res = append(res, user)
+			return nil
+		})
+	})
+	return res, err
+}